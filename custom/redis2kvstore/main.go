@@ -34,6 +34,8 @@ type Server struct {
 	lastConnection time.Time
 	lastError      time.Time
 	running        int64
+	stats          lib.Counters
+	breaker        *lib.Breaker
 }
 
 const (
@@ -76,7 +78,8 @@ func init() {
 // New creates a new Redis local server
 func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 	srv := &Server{
-		done: done,
+		done:    done,
+		breaker: lib.NewBreaker(&c),
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
@@ -103,6 +106,7 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 	defer srv.Unlock()
 
 	srv.config = *c
+	srv.breaker.Reload(c)
 
 	if srv.config.MaxConnections <= 0 {
 		srv.config.MaxConnections = maxConnections
@@ -146,6 +150,17 @@ func (srv *Server) Start() (e error) {
 	return
 }
 
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	s.Gauge("running", atomic.LoadInt64(&srv.running))
+	srv.breaker.AddStats(s)
+	return s
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
@@ -169,6 +184,8 @@ func (srv *Server) Exit() {
 		log.Printf("redis2kvstore ERROR: %d messages lost", n)
 	}
 
+	srv.breaker.Close()
+
 	// finishing the server
 	srv.done <- true
 }
@@ -176,7 +193,10 @@ func (srv *Server) Exit() {
 func (srv *Server) handleConnection(netCon net.Conn) {
 	defer netCon.Close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(netCon)
+	session := lib.NewSession(&srv.config)
 
 	pending := getPending()
 	defer func() {
@@ -211,11 +231,17 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			continue
 		}
 
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			resp.WriteTo(netCon)
+			continue
+		}
+
 		validCommand, ok := commands[req.Command]
 		if !ok {
 			respBadCommand.WriteTo(netCon)
 			continue
 		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
 
 		switch req.Command {
 		case "HMSET":
@@ -244,11 +270,17 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 				continue
 			}
 
+			if err := srv.breaker.Allow(); err != nil {
+				redis.NewResp(err).WriteTo(netCon)
+				continue
+			}
+
 			expire, _ := req.Items[2].Int()
 			if expire == 0 {
 				expire = defaultExpire
 			}
 			p.Sent = true
+			atomic.AddInt64(&srv.stats.Async, 1)
 			go srv.send(key, expire, p.clone())
 			validCommand.WriteTo(netCon)
 		case "HGETALL":
@@ -267,8 +299,13 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			}
 
 			// If is not in memory we go to the cluster
+			if err := srv.breaker.Allow(); err != nil {
+				redis.NewResp(err).WriteTo(netCon)
+				continue
+			}
 			items, err := srv.getHGetAll(key)
 			if err != nil {
+				atomic.AddInt64(&srv.stats.Errors, 1)
 				redis.NewResp(err).WriteTo(netCon)
 				continue
 			}
@@ -291,12 +328,17 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			}
 
 			// If is not in memory we go to the cluster
+			if err := srv.breaker.Allow(); err != nil {
+				redis.NewResp(err).WriteTo(netCon)
+				continue
+			}
 			g, err := srv.getHGet(key, item)
 			if err != nil {
 				if err == errNotFound {
 					redis.NewResp(nil).WriteTo(netCon)
 					continue
 				}
+				atomic.AddInt64(&srv.stats.Errors, 1)
 				redis.NewResp(err).WriteTo(netCon)
 				continue
 			}
@@ -348,8 +390,10 @@ func (srv *Server) send(key string, expire int, p *Hmset) {
 	}
 
 	for i := 0; i < maxConnectionsTries; i++ {
+		start := time.Now()
 		resp, err := srv.client.Post(url, strContentType, bytes.NewReader(w.B))
 		if err == nil {
+			srv.breaker.Record(start, lib.HTTPStatusError(resp.StatusCode))
 			// https://golang.org/pkg/net/http/#Response
 			// ... The default HTTP client's Transport may not
 			// reuse HTTP/1.x "keep-alive" TCP connections if the Body is
@@ -364,10 +408,12 @@ func (srv *Server) send(key string, expire int, p *Hmset) {
 			}
 			log.Printf("redis2kvstore ERROR post: [%d] %s %s", resp.StatusCode, url, err)
 		} else {
+			srv.breaker.Record(start, err)
 			log.Printf("redis2kvstore ERROR connect: %s %s", url, err)
 		}
 		time.Sleep(retryTime)
 	}
+	atomic.AddInt64(&srv.stats.Errors, 1)
 }
 
 // get will get via http the content of the key, this content will be
@@ -379,12 +425,15 @@ func (srv *Server) get(key string) (*Hmset, error) {
 	defer pool.Put(buf)
 
 	url := fmt.Sprintf("%s/get/%s", srv.config.URL, key)
+	start := time.Now()
 	resp, err := http.Get(url)
 	if err != nil {
+		srv.breaker.Record(start, err)
 		log.Printf("redis2kvstore ERROR connect: %s %s", url, err)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	srv.breaker.Record(start, lib.HTTPStatusError(resp.StatusCode))
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("Error: %s %s", url, resp.Status)
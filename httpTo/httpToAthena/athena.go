@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gallir/smart-relayer/httpTo/httpToAthena/ifaceAthena"
@@ -25,6 +26,7 @@ type Server struct {
 	iface          *ifaceAthena.Athena
 	lastConnection time.Time
 	lastError      time.Time
+	stats          lib.Counters
 }
 
 var (
@@ -86,6 +88,14 @@ func (srv *Server) Start() (e error) {
 	return e
 }
 
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	return srv.stats.Stats(&srv.config)
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
@@ -99,6 +109,8 @@ func (srv *Server) Exit() {
 }
 
 func (srv *Server) query(ctx *gin.Context) {
+	atomic.AddInt64(&srv.stats.Commands, 1)
+
 	b, err := ioutil.ReadAll(ctx.Request.Body)
 	if err != nil {
 		ctx.String(http.StatusBadRequest, err.Error())
@@ -107,6 +119,7 @@ func (srv *Server) query(ctx *gin.Context) {
 
 	r, err := srv.iface.Query(ctx.Param("database"), string(b))
 	if err != nil {
+		atomic.AddInt64(&srv.stats.Errors, 1)
 		ctx.IndentedJSON(http.StatusBadRequest, map[string]interface{}{
 			"Error": err.Error(),
 		})
@@ -119,6 +132,8 @@ func (srv *Server) query(ctx *gin.Context) {
 }
 
 func (srv *Server) get(ctx *gin.Context) {
+	atomic.AddInt64(&srv.stats.Commands, 1)
+
 	nextToken := ctx.GetHeader("X-NextToken")
 
 	timeOut, err := time.ParseDuration(ctx.GetHeader("X-Timeout"))
@@ -149,6 +164,7 @@ func (srv *Server) get(ctx *gin.Context) {
 				if err == ifaceAthena.ErrPending {
 					continue
 				}
+				atomic.AddInt64(&srv.stats.Errors, 1)
 				ctx.IndentedJSON(http.StatusBadRequest, map[string]interface{}{
 					"Error": err.Error(),
 				})
@@ -22,6 +22,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gallir/smart-relayer/lib"
@@ -46,6 +47,9 @@ type HttpProxy struct {
 	server     *http.Server
 	bufferPool Pool
 	done       chan bool
+	config     lib.RelayerConfig
+	stats      lib.Counters
+	breaker    *lib.Breaker
 }
 
 // New returns a new http reverse proxy
@@ -53,11 +57,13 @@ func New(c lib.RelayerConfig, done chan bool) (*HttpProxy, error) {
 	s := &HttpProxy{
 		transport: &http.Transport{},
 		done:      done,
+		breaker:   lib.NewBreaker(&c),
 	}
 
 	s.proxy = &httputil.ReverseProxy{
-		Director:  s.director,
-		Transport: s.transport,
+		Director:     s.director,
+		Transport:    s,
+		ErrorHandler: s.errorHandler,
 	}
 
 	s.limiter = newLimitHandler(s.proxy)
@@ -76,7 +82,9 @@ func (s *HttpProxy) Reload(c *lib.RelayerConfig) error {
 	s.Lock()
 	defer s.Unlock()
 
+	s.config = *c
 	s.listen = c.Listen
+	s.breaker.Reload(c)
 
 	s.limiter.MaxConns(c.MaxConnections)
 
@@ -123,18 +131,31 @@ func (s *HttpProxy) Start() error {
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
+			ConnState:      s.connState,
 		}
 	}
 	go s.serve()
 	return nil
 }
 
+// Stats returns the counters and the current state of the relayer
+func (s *HttpProxy) Stats() *lib.Stats {
+	s.Lock()
+	defer s.Unlock()
+
+	st := s.stats.Stats(&s.config)
+	st.Queued = int64(s.limiter.active())
+	s.breaker.AddStats(st)
+	return st
+}
+
 // Exit closes the listener and send done to main
 func (s *HttpProxy) Exit() {
 	s.Lock()
 	defer s.Unlock()
 	s.server.Close()
 	s.transport.CloseIdleConnections()
+	s.breaker.Close()
 	s.done <- true
 }
 
@@ -170,6 +191,42 @@ func (s *HttpProxy) serve() {
 	s.Unlock()
 }
 
+func (s *HttpProxy) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		atomic.AddInt64(&s.stats.Connections, 1)
+	}
+}
+
+// RoundTrip sends the request to the target using the transport of the proxy,
+// it fails without sending it if the breaker is open
+func (s *HttpProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&s.stats.Commands, 1)
+	if err := s.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := s.transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&s.stats.Errors, 1)
+		s.breaker.Record(start, err)
+		return resp, err
+	}
+	s.breaker.Record(start, lib.HTTPStatusError(resp.StatusCode))
+	return resp, nil
+}
+
+// errorHandler answers 503 if the breaker is open, and 502 for the rest of
+// errors as the default handler of the proxy
+func (s *HttpProxy) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	if err == lib.ErrBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("E: Error in http proxy %s: %s", s.listen, err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 func (s *HttpProxy) director(req *http.Request) {
 	req.URL.Scheme = s.target.Scheme
 	req.URL.Host = s.target.Host
@@ -224,6 +281,14 @@ func (h *limitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	<-sem
 }
 
+// active returns the number of requests holding a slot of the limiter
+func (h *limitHandler) active() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.sem)
+}
+
 func (h *limitHandler) MaxConns(maxConns int) {
 	h.Lock()
 	defer h.Unlock()
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+const authCommand = "AUTH"
+
+var (
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errAuthArgs  = errors.New("ERR wrong number of arguments for 'auth' command")
+
+	respNoAuth    = redis.NewResp(errNoAuth)
+	respWrongPass = redis.NewResp(errWrongPass)
+	respAuthArgs  = redis.NewResp(errAuthArgs)
+	respAuthOK    = redis.NewRespSimple("OK")
+)
+
+// ACL defines the password and the commands allowed to the local clients
+// of a relayer
+type ACL struct {
+	username string
+	password string
+	allow    map[string]bool // If not empty only these commands are allowed
+	deny     map[string]bool
+}
+
+// NewACL creates the ACL from the configuration of the relayer
+func NewACL(c *RelayerConfig) *ACL {
+	a := &ACL{
+		username: c.LocalUsername,
+		password: c.LocalPassword,
+		allow:    commandSet(c.AllowCommands),
+		deny:     commandSet(c.DenyCommands),
+	}
+	if a.username == "" {
+		a.username = "default"
+	}
+	return a
+}
+
+func commandSet(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, c := range strings.Fields(s) {
+		m[strings.ToUpper(c)] = true
+	}
+	return m
+}
+
+// Allowed returns true if the command can be executed
+func (a *ACL) Allowed(cmd string) bool {
+	if a.deny[cmd] {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow[cmd]
+}
+
+// Session keeps the authentication state of a local connection
+type Session struct {
+	acl           *ACL
+	authenticated bool
+}
+
+// NewSession creates the state for a new connection of a relayer
+func NewSession(c *RelayerConfig) *Session {
+	acl := NewACL(c)
+	return &Session{
+		acl:           acl,
+		authenticated: acl.password == "",
+	}
+}
+
+// Check verifies the command of a local client. It returns the response
+// that must be sent to the client if the command must not be processed:
+// the result of the AUTH or the NOAUTH and NOPERM errors. It returns nil
+// if the command can continue.
+func (s *Session) Check(cmd string, items []*redis.Resp) *redis.Resp {
+	if cmd == authCommand && s.acl.password != "" {
+		return s.auth(items)
+	}
+
+	if !s.authenticated && cmd != "QUIT" {
+		return respNoAuth
+	}
+
+	if !s.acl.Allowed(cmd) {
+		return redis.NewResp(fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", strings.ToLower(cmd)))
+	}
+	return nil
+}
+
+func (s *Session) auth(items []*redis.Resp) *redis.Resp {
+	user := "default"
+	var pass string
+	switch len(items) {
+	case 2:
+		pass, _ = items[1].Str()
+	case 3:
+		user, _ = items[1].Str()
+		pass, _ = items[2].Str()
+	default:
+		return respAuthArgs
+	}
+
+	if subtle.ConstantTimeCompare([]byte(user), []byte(s.acl.username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(s.acl.password)) != 1 {
+		return respWrongPass
+	}
+	s.authenticated = true
+	return respAuthOK
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func check(s *Session, args ...interface{}) *redis.Resp {
+	items, _ := redis.NewResp(args).Array()
+	return s.Check(args[0].(string), items)
+}
+
+func TestSessionAuth(t *testing.T) {
+	s := NewSession(&RelayerConfig{LocalPassword: "secret"})
+
+	if r := check(s, "GET", "a"); r != respNoAuth {
+		t.Fatalf("expected NOAUTH, got %s", r)
+	}
+	if r := check(s, "AUTH", "bad"); r != respWrongPass {
+		t.Fatalf("expected WRONGPASS, got %s", r)
+	}
+	if r := check(s, "AUTH", "secret"); r != respAuthOK {
+		t.Fatalf("expected OK, got %s", r)
+	}
+	if r := check(s, "GET", "a"); r != nil {
+		t.Fatalf("expected nil, got %s", r)
+	}
+
+	s = NewSession(&RelayerConfig{LocalUsername: "app", LocalPassword: "secret"})
+	if r := check(s, "AUTH", "default", "secret"); r != respWrongPass {
+		t.Fatalf("expected WRONGPASS, got %s", r)
+	}
+	if r := check(s, "AUTH", "app", "secret"); r != respAuthOK {
+		t.Fatalf("expected OK, got %s", r)
+	}
+}
+
+func TestSessionCommands(t *testing.T) {
+	s := NewSession(&RelayerConfig{DenyCommands: "flushall flushdb"})
+	if r := check(s, "FLUSHALL"); r == nil || r.Err == nil {
+		t.Fatal("FLUSHALL must be denied")
+	}
+	if r := check(s, "GET", "a"); r != nil {
+		t.Fatalf("expected nil, got %s", r)
+	}
+
+	s = NewSession(&RelayerConfig{AllowCommands: "GET SET"})
+	if r := check(s, "DEL", "a"); r == nil || r.Err == nil {
+		t.Fatal("DEL must be denied")
+	}
+	if r := check(s, "SET", "a", "1"); r != nil {
+		t.Fatalf("expected nil, got %s", r)
+	}
+}
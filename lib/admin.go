@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Admin is the http server that exposes the state of the relayers,
+// it's started only if Admin is defined in the configuration
+type Admin struct {
+	listen   string
+	listener *Listener
+	server   *http.Server
+	stats    func() []*Stats
+}
+
+// NewAdmin starts listening in the address defined by listen. The stats
+// function is called for every request to get the state of the relayers
+func NewAdmin(listen string, stats func() []*Stats) (a *Admin, err error) {
+	a = &Admin{
+		listen: listen,
+		stats:  stats,
+	}
+
+	a.listener, err = NewListener(RelayerConfig{Listen: listen})
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.relayers)
+	mux.HandleFunc("/relayers", a.relayers)
+	mux.HandleFunc("/metrics", a.metrics)
+	a.server = &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		err := a.server.Serve(a.listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("E: Error in admin server", listen, err)
+		}
+	}()
+	return a, nil
+}
+
+// Listen returns the address where the admin server is listening
+func (a *Admin) Listen() string {
+	return a.listen
+}
+
+// Exit stops the admin server
+func (a *Admin) Exit() {
+	a.server.Close()
+	a.listener.Close()
+}
+
+func (a *Admin) relayers(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" && req.URL.Path != "/relayers" {
+		http.NotFound(w, req)
+		return
+	}
+
+	stats := a.stats()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Listen < stats[j].Listen
+	})
+
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (a *Admin) metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(w, a.stats())
+}
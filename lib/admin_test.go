@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAdminRelayers(t *testing.T) {
+	c := &Counters{}
+	conf := &RelayerConfig{
+		Protocol: "redis",
+		Mode:     "smart",
+		Listen:   "tcp://:6389",
+		URL:      "tcp://127.0.0.1:6379",
+	}
+
+	a, err := NewAdmin("tcp://127.0.0.1:0", func() []*Stats {
+		s := c.Stats(conf)
+		s.Gauge("capacity", 10)
+		return []*Stats{s}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Exit()
+
+	c.Connections = 2
+	c.Commands = 5
+
+	resp, err := http.Get("http://" + a.listener.Addr().String() + "/relayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var stats []*Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 1 {
+		t.Fatalf("Expected 1 relayer, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Mode != "smart" || s.Target != conf.URL || s.Listen != conf.Listen {
+		t.Errorf("Bad relayer description %#v", s)
+	}
+	if s.Connections != 2 || s.Commands != 5 || s.Gauges["capacity"] != 10 {
+		t.Errorf("Bad counters %#v", s)
+	}
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker for the calls of a relayer to its upstream.
+// It's closed while the calls work, it opens when the percentage of failed
+// calls in the window reaches BreakerErrors, the calls slower than
+// BreakerLatency also count as failed. While it's open the calls are
+// rejected with ErrBreakerOpen, after BreakerCooldown it's half-open and
+// lets one call try the upstream: it's closed again if the call works,
+// otherwise it's open for another cool-down.
+//
+// The breaker is disabled if BreakerErrors is 0, the methods can be
+// called on a nil Breaker and do nothing.
+
+// BreakerState is the state of a Breaker
+type BreakerState int
+
+// The states of the breaker, their values are the ones in the metrics
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+const (
+	defaultBreakerMinCalls = 20
+	defaultBreakerWindow   = 10 * time.Second
+	defaultBreakerCooldown = 5 * time.Second
+)
+
+var (
+	// ErrBreakerOpen is the error for the clients while the breaker is open
+	ErrBreakerOpen = errors.New("ERR upstream unavailable, circuit breaker open")
+
+	breakerState = NewGaugeVec("breaker_state", "State of the circuit breaker: 0 closed, 1 open, 2 half-open", "relayer")
+	breakerOpens = NewCounterVec("breaker_opens_total", "Times the circuit breaker was opened", "relayer")
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker is created by NewBreaker
+type Breaker struct {
+	sync.Mutex
+	name        string
+	errorRate   int
+	latency     time.Duration
+	minCalls    int
+	window      time.Duration
+	cooldown    time.Duration
+	state       BreakerState
+	calls       int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probeAt     time.Time // When the call of the half-open state was allowed, zero if none
+	opens       int64
+}
+
+// NewBreaker returns the breaker of the relayer
+func NewBreaker(c *RelayerConfig) *Breaker {
+	b := &Breaker{
+		name: c.Listen,
+	}
+	b.configure(c)
+	breakerState.With(b.name).Set(float64(BreakerClosed))
+	return b
+}
+
+// NewConnectBreaker returns a breaker for the connections of a client to
+// the upstream: it opens when a connection fails and lets one try every
+// cooldown. It has no logs nor metrics, the calls that fail because the
+// client isn't connected are notified to the breaker of the relayer
+func NewConnectBreaker(cooldown time.Duration) *Breaker {
+	return &Breaker{
+		errorRate: 100,
+		minCalls:  1,
+		window:    cooldown,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *Breaker) configure(c *RelayerConfig) {
+	b.errorRate = c.BreakerErrors
+	b.latency = time.Duration(c.BreakerLatency) * time.Millisecond
+	b.minCalls = c.BreakerMinCalls
+	if b.minCalls <= 0 {
+		b.minCalls = defaultBreakerMinCalls
+	}
+	b.window = time.Duration(c.BreakerWindow) * time.Second
+	if b.window <= 0 {
+		b.window = defaultBreakerWindow
+	}
+	b.cooldown = time.Duration(c.BreakerCooldown) * time.Second
+	if b.cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+}
+
+// Reload changes the thresholds, the breaker is closed if they changed
+func (b *Breaker) Reload(c *RelayerConfig) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	errorRate, latency, minCalls, window, cooldown := b.errorRate, b.latency, b.minCalls, b.window, b.cooldown
+	b.configure(c)
+	if b.errorRate != errorRate || b.latency != latency || b.minCalls != minCalls ||
+		b.window != window || b.cooldown != cooldown {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Reset closes the breaker, e.g. after a change of the upstream
+func (b *Breaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.setState(BreakerClosed)
+}
+
+// Allow returns ErrBreakerOpen if the call must be rejected. The result
+// of the allowed calls must be notified with Record
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case b.errorRate <= 0 || b.state == BreakerClosed:
+		return nil
+	case b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown:
+		b.setState(BreakerHalfOpen)
+		b.probeAt = time.Now()
+		return nil
+	case b.state == BreakerHalfOpen && (b.probeAt.IsZero() || time.Since(b.probeAt) >= b.cooldown):
+		// The previous try didn't finish, or its result was lost
+		b.probeAt = time.Now()
+		return nil
+	}
+	return ErrBreakerOpen
+}
+
+// Record notifies the result of a call started at start, err is not nil if
+// the upstream failed. The errors of the application, e.g. a bad command,
+// must not be notified as failures
+func (b *Breaker) Record(start time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.errorRate <= 0 {
+		return
+	}
+	failed := err != nil || (b.latency > 0 && time.Since(start) > b.latency)
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.logf("the try in half-open state failed: %v", err)
+			b.setState(BreakerOpen)
+		} else {
+			b.setState(BreakerClosed)
+		}
+	case BreakerClosed:
+		if time.Since(b.windowStart) > b.window {
+			b.windowStart = time.Now()
+			b.calls, b.failures = 0, 0
+		}
+		b.calls++
+		if failed {
+			b.failures++
+		}
+		if b.calls >= b.minCalls && b.failures*100 >= b.errorRate*b.calls {
+			b.logf("%d of %d calls failed", b.failures, b.calls)
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+func (b *Breaker) setState(s BreakerState) {
+	if s == b.state {
+		return
+	}
+	b.logf("changed from %s to %s", b.state, s)
+	b.state = s
+	b.calls, b.failures = 0, 0
+	b.windowStart = time.Now()
+	b.probeAt = time.Time{}
+	if s == BreakerOpen {
+		b.openedAt = time.Now()
+		b.opens++
+	}
+	if b.name == "" {
+		return
+	}
+	if s == BreakerOpen {
+		breakerOpens.With(b.name).Inc()
+	}
+	breakerState.With(b.name).Set(float64(s))
+}
+
+// logf logs the changes of the breakers of the relayers, the ones of the
+// connections are too verbose
+func (b *Breaker) logf(format string, args ...interface{}) {
+	if b.name == "" {
+		return
+	}
+	log.Printf("Breaker: %s "+format, append([]interface{}{b.name}, args...)...)
+}
+
+// State returns the current state
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// AddStats adds the state of the breaker to the stats of the relayer
+func (b *Breaker) AddStats(s *Stats) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.errorRate <= 0 {
+		return
+	}
+	s.Gauge("breakerState", int64(b.state))
+	s.Gauge("breakerOpens", b.opens)
+}
+
+// HTTPStatusError returns the error to notify to the breaker for the status
+// of an HTTP response, only the errors of the server (5xx) are failures
+func HTTPStatusError(code int) error {
+	if code < 500 {
+		return nil
+	}
+	return fmt.Errorf("HTTP status %d", code)
+}
+
+// Close removes the metrics of the breaker
+func (b *Breaker) Close() {
+	if b == nil || b.name == "" {
+		return
+	}
+	breakerState.Delete(b.name)
+	breakerOpens.Delete(b.name)
+}
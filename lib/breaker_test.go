@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(&RelayerConfig{
+		Listen:          "breaker-test",
+		BreakerErrors:   50,
+		BreakerMinCalls: 4,
+		BreakerCooldown: 1,
+	})
+	defer b.Close()
+	errFailed := errors.New("failed")
+
+	// Below the error rate
+	for _, err := range []error{nil, nil, nil, errFailed} {
+		if e := b.Allow(); e != nil {
+			t.Fatalf("closed breaker rejected the call: %s", e)
+		}
+		b.Record(time.Now(), err)
+	}
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("expected closed, got %s", s)
+	}
+
+	for i := 0; i < 4; i++ {
+		b.Record(time.Now(), errFailed)
+	}
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("expected open, got %s", s)
+	}
+	if e := b.Allow(); e != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen, got %v", e)
+	}
+
+	// Only one call in half-open state, it opens again if it fails
+	b.openedAt = time.Now().Add(-time.Second)
+	if e := b.Allow(); e != nil {
+		t.Fatalf("expected a try after the cool-down, got %s", e)
+	}
+	if e := b.Allow(); e != ErrBreakerOpen {
+		t.Fatalf("expected only one try in half-open state, got %v", e)
+	}
+	b.Record(time.Now(), errFailed)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("expected open after the failed try, got %s", s)
+	}
+
+	b.openedAt = time.Now().Add(-time.Second)
+	if e := b.Allow(); e != nil {
+		t.Fatalf("expected a try after the cool-down, got %s", e)
+	}
+	b.Record(time.Now(), nil)
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("expected closed after the successful try, got %s", s)
+	}
+
+	s := &Stats{}
+	b.AddStats(s)
+	if s.Gauges["breakerOpens"] != 2 || s.Gauges["breakerState"] != int64(BreakerClosed) {
+		t.Errorf("unexpected stats %v", s.Gauges)
+	}
+}
+
+func TestBreakerLatency(t *testing.T) {
+	b := NewBreaker(&RelayerConfig{
+		Listen:          "breaker-latency-test",
+		BreakerErrors:   60,
+		BreakerLatency:  10,
+		BreakerMinCalls: 2,
+	})
+	defer b.Close()
+
+	b.Record(time.Now(), nil)
+	b.Record(time.Now().Add(-20*time.Millisecond), nil)
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("expected closed, got %s", s)
+	}
+	b.Record(time.Now().Add(-20*time.Millisecond), nil)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("expected open by the slow calls, got %s", s)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	var nilBreaker *Breaker
+	if err := nilBreaker.Allow(); err != nil {
+		t.Errorf("nil breaker: %s", err)
+	}
+	nilBreaker.Record(time.Now(), errors.New("failed"))
+
+	b := NewBreaker(&RelayerConfig{Listen: "breaker-disabled-test"})
+	defer b.Close()
+	for i := 0; i < 100; i++ {
+		b.Record(time.Now(), errors.New("failed"))
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("disabled breaker: %s", err)
+	}
+}
+
+func TestBreakerClose(t *testing.T) {
+	b := NewBreaker(&RelayerConfig{
+		Listen:          "breaker-close-test",
+		BreakerErrors:   50,
+		BreakerMinCalls: 1,
+	})
+	b.Record(time.Now(), errors.New("failed"))
+	b.Close()
+
+	for _, v := range []*metricVec{breakerState.metricVec, breakerOpens.metricVec} {
+		v.Lock()
+		_, ok := v.series[v.labelsKey([]string{"breaker-close-test"})]
+		v.Unlock()
+		if ok {
+			t.Errorf("%s wasn't removed", v.name)
+		}
+	}
+}
+
+func TestConnectBreaker(t *testing.T) {
+	b := NewConnectBreaker(time.Second)
+
+	// One failed connection opens it
+	b.Record(time.Now(), errors.New("failed"))
+	if e := b.Allow(); e != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen, got %v", e)
+	}
+
+	b.openedAt = time.Now().Add(-time.Second)
+	if e := b.Allow(); e != nil {
+		t.Fatalf("expected a try after the cool-down, got %s", e)
+	}
+	b.Reset()
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("expected closed after the connection, got %s", s)
+	}
+	b.Close()
+}
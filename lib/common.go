@@ -8,6 +8,11 @@ type Relayer interface {
 	Exit()
 }
 
+// RelayerStats is implemented by the relayers to expose their state and counters
+type RelayerStats interface {
+	Stats() *Stats
+}
+
 type RelayerClient interface {
 	IsValid() bool
 	Exit()
@@ -34,5 +39,4 @@ func init() {
 	flag.StringVar(&GlobalConfig.ConfigFileName, "c", "relayer.conf", "Configuration filename")
 	flag.BoolVar(&GlobalConfig.Debug, "d", false, "Show debug info")
 	flag.BoolVar(&GlobalConfig.ShowVersion, "v", false, "Show version and exit")
-	flag.Parse()
 }
@@ -3,6 +3,8 @@ package lib
 import (
 	"log"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -17,11 +19,12 @@ type Config struct {
 	Comment        string
 	GOGC           int //GCPercent
 	Relayer        []RelayerConfig
-	BufferPoolSize int // If > 0 it will use bybufferpools in redis.Resp if size > BufferPoolSize
+	BufferPoolSize int    // If > 0 it will use bybufferpools in redis.Resp if size > BufferPoolSize
+	Admin          string // Local url for the admin http server, disabled if empty
 }
 
 type RelayerConfig struct {
-	Protocol           string // redis | redis2 | redis-cluster | redis-plus | firehose
+	Protocol           string // redis | redis2 | redis-cluster | redis-plus | firehose | memcached
 	Mode               string // smart | sync
 	Critical           bool
 	Listen             string // Local url | also is streamName for Kinesis Firehose
@@ -38,8 +41,10 @@ type RelayerConfig struct {
 	UseBufferPool bool // used by the http proxy, enable or diable buffer pool
 
 	//	Parallel           bool // For redis-cluster, send parallel requests
-	Pipeline int // If > 0 it does pipelining (buffering)
-	Timeout  int // Timeout in seconds to wait for responses from the server
+	Pipeline       int // If > 0 it does pipelining (buffering), max commands before flushing
+	PipelineBytes  int // Max bytes in the pipeline before flushing, 0 is unlimited
+	PipelineLinger int // Microseconds a command can wait in the pipeline, if 0 it's flushed when there are no more commands
+	Timeout        int // Timeout in seconds to wait for responses from the server
 
 	MaxRecords int    // To send in batch to Kinesis
 	Buffer     int    // Size for the channel (queue for Kinesis/Firehose)
@@ -50,12 +55,72 @@ type RelayerConfig struct {
 	Concat     bool   // Kinesis/Firehose contact messages, valid just for S3 backend
 	Path       string // Path were to store the logs
 	S3Bucket   string // S3 Bucket name
+	S3Endpoint string // S3 endpoint with path style, e.g. a local S3 stand-in, the AWS one if empty
+
+	Archive        bool // FS: pack the closed minute directories in tar files, upload them to S3Bucket and delete them
+	ArchiveGrace   int  // FS: seconds after the end of a minute before archiving its directory, 120 if 0
+	ArchiveMaxSize int  // FS: max MB of each tar file, 512 if 0
+
+	Retention      string // FS: policies "project:maxAge:maxMB" separated by spaces, maxAge is a duration like 24h, "*" is the default project, 0 is unlimited
+	QuotaHighWater int    // FS: percent of maxMB used by a project above which its SETs are rejected, 95 if 0
+	Durability     string // FS: "none", "file" to fsync the files before renaming them into place, "dir" to fsync also their directory, none if empty
+	Storage        string // FS: "local" for the files in Path, "s3" to put an object in S3Bucket for each message (without KEYS), local if empty
+	FallbackPath   string // FS: directory for the messages that failed WriteRetries times in the storage
+	WriteRetries   int    // FS: failed writes of a message before using FallbackPath, or dropping it without it, 3 if 0
+
+	Sentinels  string // Redis Sentinel URLs separated by spaces, the URL of the master is obtained from them
+	MasterName string // Name of the master in the sentinels
+
+	FailoverFailures int // Failed connections to the current upstream of the redis URL list before switching to the next one, 3 if 0
+	FailbackSecs     int // Seconds the first upstream of the redis URL list must be healthy to fail back to it, 30 if 0
+
+	Username      string // ACL user for the Redis AUTH, requires Password
+	Password      string // Password for the Redis AUTH, disabled if empty
+	TLS           bool   // Use TLS in the connections to Redis
+	TLSCA         string // File with the CA certificates to verify the server, the system ones if empty
+	TLSCert       string // Client certificate file
+	TLSKey        string // Client key file
+	TLSServerName string // Name to verify the certificate of the server, the host of the URL if empty
+	TLSSkipVerify bool   // Don't verify the certificate of the server
+
+	LocalUsername string // User for the AUTH of the local clients, "default" if empty
+	LocalPassword string // Password required to the local clients, disabled if empty
+	AllowCommands string // Commands allowed to the local clients separated by spaces, all if empty
+	DenyCommands  string // Commands forbidden to the local clients separated by spaces
 
 	Shards          int // Shards for FS plugin
 	Writers         int // Writers BY shard (each shard will have the number of workers defined here)
 	BreakMultiplier int // Limit to declare as failing. Total writes plus this value
 
-	AsynCommands string
+	DBPrefix string // Emulate SELECT in redis-cluster prefixing the keys with this template, %d is the database, e.g. "db%d:"
+	ReadFrom string // Cluster nodes for the reads: "master" (default), "prefer-replica" or "round-robin"
+
+	MirrorURL string // Redis that also receives the writes, in background and without affecting the clients
+	MirrorAll bool   // Mirror all the commands, not only the writes
+
+	HashTag       string // Two characters, e.g. "{}", only the part of the key between them is hashed
+	EjectFailures int    // Failures to eject a node of the sharded relayer, disabled if 0
+	EjectSecs     int    // Seconds an ejected node is out of the ring
+
+	BreakerErrors   int // Percentage of failed calls to the upstream that opens the circuit breaker, disabled if 0
+	BreakerLatency  int // Milliseconds, the slower calls count as failed for the breaker, 0 to ignore the latency
+	BreakerMinCalls int // Calls in the window before the breaker checks the percentage of failures, 20 if 0
+	BreakerWindow   int // Seconds of the window where the breaker counts the calls, 10 if 0
+	BreakerCooldown int // Seconds the breaker is open before letting a call try the upstream, 5 if 0
+
+	AsynCommands  string
+	LoadCommands  bool // Update the table of commands with the COMMAND reply of the server at start, only the first relayer does it
+	Consistent    bool // The reads of a connection wait for its previous async writes of the same keys
+	ErrorsJournal int  // Failed async commands kept for the local command RELAYER ERRORS, 128 if 0
+	Coalesce      int  // Milliseconds the async SET, SETEX, PSETEX, HSET and HMSET are held to send only the last one of the same key, disabled if 0
+
+	CachePatterns string // Patterns of the keys whose GETs are answered from a local cache, separated by spaces, disabled if empty
+	CacheSize     int    // Max number of keys in the local cache, 10000 if 0
+	CacheTTL      int    // Seconds a value is kept in the local cache, 0 is unlimited
+
+	Spool        string // Directory to store the async commands that couldn't be sent, disabled if empty
+	SpoolMaxSize int    // Max size of the spool in MB, 0 is unlimited
+	SpoolMaxAge  int    // Seconds, older commands in the spool are discarded, 0 is unlimited
 }
 
 func ReadConfig(filename string) (config *Config, err error) {
@@ -84,8 +149,41 @@ func (c *RelayerConfig) Type() int {
 	return ModeSync
 }
 
+// Target returns the destination of the relayer: the URL, the stream or the path
+func (c *RelayerConfig) Target() string {
+	switch {
+	case c.URL != "":
+		return c.URL
+	case c.StreamName != "":
+		return c.StreamName
+	default:
+		return c.Path
+	}
+}
+
+// ResponseTimeout returns the Timeout as a duration, or the default if it's not defined
+func (c *RelayerConfig) ResponseTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return responseTimeout * time.Second
+}
+
+// URLs returns the list of URLs, separated by spaces in the configuration
+func (c *RelayerConfig) URLs() []string {
+	return strings.Fields(c.URL)
+}
+
+// firstURL is used when only one server is expected
+func (c *RelayerConfig) firstURL() string {
+	if urls := c.URLs(); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
 func (c *RelayerConfig) Scheme() (scheme string) {
-	u, err := url.Parse(c.URL)
+	u, err := url.Parse(c.firstURL())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -94,7 +192,7 @@ func (c *RelayerConfig) Scheme() (scheme string) {
 }
 
 func (c *RelayerConfig) Host() (host string) {
-	host, err := Host(c.URL)
+	host, err := Host(c.firstURL())
 	if err != nil {
 		log.Fatal(err)
 	}
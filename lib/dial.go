@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+var errBadCA = errors.New("no valid certificates in TLSCA")
+
+// The table of commands is shared by all the relayers, it's updated only
+// once so a relayer doesn't change the commands of the others
+var commandsLoaded struct {
+	sync.Mutex
+	from string // Host whose reply is in the table, empty if none
+}
+
+// TLSConfig returns the configuration for the connections to the upstream
+// servers, nil if TLS is not enabled
+func (c *RelayerConfig) TLSConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSSkipVerify,
+	}
+
+	if c.TLSCA != "" {
+		b, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errBadCA
+		}
+	}
+
+	if c.TLSCert != "" || c.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ConnectionChanged returns true if the new configuration requires to
+// open again the connections to the upstream servers
+func (c *RelayerConfig) ConnectionChanged(n *RelayerConfig) bool {
+	return c.URL != n.URL ||
+		c.Username != n.Username || c.Password != n.Password ||
+		c.TLS != n.TLS || c.TLSCA != n.TLSCA || c.TLSCert != n.TLSCert || c.TLSKey != n.TLSKey ||
+		c.TLSServerName != n.TLSServerName || c.TLSSkipVerify != n.TLSSkipVerify
+}
+
+// DialRedis connects to a Redis server using TLS if it's enabled in the
+// configuration, and authenticates the connection if there is a password
+func DialRedis(c *RelayerConfig, network, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			if host, _, e := net.SplitHostPort(addr); e == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if err := Auth(conn, c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Auth sends the AUTH command with the username and password of the
+// configuration, it does nothing if there is no password
+func Auth(conn net.Conn, c *RelayerConfig) error {
+	if c.Password == "" {
+		return nil
+	}
+
+	args := []interface{}{"AUTH", c.Password}
+	if c.Username != "" {
+		args = []interface{}{"AUTH", c.Username, c.Password}
+	}
+	if _, err := redis.NewResp(args).WriteTo(conn); err != nil {
+		return err
+	}
+
+	r := redis.NewRespReader(conn).Read()
+	if r.Err != nil {
+		return fmt.Errorf("AUTH failed: %s", r.Err)
+	}
+	return nil
+}
+
+// LoadCommands updates the table of commands with the reply of COMMAND
+// of the first server of the configuration. Only the first relayer that
+// loads them updates the table, the next calls do nothing
+func LoadCommands(c *RelayerConfig) error {
+	commandsLoaded.Lock()
+	defer commandsLoaded.Unlock()
+	if commandsLoaded.from != "" {
+		log.Printf("Commands already loaded from %s, ignored for %s", commandsLoaded.from, c.Host())
+		return nil
+	}
+
+	timeout := c.ResponseTimeout()
+	conn, err := DialRedis(c, c.Scheme(), c.Host(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	n, err := commands.Load(conn)
+	if err != nil {
+		return err
+	}
+	commandsLoaded.from = c.Host()
+	log.Printf("Loaded %d commands from %s", n, c.Host())
+	return nil
+}
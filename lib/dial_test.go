@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+	"github.com/gallir/smart-relayer/redis/redistest"
+)
+
+func TestDialRedisAuth(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetAuth("relayer", "secret")
+
+	c := &RelayerConfig{Username: "relayer", Password: "bad"}
+	if _, err := DialRedis(c, "tcp", rs.Addr(), time.Second); err == nil {
+		t.Fatal("expected error with a wrong password")
+	}
+
+	c.Password = "secret"
+	conn, err := DialRedis(c, "tcp", rs.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	redis.NewResp([]interface{}{"PING"}).WriteTo(conn)
+	if s, _ := redis.NewRespReader(conn).Read().Str(); s != "PONG" {
+		t.Fatalf("expected PONG, got %q", s)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	c := &RelayerConfig{}
+	if cfg, err := c.TLSConfig(); cfg != nil || err != nil {
+		t.Fatal("TLS must be disabled by default")
+	}
+
+	c = &RelayerConfig{TLS: true, TLSServerName: "redis.local", TLSCA: "/nonexistent/ca.pem"}
+	if _, err := c.TLSConfig(); err == nil {
+		t.Fatal("expected error with a missing CA file")
+	}
+
+	c.TLSCA = ""
+	cfg, err := c.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "redis.local" {
+		t.Fatalf("bad server name %q", cfg.ServerName)
+	}
+}
+
+func TestLoadCommands(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	commandsLoaded.Lock()
+	commandsLoaded.from = ""
+	commandsLoaded.Unlock()
+	if err := LoadCommands(&RelayerConfig{URL: rs.URL()}); err != nil {
+		t.Fatal(err)
+	}
+	if rs.Count("COMMAND") != 1 {
+		t.Error("COMMAND wasn't sent")
+	}
+
+	// Another relayer doesn't change the table
+	other, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := LoadCommands(&RelayerConfig{URL: other.URL()}); err != nil {
+		t.Fatal(err)
+	}
+	if other.Count("COMMAND") != 0 {
+		t.Error("the commands were loaded twice")
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 )
 
 type Listener struct {
+	sync.Mutex
 	config   RelayerConfig
 	listener net.Listener
+	closed   bool
 }
 
 // MewListener check sockets and files and return a listener alread listening
@@ -39,26 +42,24 @@ func NewListener(c RelayerConfig) (l *Listener, e error) {
 
 }
 
+// Close stops the listener, the pending and next Accept calls return an
+// error. The listener isn't removed, Accept can be running meanwhile
 func (l *Listener) Close() error {
-	if l.listener != nil {
-		e := l.listener.Close()
-		l.listener = nil
-		return e
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return nil
 	}
-	return nil
+	l.closed = true
+	return l.listener.Close()
 }
 
 func (l *Listener) Addr() net.Addr {
-	if l.listener != nil {
-		return l.listener.Addr()
-	}
-	return nil
+	return l.listener.Addr()
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
-	if l.listener == nil {
-		log.Panicln("Trying to accept from a closed listener")
-	}
 	return l.listener.Accept()
 }
 
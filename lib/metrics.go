@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Minimal implementation of the Prometheus metrics (text format 0.0.4).
+// The vectors are registered when they are created and are exported by
+// the /metrics handler of the admin server. All the metrics of the relayers
+// use the label "relayer" with the value of RelayerConfig.Listen
+
+const (
+	metricsPrefix = "smart_relayer_"
+	maxSeries     = 2000 // Limit of label combinations per vector
+)
+
+var (
+	// DefBuckets are the default buckets for latencies in seconds
+	DefBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+	metrics = &registry{}
+
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type registry struct {
+	sync.Mutex
+	vecs []*metricVec
+}
+
+func (r *registry) register(v *metricVec) {
+	r.Lock()
+	defer r.Unlock()
+	r.vecs = append(r.vecs, v)
+}
+
+// WriteMetrics writes all the registered metrics in Prometheus text format
+// followed by the counters of the relayers
+func WriteMetrics(w io.Writer, stats []*Stats) error {
+	metrics.Lock()
+	vecs := make([]*metricVec, len(metrics.vecs))
+	copy(vecs, metrics.vecs)
+	metrics.Unlock()
+
+	sort.Slice(vecs, func(i, j int) bool {
+		return vecs[i].name < vecs[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, v := range vecs {
+		v.write(bw)
+	}
+	writeStats(bw, stats)
+	return bw.Flush()
+}
+
+// writeStats exports the Counters of the relayers
+func writeStats(w io.Writer, stats []*Stats) {
+	if len(stats) == 0 {
+		return
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Listen < stats[j].Listen
+	})
+
+	values := []struct {
+		name, typ, help string
+		get             func(s *Stats) int64
+	}{
+		{"connections_total", "counter", "Accepted local connections", func(s *Stats) int64 { return s.Connections }},
+		{"commands_total", "counter", "Commands received from the local clients", func(s *Stats) int64 { return s.Commands }},
+		{"async_total", "counter", "Commands answered immediately and sent in background", func(s *Stats) int64 { return s.Async }},
+		{"overloaded_total", "counter", "Requests rejected because the queues were full", func(s *Stats) int64 { return s.Overloaded }},
+		{"errors_total", "counter", "Errors sending or storing the data", func(s *Stats) int64 { return s.Errors }},
+		{"queued", "gauge", "Requests waiting in the relayer queues", func(s *Stats) int64 { return s.Queued }},
+	}
+
+	for _, v := range values {
+		name := metricsPrefix + v.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, v.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, v.typ)
+		for _, s := range stats {
+			labels := `relayer="` + labelEscaper.Replace(s.Listen) + `",protocol="` + labelEscaper.Replace(s.Protocol) + `"`
+			writeSample(w, name, labels, float64(v.get(s)))
+		}
+	}
+}
+
+type series interface {
+	write(w io.Writer, name, labels string)
+}
+
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string]series
+}
+
+func newMetricVec(name, help, typ string, labels []string) *metricVec {
+	v := &metricVec{
+		name:   metricsPrefix + name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]series),
+	}
+	metrics.register(v)
+	return v
+}
+
+// labelsKey builds the labels in the exposition format, it's also used as key of the map
+func (v *metricVec) labelsKey(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	pairs := make([]string, len(values))
+	for i, l := range v.labels {
+		pairs[i] = l + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *metricVec) with(values []string, newFunc func() series) series {
+	k := v.labelsKey(values)
+
+	v.Lock()
+	defer v.Unlock()
+
+	s, ok := v.series[k]
+	if !ok {
+		s = newFunc()
+		if len(v.series) < maxSeries {
+			v.series[k] = s
+		}
+	}
+	return s
+}
+
+func (v *metricVec) set(values []string, s series) {
+	k := v.labelsKey(values)
+
+	v.Lock()
+	defer v.Unlock()
+	v.series[k] = s
+}
+
+// Delete removes the series with the given label values
+func (v *metricVec) Delete(values ...string) {
+	k := v.labelsKey(values)
+
+	v.Lock()
+	defer v.Unlock()
+	delete(v.series, k)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	for _, k := range keys {
+		v.series[k].write(w, v.name, k)
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+}
+
+// Counter is a monotonic counter
+type Counter struct {
+	v int64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, float64(atomic.LoadInt64(&c.v)))
+}
+
+// CounterVec is a set of counters with the same name and different labels
+type CounterVec struct {
+	*metricVec
+}
+
+// NewCounterVec creates and registers a new vector of counters
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		metricVec: newMetricVec(name, help, "counter", labels),
+	}
+}
+
+// With returns the counter for the given label values, it's created if it didn't exist
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values, func() series { return &Counter{} }).(*Counter)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set stores the value of the gauge
+func (g *Gauge) Set(f float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(f))
+}
+
+// Get returns the current value of the gauge
+func (g *Gauge) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, g.Get())
+}
+
+type gaugeFunc func() float64
+
+func (f gaugeFunc) write(w io.Writer, name, labels string) {
+	writeSample(w, name, labels, f())
+}
+
+// GaugeVec is a set of gauges with the same name and different labels
+type GaugeVec struct {
+	*metricVec
+}
+
+// NewGaugeVec creates and registers a new vector of gauges
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{
+		metricVec: newMetricVec(name, help, "gauge", labels),
+	}
+}
+
+// With returns the gauge for the given label values, it's created if it didn't exist
+func (v *GaugeVec) With(values ...string) *Gauge {
+	g, ok := v.with(values, func() series { return &Gauge{} }).(*Gauge)
+	if !ok {
+		// It was defined as a function
+		return &Gauge{}
+	}
+	return g
+}
+
+// SetFunc defines a gauge whose value is obtained calling f when the metrics are exported
+func (v *GaugeVec) SetFunc(f func() float64, values ...string) {
+	v.set(values, gaugeFunc(f))
+}
+
+// Histogram counts the observations in buckets
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Observe adds a new value to the histogram
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.buckets, f)
+
+	h.Lock()
+	defer h.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += f
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.Lock()
+	defer h.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var acc uint64
+	for i, b := range h.buckets {
+		acc += h.counts[i]
+		writeSample(w, name+"_bucket", labels+sep+`le="`+formatFloat(b)+`"`, float64(acc))
+	}
+	writeSample(w, name+"_bucket", labels+sep+`le="+Inf"`, float64(h.count))
+	writeSample(w, name+"_sum", labels, h.sum)
+	writeSample(w, name+"_count", labels, float64(h.count))
+}
+
+// HistogramVec is a set of histograms with the same name and buckets and different labels
+type HistogramVec struct {
+	*metricVec
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a new vector of histograms, the
+// buckets must be sorted, DefBuckets is used if it's nil
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return &HistogramVec{
+		metricVec: newMetricVec(name, help, "histogram", labels),
+		buckets:   buckets,
+	}
+}
+
+// With returns the histogram for the given label values, it's created if it didn't exist
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values, func() series {
+		return &Histogram{
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+	}).(*Histogram)
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := NewCounterVec("test_dropped_total", "Dropped", "relayer")
+	c.With("tcp://:6389").Inc()
+	c.With("tcp://:6389").Add(2)
+
+	g := NewGaugeVec("test_running", "Running", "relayer")
+	g.SetFunc(func() float64 { return 7 }, "unix:/tmp/a\"b.sock")
+
+	h := NewHistogramVec("test_seconds", "Latency", []float64{0.1, 1}, "relayer", "command")
+	h.With("tcp://:6389", "SET").Observe(0.05)
+	h.With("tcp://:6389", "SET").Observe(0.5)
+	h.With("tcp://:6389", "SET").Observe(3)
+
+	deleted := NewGaugeVec("test_deleted", "Deleted", "relayer")
+	deleted.With("tcp://:6389").Set(1)
+	deleted.Delete("tcp://:6389")
+
+	b := &bytes.Buffer{}
+	WriteMetrics(b, []*Stats{{Listen: "tcp://:6389", Protocol: "redis", Commands: 4}})
+	out := b.String()
+
+	expected := []string{
+		"# TYPE smart_relayer_test_dropped_total counter\n",
+		`smart_relayer_test_dropped_total{relayer="tcp://:6389"} 3` + "\n",
+		`smart_relayer_test_running{relayer="unix:/tmp/a\"b.sock"} 7` + "\n",
+		"# TYPE smart_relayer_test_seconds histogram\n",
+		`smart_relayer_test_seconds_bucket{relayer="tcp://:6389",command="SET",le="0.1"} 1` + "\n",
+		`smart_relayer_test_seconds_bucket{relayer="tcp://:6389",command="SET",le="1"} 2` + "\n",
+		`smart_relayer_test_seconds_bucket{relayer="tcp://:6389",command="SET",le="+Inf"} 3` + "\n",
+		`smart_relayer_test_seconds_sum{relayer="tcp://:6389",command="SET"} 3.55` + "\n",
+		`smart_relayer_test_seconds_count{relayer="tcp://:6389",command="SET"} 3` + "\n",
+		`smart_relayer_commands_total{relayer="tcp://:6389",protocol="redis"} 4` + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Missing %q in:\n%s", e, out)
+		}
+	}
+
+	if strings.Contains(out, "test_deleted") {
+		t.Errorf("Deleted metric exported:\n%s", out)
+	}
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// CommandKeys returns the keys used by a command, items are the command and its
+// arguments. If the keys can't be known all is true and it must be considered
+// as if the command could use any key
+func CommandKeys(cmd string, items []*redis.Resp) (keys []string, all bool) {
+	c := commands.Get(cmd)
+	if c == nil {
+		// Unknown command, the first argument is supposed to be the key
+		if len(items) < 2 {
+			return nil, true
+		}
+		k, err := items[1].Str()
+		if err != nil {
+			return nil, true
+		}
+		return []string{k}, false
+	}
+
+	if c.Has(commands.AnyKey) {
+		return nil, true
+	}
+	positions, ok := c.Keys(items)
+	if !ok {
+		return nil, true
+	}
+	for _, i := range positions {
+		if k, err := items[i].Str(); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys, false
+}
+
+// PendingKeys counts the writes of a local connection that were answered
+// but not yet confirmed by the server. It's used by the consistent mode to
+// ensure that the reads of a connection see its previous async writes
+type PendingKeys struct {
+	sync.Mutex
+	keys    map[string]int
+	all     int // Pending writes with unknown keys
+	total   int
+	changed chan struct{} // Closed and replaced every time a write is done
+}
+
+// NewPendingKeys creates an empty table
+func NewPendingKeys() *PendingKeys {
+	return &PendingKeys{
+		keys:    make(map[string]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// Add registers a write of the given keys
+func (p *PendingKeys) Add(keys []string, all bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.total++
+	if all {
+		p.all++
+	}
+	for _, k := range keys {
+		p.keys[k]++
+	}
+}
+
+// Done marks as finished a write previously registered with Add
+func (p *PendingKeys) Done(keys []string, all bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.total--
+	if all {
+		p.all--
+	}
+	for _, k := range keys {
+		if n := p.keys[k]; n > 1 {
+			p.keys[k] = n - 1
+		} else {
+			delete(p.keys, k)
+		}
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Len returns the number of pending writes
+func (p *PendingKeys) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.total
+}
+
+// Pending returns true if there are pending writes that affect the keys
+func (p *PendingKeys) Pending(keys []string, all bool) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.pending(keys, all)
+}
+
+func (p *PendingKeys) pending(keys []string, all bool) bool {
+	if p.total == 0 {
+		return false
+	}
+	if all || p.all > 0 {
+		return true
+	}
+	for _, k := range keys {
+		if p.keys[k] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait blocks until there are no pending writes of the keys, it returns
+// false if the timeout expired before
+func (p *PendingKeys) Wait(keys []string, all bool, timeout time.Duration) bool {
+	var timer *time.Timer
+	for {
+		p.Lock()
+		if !p.pending(keys, all) {
+			p.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return true
+		}
+		ch := p.changed
+		p.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return false
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		args []interface{}
+		keys []string
+		all  bool
+	}{
+		{[]interface{}{"GET", "a"}, []string{"a"}, false},
+		{[]interface{}{"PING"}, nil, false},
+		{[]interface{}{"MGET", "a", "b"}, []string{"a", "b"}, false},
+		{[]interface{}{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}, false},
+		{[]interface{}{"EVAL", "return 1", "1", "a", "x"}, []string{"a"}, false},
+		{[]interface{}{"KEYS", "*"}, nil, true},
+		{[]interface{}{"RANDOMKEY"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		items, _ := redis.NewResp(tt.args).Array()
+		keys, all := CommandKeys(tt.args[0].(string), items)
+		if !reflect.DeepEqual(keys, tt.keys) || all != tt.all {
+			t.Errorf("%v: got %v %v, expected %v %v", tt.args, keys, all, tt.keys, tt.all)
+		}
+	}
+}
+
+func TestPendingKeys(t *testing.T) {
+	p := NewPendingKeys()
+	p.Add([]string{"a"}, false)
+	p.Add([]string{"a", "b"}, false)
+
+	if !p.Pending([]string{"a"}, false) || p.Pending([]string{"c"}, false) {
+		t.Fatal("bad pending keys")
+	}
+	if !p.Pending(nil, true) {
+		t.Fatal("unknown keys must wait for any write")
+	}
+
+	if p.Wait([]string{"b"}, false, 10*time.Millisecond) {
+		t.Fatal("wait didn't timeout")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Done([]string{"a"}, false)
+		p.Done([]string{"a", "b"}, false)
+	}()
+	if !p.Wait([]string{"a"}, false, time.Second) {
+		t.Fatal("wait timeout")
+	}
+	if p.Len() != 0 {
+		t.Fatalf("expected no pending writes, got %d", p.Len())
+	}
+}
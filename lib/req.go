@@ -3,6 +3,7 @@ package lib
 import (
 	"io"
 	"strings"
+	"time"
 
 	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
 )
@@ -17,8 +18,15 @@ type Request struct {
 	Resp     *redis.Resp
 	Items    []*redis.Resp
 	Command  string
-	Conn     io.Writer // Writer to send the response to the original client
-	Database int       // The current database at the time the request was issued
+	Conn     io.Writer    // Writer to send the response to the original client
+	Database int          // The current database at the time the request was issued
+	Pending  *PendingKeys // If not nil, the request is a write registered in the table
+	OnDone   func()       // Called once the response was written to Conn
+	Sent     time.Time    // When it was written to the server
+	Spooled  bool         // Replayed from the spool, it's kept there until it's answered
+	Err      error        // Why it wasn't answered by the server, set before Done
+	keys     []string
+	allKeys  bool
 }
 
 func NewRequest(resp *redis.Resp, c *RelayerConfig) *Request {
@@ -52,3 +60,30 @@ func NewRequest(resp *redis.Resp, c *RelayerConfig) *Request {
 	return r
 
 }
+
+// Keys returns the keys used by the request, all is true if they are unknown
+func (r *Request) Keys() (keys []string, all bool) {
+	if r.keys == nil && !r.allKeys {
+		r.keys, r.allKeys = CommandKeys(r.Command, r.Items)
+	}
+	return r.keys, r.allKeys
+}
+
+// Track registers the request as a pending write in the table
+func (r *Request) Track(p *PendingKeys) {
+	r.Pending = p
+	p.Add(r.Keys())
+}
+
+// Done marks the request as finished in the pending table, if any, and
+// calls OnDone. The clients call it after writing the response to Conn
+func (r *Request) Done() {
+	if p := r.Pending; p != nil {
+		r.Pending = nil
+		p.Done(r.Keys())
+	}
+	if f := r.OnDone; f != nil {
+		r.OnDone = nil
+		f()
+	}
+}
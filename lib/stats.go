@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"sync/atomic"
+)
+
+// Counters keeps the live counters of a relayer. The fields are updated
+// by the connection handlers and clients, always with atomic operations
+type Counters struct {
+	Connections int64 // Accepted local connections
+	Commands    int64 // Commands received from the local clients
+	Async       int64 // Commands answered immediately and sent in background
+	Overloaded  int64 // Requests rejected because the queues were full
+	Errors      int64 // Errors sending or storing the data
+	Queued      int64 // Requests waiting in the relayer queues
+}
+
+// Stats is a snapshot of the state of a relayer, it's what the admin
+// endpoint shows for each relayer
+type Stats struct {
+	Protocol    string
+	Listen      string
+	Target      string
+	Mode        string
+	Connections int64
+	Commands    int64
+	Async       int64
+	Overloaded  int64
+	Errors      int64
+	Queued      int64
+	Gauges      map[string]int64 `json:",omitempty"` // Other values specific to the relayer
+}
+
+// Stats returns a copy of the current values of the counters
+func (c *Counters) Stats(conf *RelayerConfig) *Stats {
+	mode := "sync"
+	if conf.Type() == ModeSmart {
+		mode = "smart"
+	}
+
+	return &Stats{
+		Protocol:    conf.Protocol,
+		Listen:      conf.Listen,
+		Target:      conf.Target(),
+		Mode:        mode,
+		Connections: atomic.LoadInt64(&c.Connections),
+		Commands:    atomic.LoadInt64(&c.Commands),
+		Async:       atomic.LoadInt64(&c.Async),
+		Overloaded:  atomic.LoadInt64(&c.Overloaded),
+		Errors:      atomic.LoadInt64(&c.Errors),
+		Queued:      atomic.LoadInt64(&c.Queued),
+	}
+}
+
+// Gauge stores an extra value in the Stats
+func (s *Stats) Gauge(name string, v int64) {
+	if s.Gauges == nil {
+		s.Gauges = make(map[string]int64)
+	}
+	s.Gauges[name] = v
+}
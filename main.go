@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/syslog"
@@ -17,6 +18,7 @@ import (
 	"github.com/gallir/smart-relayer/httpTo/httpToAthena"
 	"github.com/gallir/smart-relayer/httpproxy"
 	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/memcached"
 	"github.com/gallir/smart-relayer/redis/cluster"
 	"github.com/gallir/smart-relayer/redis/fh"
 	"github.com/gallir/smart-relayer/redis/fs"
@@ -24,6 +26,7 @@ import (
 	"github.com/gallir/smart-relayer/redis/radix"
 	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
 	"github.com/gallir/smart-relayer/redis/rsqs"
+	"github.com/gallir/smart-relayer/redis/sharded"
 )
 
 const (
@@ -35,6 +38,7 @@ var (
 	relayers       = make(map[string]lib.Relayer)
 	totalRelayers  = 0
 	relayersConfig *lib.Config
+	admin          *lib.Admin
 	done           = make(chan bool)
 	reloadSig      = make(chan os.Signal, 1)
 	exitSig        = make(chan os.Signal, 1)
@@ -46,6 +50,10 @@ func getNewServer(conf lib.RelayerConfig) (srv lib.Relayer, err error) {
 		srv, err = redis2.New(conf, done)
 	case "redis-cluster", "redis-plus":
 		srv, err = cluster.New(conf, done)
+	case "redis-sharded":
+		srv, err = sharded.New(conf, done)
+	case "memcached":
+		srv, err = memcached.New(conf, done)
 	case "firehose":
 		srv, err = fh.New(conf, done)
 	case "kinesis":
@@ -126,10 +134,50 @@ func startOrReload() bool {
 		}
 	}
 
+	reloadAdmin(newConf.Admin)
+
 	return true
 }
 
+// reloadAdmin starts, stops or moves the admin server if its address changed
+func reloadAdmin(listen string) {
+	if admin != nil {
+		if admin.Listen() == listen {
+			return
+		}
+		log.Printf("Stopping admin server at %s", admin.Listen())
+		admin.Exit()
+		admin = nil
+	}
+
+	if listen == "" {
+		return
+	}
+
+	a, err := lib.NewAdmin(listen, relayersStats)
+	if err != nil {
+		log.Println("E: Error starting admin server", listen, err)
+		return
+	}
+	admin = a
+}
+
+// relayersStats returns the state of all the running relayers
+func relayersStats() []*lib.Stats {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stats := make([]*lib.Stats, 0, len(relayers))
+	for _, r := range relayers {
+		if s, ok := r.(lib.RelayerStats); ok {
+			stats = append(stats, s.Stats())
+		}
+	}
+	return stats
+}
+
 func main() {
+	flag.Parse()
 
 	// Force a high number of file descriptoir, if possible
 	var rLimit syscall.Rlimit
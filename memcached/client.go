@@ -0,0 +1,219 @@
+package memcached
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// call is a request for the client, the reply is written to conn if it's
+// not nil, otherwise the request is sent with noreply. done is closed
+// once it's finished
+type call struct {
+	req  *request
+	conn io.Writer
+	done chan bool
+}
+
+// client sends the calls in order through a connection to the server
+type client struct {
+	config  lib.RelayerConfig
+	stats   *lib.Counters
+	ch      chan *call
+	netConn net.Conn
+	reader  *bufio.Reader
+	unread  int // Commands sent with noreply since the last drain
+}
+
+func newClient(c *lib.RelayerConfig, stats *lib.Counters) *client {
+	clt := &client{
+		config: *c,
+		stats:  stats,
+		ch:     make(chan *call, requestBufferSize),
+	}
+	go clt.listen()
+	return clt
+}
+
+// send queues the call, it fails if the queue is full
+func (clt *client) send(c *call) error {
+	if len(clt.ch) == cap(clt.ch) {
+		log.Println("Memcached overloaded", clt.config.Host())
+		atomic.AddInt64(&clt.stats.Overloaded, 1)
+		return errOverloaded
+	}
+	atomic.AddInt64(&clt.stats.Queued, 1)
+	clt.ch <- c
+	return nil
+}
+
+func (clt *client) listen() {
+	for c := range clt.ch {
+		atomic.AddInt64(&clt.stats.Queued, -1)
+		clt.do(c)
+	}
+	clt.disconnect()
+}
+
+func (clt *client) do(c *call) {
+	if c.done != nil {
+		defer close(c.done)
+	}
+
+	err := clt.exec(c)
+	if err == nil {
+		return
+	}
+	atomic.AddInt64(&clt.stats.Errors, 1)
+	log.Println("Memcached ERROR:", clt.config.Host(), err)
+	clt.disconnect()
+	if c.conn != nil {
+		writeError(c.conn, errServer)
+	}
+}
+
+func (clt *client) exec(c *call) error {
+	if clt.netConn == nil {
+		if err := clt.connect(); err != nil {
+			return err
+		}
+	}
+
+	timeout := time.Duration(clt.config.Timeout) * time.Second
+	if timeout > 0 {
+		clt.netConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if c.conn != nil && clt.unread > 0 {
+		if err := clt.drain(); err != nil {
+			return err
+		}
+	}
+	if err := c.req.write(clt.netConn, c.conn == nil); err != nil {
+		return err
+	}
+	if c.conn == nil {
+		clt.unread++
+		if clt.unread < drainPeriod {
+			return nil
+		}
+		return clt.drain()
+	}
+
+	reply, err := readReply(clt.reader, c.req)
+	if err != nil {
+		return err
+	}
+	c.conn.Write(reply)
+	return nil
+}
+
+// drain reads the replies of the noreply commands, memcached sends their
+// errors anyway. They are the lines before the reply of a version
+func (clt *client) drain() error {
+	if _, err := clt.netConn.Write(versionRequest); err != nil {
+		return err
+	}
+	for {
+		line, err := clt.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "VERSION ") {
+			clt.unread = 0
+			return nil
+		}
+		atomic.AddInt64(&clt.stats.Errors, 1)
+		log.Printf("Memcached ERROR: %s noreply command: %s", clt.config.Host(), strings.TrimSpace(line))
+	}
+}
+
+func (clt *client) connect() error {
+	conn, err := net.DialTimeout(clt.config.Scheme(), clt.config.Host(), connectTimeout)
+	if err != nil {
+		return err
+	}
+	lib.Debugf("Connected to %s", conn.RemoteAddr())
+	clt.netConn = conn
+	clt.reader = bufio.NewReader(conn)
+	clt.unread = 0
+	return nil
+}
+
+func (clt *client) disconnect() {
+	if clt.netConn != nil {
+		clt.netConn.Close()
+		clt.netConn = nil
+	}
+}
+
+// exit closes the connection once the queued calls are sent
+func (clt *client) exit() {
+	close(clt.ch)
+}
+
+// pool keeps the idle clients
+type pool struct {
+	sync.Mutex
+	config lib.RelayerConfig
+	stats  *lib.Counters
+	free   chan *client
+	closed bool
+}
+
+func newPool(c *lib.RelayerConfig, stats *lib.Counters) *pool {
+	maxIdle := c.MaxIdleConnections
+	if maxIdle <= 0 {
+		maxIdle = 1
+	}
+	return &pool{
+		config: *c,
+		stats:  stats,
+		free:   make(chan *client, maxIdle),
+	}
+}
+
+func (p *pool) get() *client {
+	select {
+	case c := <-p.free:
+		return c
+	default:
+		return newClient(&p.config, p.stats)
+	}
+}
+
+// put keeps the client if there is room in the pool, otherwise it's closed
+func (p *pool) put(c *client) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.closed {
+		select {
+		case p.free <- c:
+			return
+		default:
+		}
+	}
+	c.exit()
+}
+
+func (p *pool) close() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	for {
+		select {
+		case c := <-p.free:
+			c.exit()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package memcached implements a relayer for the memcached text protocol,
+// the commands get, gets, set, add, replace, append, prepend, cas, delete,
+// incr, decr, touch, version and quit are relayed to the server in url.
+// The binary protocol, deprecated by memcached, is out of scope.
+//
+// The commands with noreply are always sent in background. In smart mode
+// the commands in asynCommands ("set" by default, "delete" and "touch" are
+// also accepted) are answered immediately and sent with noreply. Memcached
+// answers their errors anyway, they are read and counted as errors.
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// Server is the thread that listen for clients' connections
+type Server struct {
+	sync.Mutex
+	config       lib.RelayerConfig
+	pool         *pool
+	mode         int
+	done         chan bool
+	exiting      bool
+	listener     net.Listener
+	asynCommands atomic.Value
+	stats        lib.Counters
+}
+
+const (
+	requestBufferSize = 1024
+	connectTimeout    = 5 * time.Second
+	drainPeriod       = 100 // Commands sent with noreply before reading their errors
+)
+
+var (
+	errServer     = errors.New("SERVER_ERROR upstream failed")
+	errOverloaded = errors.New("SERVER_ERROR overloaded")
+
+	// The commands that can be async and their immediate responses
+	asyncResponses = map[string][]byte{
+		"set":    []byte("STORED\r\n"),
+		"delete": []byte("DELETED\r\n"),
+		"touch":  []byte("TOUCHED\r\n"),
+	}
+	versionReply   = []byte("VERSION smart-relayer\r\n")
+	versionRequest = []byte("version\r\n")
+)
+
+// New creates a new memcached local server
+func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
+	srv := &Server{
+		done: done,
+	}
+	if err := srv.Reload(&c); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Start accepts incoming connections on the Listener
+func (srv *Server) Start() (e error) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	srv.listener, e = lib.NewListener(srv.config)
+	if e != nil {
+		return e
+	}
+
+	// Serve clients
+	go func(l net.Listener) {
+		defer srv.listener.Close()
+		for {
+			netConn, e := l.Accept()
+			if e != nil {
+				if netErr, ok := e.(net.Error); ok && netErr.Timeout() {
+					// Paranoid, ignore timeout errors
+					log.Println("Timeout at local listener", srv.config.ListenHost(), e)
+					continue
+				}
+				if srv.exiting {
+					log.Println("Exiting local listener", srv.config.ListenHost())
+					return
+				}
+				log.Fatalln("Emergency error in local listener", srv.config.ListenHost(), e)
+				return
+			}
+			go srv.handleConnection(netConn)
+		}
+	}(srv.listener)
+
+	return nil
+}
+
+// Reload the configuration
+func (srv *Server) Reload(c *lib.RelayerConfig) error {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.pool == nil || srv.config.URL != c.URL || srv.config.Timeout != c.Timeout ||
+		srv.config.MaxIdleConnections != c.MaxIdleConnections {
+		if srv.pool != nil {
+			log.Printf("Reset memcached server at port %s for target %s", c.Listen, c.Host())
+			srv.pool.close()
+		}
+		srv.pool = newPool(c, &srv.stats)
+	}
+	srv.config = *c
+	srv.mode = c.Type()
+
+	async := map[string][]byte{
+		"set": asyncResponses["set"],
+	}
+	for _, s := range strings.Fields(c.AsynCommands) {
+		name := strings.ToLower(s)
+		resp, ok := asyncResponses[name]
+		if !ok {
+			log.Printf("Command %s can't be async at port %s, ignored", name, c.Listen)
+			continue
+		}
+		async[name] = resp
+	}
+	srv.asynCommands.Store(async)
+	return nil
+}
+
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	return srv.stats.Stats(&srv.config)
+}
+
+// Exit closes the listener and send done to main
+func (srv *Server) Exit() {
+	srv.exiting = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	srv.Lock()
+	srv.pool.close()
+	srv.Unlock()
+	srv.done <- true
+}
+
+func (srv *Server) handleConnection(netCon net.Conn) {
+	defer netCon.Close()
+
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
+	srv.Lock()
+	p := srv.pool
+	srv.Unlock()
+	client := p.get()
+	defer p.put(client)
+
+	reader := bufio.NewReaderSize(netCon, maxLine)
+	for {
+		req, err := readRequest(reader)
+		if err != nil {
+			if err == io.EOF || isNetError(err) {
+				return
+			}
+			writeError(netCon, err)
+			continue
+		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
+
+		switch req.command {
+		case "quit":
+			return
+		case "version":
+			netCon.Write(versionReply)
+			continue
+		}
+
+		c := &call{req: req}
+		if !req.noreply {
+			if resp := srv.fastResponse(req); resp != nil {
+				netCon.Write(resp)
+			} else {
+				c.conn = netCon
+				c.done = make(chan bool)
+			}
+		}
+		if c.conn == nil {
+			atomic.AddInt64(&srv.stats.Async, 1)
+		}
+
+		if err := client.send(c); err != nil {
+			if c.conn != nil {
+				writeError(netCon, err)
+			}
+			continue
+		}
+		if c.done != nil {
+			<-c.done
+		}
+	}
+}
+
+// fastResponse returns the immediate response if the command is async
+func (srv *Server) fastResponse(req *request) []byte {
+	if srv.mode != lib.ModeSmart {
+		return nil
+	}
+	async, _ := srv.asynCommands.Load().(map[string][]byte)
+	return async[req.command]
+}
+
+func writeError(w io.Writer, err error) {
+	w.Write([]byte(err.Error() + "\r\n"))
+}
+
+func isNetError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,230 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// fakeServer is a minimal memcached with get, set, delete and incr
+type fakeServer struct {
+	sync.Mutex
+	listener net.Listener
+	data     map[string]string
+	counts   map[string]int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		listener: l,
+		data:     make(map[string]string),
+		counts:   make(map[string]int),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) count(cmd string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.counts[cmd]
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		noreply := f[len(f)-1] == "noreply"
+
+		s.Lock()
+		s.counts[f[0]]++
+		var reply string
+		switch f[0] {
+		case "get":
+			for _, k := range f[1:] {
+				if v, ok := s.data[k]; ok {
+					reply += fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			reply += "END\r\n"
+		case "set":
+			n, _ := strconv.Atoi(f[4])
+			b := make([]byte, n+2)
+			io.ReadFull(r, b)
+			s.data[f[1]] = string(b[:n])
+			reply = "STORED\r\n"
+		case "delete":
+			reply = "NOT_FOUND\r\n"
+			if _, ok := s.data[f[1]]; ok {
+				delete(s.data, f[1])
+				reply = "DELETED\r\n"
+			}
+		case "incr":
+			v, err := strconv.Atoi(s.data[f[1]])
+			if err != nil {
+				// The errors are sent even with noreply
+				reply, noreply = "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n", false
+				break
+			}
+			d, _ := strconv.Atoi(f[2])
+			s.data[f[1]] = strconv.Itoa(v + d)
+			reply = s.data[f[1]] + "\r\n"
+		case "version":
+			reply = "VERSION 1.6.0\r\n"
+		default:
+			reply = "ERROR\r\n"
+		}
+		s.Unlock()
+
+		if !noreply {
+			c.Write([]byte(reply))
+		}
+	}
+}
+
+func startRelayer(t *testing.T, mode string, upstream string) (*Server, net.Conn) {
+	srv, err := New(lib.RelayerConfig{
+		Protocol:           "memcached",
+		Mode:               mode,
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                "tcp://" + upstream,
+		MaxIdleConnections: 2,
+		Timeout:            5,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, conn
+}
+
+func TestRelay(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.listener.Close()
+
+	for _, mode := range []string{"sync", "smart"} {
+		t.Run(mode, func(t *testing.T) {
+			srv, conn := startRelayer(t, mode, fs.listener.Addr().String())
+			defer srv.Exit()
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+
+			expect := func(cmd string, lines ...string) {
+				t.Helper()
+				conn.Write([]byte(cmd))
+				for _, l := range lines {
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					got, err := r.ReadString('\n')
+					if err != nil || got != l+"\r\n" {
+						t.Fatalf("%q: expected %q, got %q %v", cmd, l, got, err)
+					}
+				}
+			}
+
+			expect("set k 0 0 5\r\nhello\r\n", "STORED")
+			expect("get k other\r\n", "VALUE k 0 5", "hello", "END")
+			expect("set n 0 0 1 noreply\r\n1\r\n")
+			expect("incr n 2\r\n", "3")
+			expect("delete k\r\n", "DELETED")
+			expect("get k\r\n", "END")
+			expect("bogus\r\n", "ERROR")
+			expect("delete\r\n", "CLIENT_ERROR bad command line format")
+			// The data block of a bad storage command is discarded
+			expect("set k 0 0 5 1 2\r\nhello\r\n", "CLIENT_ERROR bad command line format")
+			expect("get k\r\n", "END")
+			expect("version\r\n", "VERSION smart-relayer")
+		})
+	}
+}
+
+func TestAsyncSet(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.listener.Close()
+
+	srv, conn := startRelayer(t, "smart", fs.listener.Addr().String())
+	defer srv.Exit()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(conn, "set k%d 0 0 1\r\n%d\r\n", i, i%10)
+	}
+	for i := 0; i < n; i++ {
+		if l, _ := r.ReadString('\n'); l != "STORED\r\n" {
+			t.Fatalf("expected STORED, got %q", l)
+		}
+	}
+
+	// The get is sent after the sets in the same connection
+	fmt.Fprintf(conn, "get k%d\r\n", n-1)
+	if l, _ := r.ReadString('\n'); !strings.HasPrefix(l, "VALUE") {
+		t.Fatalf("expected the value, got %q", l)
+	}
+	if c := fs.count("set"); c != n {
+		t.Errorf("expected %d sets, got %d", n, c)
+	}
+	if s := srv.Stats(); s.Async != n {
+		t.Errorf("expected %d async commands, got %d", n, s.Async)
+	}
+}
+
+func TestNoreplyErrors(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.listener.Close()
+
+	srv, conn := startRelayer(t, "sync", fs.listener.Addr().String())
+	defer srv.Exit()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// The error of the incr doesn't become the reply of the get
+	fmt.Fprintf(conn, "set s 0 0 3\r\nabc\r\n")
+	if l, _ := r.ReadString('\n'); l != "STORED\r\n" {
+		t.Fatalf("expected STORED, got %q", l)
+	}
+	fmt.Fprintf(conn, "incr s 1 noreply\r\nget s\r\n")
+	for _, expected := range []string{"VALUE s 0 3\r\n", "abc\r\n", "END\r\n"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if l, err := r.ReadString('\n'); l != expected {
+			t.Fatalf("expected %q, got %q %v", expected, l, err)
+		}
+	}
+	if s := srv.Stats(); s.Errors != 1 {
+		t.Errorf("expected 1 error, got %d", s.Errors)
+	}
+}
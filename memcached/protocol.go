@@ -0,0 +1,203 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLine    = 2048
+	maxKey     = 250
+	maxValue   = 1 << 20
+	noreplyArg = "noreply"
+)
+
+var (
+	errUnknown   = errors.New("ERROR")
+	errBadFormat = errors.New("CLIENT_ERROR bad command line format")
+	errBadChunk  = errors.New("CLIENT_ERROR bad data chunk")
+	errTooLarge  = errors.New("SERVER_ERROR object too large for cache")
+	errLineLong  = errors.New("CLIENT_ERROR line too long")
+
+	crlf = []byte("\r\n")
+)
+
+// Number of arguments of each command after the name, without noreply.
+// The storage commands are followed by a data block
+var commandArgs = map[string]struct {
+	min, max int
+	storage  bool
+}{
+	"get":     {1, -1, false},
+	"gets":    {1, -1, false},
+	"set":     {4, 4, true},
+	"add":     {4, 4, true},
+	"replace": {4, 4, true},
+	"append":  {4, 4, true},
+	"prepend": {4, 4, true},
+	"cas":     {5, 5, true},
+	"delete":  {1, 1, false},
+	"incr":    {2, 2, false},
+	"decr":    {2, 2, false},
+	"touch":   {2, 2, false},
+	"version": {0, 0, false},
+	"quit":    {0, 0, false},
+}
+
+// request is a command of the text protocol
+type request struct {
+	command string
+	args    []string
+	noreply bool
+	data    []byte // The data block of the storage commands, with its \r\n
+}
+
+// readRequest reads a command from the client, the errors that are not
+// from the connection are the response for the client
+func readRequest(r *bufio.Reader) (*request, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errUnknown
+	}
+	req := &request{
+		command: strings.ToLower(fields[0]),
+		args:    fields[1:],
+	}
+
+	spec, ok := commandArgs[req.command]
+	if !ok {
+		return nil, errUnknown
+	}
+	if n := len(req.args); n > 0 && n > spec.min && req.args[n-1] == noreplyArg && spec.max >= 0 {
+		req.noreply = true
+		req.args = req.args[:n-1]
+	}
+	if len(req.args) < spec.min || (spec.max >= 0 && len(req.args) > spec.max) {
+		return nil, badRequest(r, req, spec.storage)
+	}
+	for _, k := range req.keys() {
+		if len(k) > maxKey {
+			return nil, badRequest(r, req, spec.storage)
+		}
+	}
+
+	if spec.storage {
+		size, err := strconv.Atoi(req.args[3])
+		if err != nil || size < 0 {
+			return nil, errBadFormat
+		}
+		if size > maxValue {
+			// Discard the data block
+			io.CopyN(ioutil.Discard, r, int64(size)+2)
+			return nil, errTooLarge
+		}
+		req.data = make([]byte, size+2)
+		if _, err := io.ReadFull(r, req.data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(req.data, crlf) {
+			return nil, errBadChunk
+		}
+	}
+	return req, nil
+}
+
+// badRequest discards the data block of a storage command with a bad
+// command line if its size can be parsed, as memcached does
+func badRequest(r *bufio.Reader, req *request, storage bool) error {
+	if storage && len(req.args) > 3 {
+		if size, err := strconv.Atoi(req.args[3]); err == nil && size >= 0 && size <= maxValue {
+			io.CopyN(ioutil.Discard, r, int64(size)+2)
+		}
+	}
+	return errBadFormat
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Discard the rest of the line
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// keys returns the keys of the request
+func (req *request) keys() []string {
+	switch req.command {
+	case "get", "gets":
+		return req.args
+	case "version", "quit":
+		return nil
+	}
+	return req.args[:1]
+}
+
+// hasValues returns true if the reply has values and ends with END
+func (req *request) hasValues() bool {
+	return req.command == "get" || req.command == "gets"
+}
+
+// write sends the request to the server, with noreply if it's true
+func (req *request) write(w io.Writer, noreply bool) error {
+	var b bytes.Buffer
+	b.WriteString(req.command)
+	for _, a := range req.args {
+		b.WriteByte(' ')
+		b.WriteString(a)
+	}
+	if noreply {
+		b.WriteString(" " + noreplyArg)
+	}
+	b.Write(crlf)
+	b.Write(req.data)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// readReply reads the reply of the server to the request
+func readReply(r *bufio.Reader, req *request) ([]byte, error) {
+	var b bytes.Buffer
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		b.Write(line)
+		if !req.hasValues() {
+			return b.Bytes(), nil
+		}
+
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := strings.Fields(string(line))
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return b.Bytes(), nil // END or an error
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size < 0 {
+			return nil, errBadChunk
+		}
+		if _, err := io.CopyN(&b, r, int64(size)+2); err != nil {
+			return nil, err
+		}
+	}
+}
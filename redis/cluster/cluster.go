@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/mirror"
 	"github.com/gallir/smart-relayer/redis/radix.improved/cluster"
 	"github.com/gallir/smart-relayer/redis/radix.improved/pool"
 	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
@@ -27,12 +29,20 @@ type Server struct {
 	listener     net.Listener
 	pool         util.Cmder
 	asynCommands atomic.Value
+	stats        lib.Counters
+	mirror       atomic.Value // *mirror.Mirror
+	breaker      *lib.Breaker
 }
 
 type reqData struct {
 	req        *redis.Resp
+	response   *redis.Resp // Immediate response of an async command, written in order
 	compress   bool
 	mustAnswer bool
+	tracked    bool // Registered in the pending table, in consistent mode
+	keys       []string
+	allKeys    bool
+	prefix     string // Prefix of the keys of the selected database
 }
 
 const (
@@ -49,6 +59,9 @@ var (
 	respPong       = redis.NewRespSimple("PONG")
 	respTrue       = redis.NewResp(1)
 	respBadCommand = redis.NewResp(errBadCmd)
+
+	commandLatency = lib.NewHistogramVec("cluster_command_seconds", "Time to get the response of a command from the cluster", nil, "relayer", "command")
+	faultyGauge    = lib.NewGaugeVec("cluster_faulty", "1 if the cluster is in faulty state and the commands are rejected", "relayer")
 )
 
 func init() {
@@ -75,7 +88,8 @@ func init() {
 // New creates a new Redis cluster or pool client
 func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 	srv := &Server{
-		done: done,
+		done:    done,
+		breaker: lib.NewBreaker(&c),
 	}
 
 	err := srv.Reload(&c)
@@ -84,6 +98,19 @@ func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 		return nil, err
 	}
 
+	if c.LoadCommands {
+		if err := lib.LoadCommands(&srv.config); err != nil {
+			log.Printf("Error loading the commands from %s: %s", srv.config.Host(), err)
+		}
+	}
+
+	faultyGauge.SetFunc(func() float64 {
+		if p, ok := srv.pool.(*cluster.Cluster); ok && p.IsFaulty() {
+			return 1
+		}
+		return 0
+	}, srv.config.Listen)
+
 	return srv, nil
 }
 
@@ -93,9 +120,17 @@ func (srv *Server) Reload(c *lib.RelayerConfig) error {
 	defer srv.Unlock()
 
 	reset := false
-	if srv.config.URL != c.URL {
+	if srv.config.ConnectionChanged(c) || srv.config.ReadFrom != c.ReadFrom {
 		reset = true
 	}
+	if m := srv.getMirror(); m.Changed(c) {
+		m.Close()
+		srv.mirror.Store(mirror.New(c))
+	}
+	srv.breaker.Reload(c)
+	if reset {
+		srv.breaker.Reset()
+	}
 	srv.config = *c // Save a copy
 	srv.mode = c.Type()
 
@@ -103,10 +138,13 @@ func (srv *Server) Reload(c *lib.RelayerConfig) error {
 	for r, s := range commands {
 		async[r] = s
 	}
-	if srv.config.AsynCommands != "" {
-		for _, s := range strings.Split(srv.config.AsynCommands, " ") {
-			async[strings.ToUpper(s)] = respOK
+	for _, s := range strings.Fields(srv.config.AsynCommands) {
+		name := strings.ToUpper(s)
+		if !rediscmd.CanBeAsync(name) {
+			log.Printf("Command %s can't be async at port %s, ignored", name, srv.config.Listen)
+			continue
 		}
+		async[name] = respOK
 	}
 	srv.asynCommands.Store(async)
 
@@ -171,7 +209,7 @@ func (srv *Server) reloadCluster(reset bool) error {
 	}
 
 	// Allows a list of URLs separated by spaces
-	for _, url := range strings.Split(srv.config.URL, " ") {
+	for _, url := range srv.config.URLs() {
 		addr, err := lib.Host(url)
 		if err != nil {
 			continue
@@ -188,6 +226,10 @@ func (srv *Server) reloadCluster(reset bool) error {
 			Addr:     addr,
 			PoolSize: size,
 			Timeout:  time.Duration(srv.config.Timeout) * time.Second,
+			Dialer:   srv.dialer(),
+			ReadFrom: srv.readFrom(),
+			// The checks of the faulty cluster go to the breaker too
+			CheckFunc: srv.breaker.Record,
 		}); err != nil {
 			log.Printf("Error in cluster %s: %s", addr, err)
 			srv.pool = nil
@@ -216,7 +258,7 @@ func (srv *Server) reloadPool(reset bool) error {
 	}
 
 	var err error
-	srv.pool, err = pool.New("tcp", srv.config.Host(), srv.config.MaxIdleConnections)
+	srv.pool, err = pool.NewCustom("tcp", srv.config.Host(), srv.config.MaxIdleConnections, pool.DialFunc(srv.dialer()))
 	if err != nil {
 		srv.pool = nil
 		return errors.New("connection error")
@@ -226,6 +268,109 @@ func (srv *Server) reloadPool(reset bool) error {
 	return nil
 }
 
+// cmd sends the command to the cluster, the multi-key commands with keys
+// in different slots are split and the read-only ones can go to the replicas.
+// items are the command and its arguments, args the arguments to send
+func (srv *Server) cmd(cmd string, items []*redis.Resp, args []interface{}) *redis.Resp {
+	if c, ok := srv.pool.(*cluster.Cluster); ok {
+		name := strings.ToUpper(cmd)
+		if parts := split(name, args); parts != nil {
+			return srv.splitCmd(c, name, parts, len(args)/splitCommands[name].step)
+		}
+		return clusterCmd(c, name, commandKey(name, items), args)
+	}
+	return srv.pool.Cmd(cmd, args)
+}
+
+// commandKey returns the first key of the command, empty if it's unknown
+func commandKey(cmd string, items []*redis.Resp) string {
+	positions, ok := rediscmd.KeyPositions(cmd, items)
+	if !ok || len(positions) == 0 {
+		return ""
+	}
+	key, _ := items[positions[0]].Str()
+	return key
+}
+
+// clusterCmd sends the read-only commands with the ReadFrom policy, the
+// rest to the master of the key. If the key is empty the node is chosen
+// by the first argument
+func clusterCmd(c *cluster.Cluster, cmd, key string, args []interface{}) *redis.Resp {
+	if key == "" {
+		if len(args) == 0 {
+			return redis.NewResp(cluster.ErrBadCmdNoKey)
+		}
+		k, err := redis.KeyFromArgs(args)
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		key = k
+	}
+	if rediscmd.IsReadOnly(cmd) {
+		return c.ReadCmdKey(key, cmd, args...)
+	}
+	return c.CmdKey(key, cmd, args...)
+}
+
+// readFrom returns the policy for the read-only commands. In consistent
+// mode they are sent to the masters, the replicas could not have the
+// previous writes yet
+func (srv *Server) readFrom() cluster.ReadFrom {
+	switch strings.ToLower(srv.config.ReadFrom) {
+	case "", "master":
+		return cluster.ReadFromMaster
+	case "prefer-replica", "round-robin":
+		if srv.config.Consistent {
+			log.Printf("Reads from replicas are disabled in consistent mode at port %s", srv.config.Listen)
+			return cluster.ReadFromMaster
+		}
+		if strings.ToLower(srv.config.ReadFrom) == "round-robin" {
+			return cluster.ReadFromRoundRobin
+		}
+		return cluster.ReadFromPreferReplica
+	}
+	log.Printf("Unknown readFrom %s at port %s, using master", srv.config.ReadFrom, srv.config.Listen)
+	return cluster.ReadFromMaster
+}
+
+// dialer returns the function used to open the connections to Redis,
+// with TLS and authentication if they are enabled in the configuration.
+// The connections are authenticated again every time they are created
+func (srv *Server) dialer() cluster.DialFunc {
+	c := srv.config
+	timeout := time.Duration(c.Timeout) * time.Second
+	return func(network, addr string) (*redis.Client, error) {
+		conn, err := lib.DialRedis(&c, network, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(conn, network, addr, timeout), nil
+	}
+}
+
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	if p, ok := srv.pool.(*cluster.Cluster); ok {
+		faulty := int64(0)
+		if p.IsFaulty() {
+			faulty = 1
+		}
+		s.Gauge("faulty", faulty)
+	}
+	srv.getMirror().AddStats(s)
+	srv.breaker.AddStats(s)
+	return s
+}
+
+func (srv *Server) getMirror() *mirror.Mirror {
+	m, _ := srv.mirror.Load().(*mirror.Mirror)
+	return m
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
@@ -238,5 +383,8 @@ func (srv *Server) Exit() {
 			go p.Close()
 		}
 	}
+	faultyGauge.Delete(srv.config.Listen)
+	srv.getMirror().Close()
+	srv.breaker.Close()
 	srv.done <- true
 }
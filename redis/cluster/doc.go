@@ -19,6 +19,28 @@
 // and can accelerate (a lot) operation from clients that store and/or read
 // a lot of data.
 //
+// With "consistent = true" the reads of a connection always see its previous
+// async writes: the commands that use keys with pending writes are queued
+// after them, the rest are sent directly.
+//
+// MGET, MSET, DEL, EXISTS, UNLINK and TOUCH with keys in different slots are
+// split in one command per slot, sent in parallel and the replies merged in
+// the order of the keys, so they don't fail with CROSSSLOT. The split commands
+// are not atomic.
+//
+// With "readFrom" the read-only commands can be sent to the replicas of the
+// slot, READONLY is sent in their connections: "prefer-replica" uses the
+// replicas in turn and "round-robin" the master and its replicas. The command
+// is sent to the master if the replica fails or answers with an error. It's
+// ignored in consistent mode.
+//
+// SELECT is emulated with "dbPrefix": the keys of every command are prefixed
+// with the template with the selected database, e.g. "db%d:" stores the key
+// "a" of the database 3 as "db3:a", the database 0 included. The prefix is
+// removed from the keys in the replies of KEYS, SCAN, BLPOP and BRPOP, and
+// the commands whose keys are unknown are rejected. Avoid hashtags in the
+// template, all the keys of a database would be in the same slot.
+//
 // One more thing: there is mode "redis-plus" that connects to a single redis
 // instance but using the same functions and it has the same limitations as a
 // redis-cluster, i.e. all operations must have a key and SELECT is not allowed.
@@ -4,8 +4,11 @@ import (
 	"net"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix.improved/cluster"
 	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
 )
 
@@ -18,16 +21,29 @@ type connHandler struct {
 	srv         *Server
 	conn        net.Conn
 	reqCh       chan reqData
+	session     *lib.Session
 	pending     int32
+	answers     int32            // Responses to the client waiting in reqCh
+	pendingKeys *lib.PendingKeys // Keys of the async writes in reqCh, for consistent mode
+	prefix      string           // Prefix of the keys of the selected database, if SELECT is emulated
 }
 
 func Handle(srv *Server, netCon net.Conn) {
 	h := &connHandler{
-		srv:  srv,
-		conn: netCon,
+		srv:     srv,
+		conn:    netCon,
+		session: lib.NewSession(&srv.config),
+	}
+	if srv.config.Consistent {
+		h.pendingKeys = lib.NewPendingKeys()
+	}
+	if srv.config.DBPrefix != "" {
+		h.prefix = dbPrefix(srv.config.DBPrefix, 0)
 	}
 	defer h.close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(h.conn)
 	for {
 		req := reader.Read()
@@ -56,12 +72,39 @@ func (h *connHandler) process(req *redis.Resp) {
 		return
 	}
 
+	atomic.AddInt64(&h.srv.stats.Commands, 1)
+
 	cmd = strings.ToUpper(cmd)
+	items, _ := req.Array()
+	if resp := h.session.Check(cmd, items); resp != nil {
+		resp.WriteTo(h.conn)
+		return
+	}
+
+	if err := rediscmd.CheckArity(cmd, len(items)); err != nil {
+		h.answer(redis.NewResp(err))
+		return
+	}
+
 	if cmd == selectCommand {
-		respBadCommand.WriteTo(h.conn)
+		if h.prefix == "" {
+			respBadCommand.WriteTo(h.conn)
+			return
+		}
+		h.answer(h.selectDB(items))
 		return
 	}
 
+	if h.prefix != "" {
+		if req, err = prefixKeys(cmd, items, h.prefix); err != nil {
+			redis.NewResp(err).WriteTo(h.conn)
+			return
+		}
+	}
+
+	// The cluster has only one database, the keys have the prefix if any
+	h.srv.getMirror().Send(nil, cmd, 0, req)
+
 	doAsync := false
 	var fastResponse *redis.Resp
 	if h.srv.mode == lib.ModeSmart {
@@ -71,45 +114,113 @@ func (h *connHandler) process(req *redis.Resp) {
 	}
 
 	if doAsync {
-		fastResponse.WriteTo(h.conn)
+		// In consistent mode the response is sent after the pending sync answers
+		ordered := h.pendingKeys != nil && atomic.LoadInt32(&h.answers) > 0
+		if !ordered {
+			fastResponse.WriteTo(h.conn)
+		}
 		if !h.initialized {
 			h.initialized = true
 			h.reqCh = make(chan reqData, requestBufferSize)
 			go h.sendWorker()
 		}
-		atomic.AddInt32(&h.pending, 1)
-		h.reqCh <- reqData{
+		m := reqData{
 			req:        req,
 			compress:   (h.srv.config.Compress || h.srv.config.Gzip != 0) && cmd != evalCommand,
 			mustAnswer: false,
 		}
+		if ordered {
+			m.response = fastResponse
+			atomic.AddInt32(&h.answers, 1)
+		}
+		if h.pendingKeys != nil {
+			m.tracked = true
+			m.keys, m.allKeys = h.keys(cmd, req)
+			h.pendingKeys.Add(m.keys, m.allKeys)
+		}
+		atomic.AddInt32(&h.pending, 1)
+		atomic.AddInt64(&h.srv.stats.Async, 1)
+		atomic.AddInt64(&h.srv.stats.Queued, 1)
+		h.reqCh <- m
 		return
 	}
 
-	p := atomic.LoadInt32(&h.pending)
-	if p != 0 {
+	if h.mustQueue(cmd, req) {
 		// There are operations in queue, send by the same channel
 		atomic.AddInt32(&h.pending, 1)
+		atomic.AddInt32(&h.answers, 1)
+		atomic.AddInt64(&h.srv.stats.Queued, 1)
 		h.reqCh <- reqData{
 			req:        req,
 			compress:   (h.srv.config.Compress || h.srv.config.Gzip != 0) && cmd != evalCommand,
 			mustAnswer: true,
+			prefix:     h.prefix,
 		}
 		return
 	}
 
 	// No ongoing operations, we can send directly
-	h.sender(true, req, h.srv.config.Compress && cmd != evalCommand, false)
+	h.sender(reqData{
+		req:        req,
+		compress:   h.srv.config.Compress && cmd != evalCommand,
+		mustAnswer: true,
+		prefix:     h.prefix,
+	}, false)
+}
+
+// answer writes a local response, after the queued ones if there are any
+func (h *connHandler) answer(resp *redis.Resp) {
+	if atomic.LoadInt32(&h.answers) == 0 {
+		resp.WriteTo(h.conn)
+		return
+	}
+	atomic.AddInt32(&h.answers, 1)
+	h.reqCh <- reqData{response: resp}
+}
+
+// mustQueue returns true if a sync command must be sent after the queued ones.
+// In consistent mode only the commands that use keys with pending writes are
+// queued, or all of them if there are responses pending to keep the order
+func (h *connHandler) mustQueue(cmd string, req *redis.Resp) bool {
+	if atomic.LoadInt32(&h.pending) == 0 {
+		return false
+	}
+	if h.pendingKeys == nil || atomic.LoadInt32(&h.answers) > 0 {
+		return true
+	}
+	return h.pendingKeys.Pending(h.keys(cmd, req))
+}
+
+func (h *connHandler) keys(cmd string, req *redis.Resp) ([]string, bool) {
+	items, err := req.Array()
+	if err != nil {
+		return nil, true
+	}
+	return lib.CommandKeys(cmd, items)
 }
 
 func (h *connHandler) sendWorker() {
 	for m := range h.reqCh {
-		h.sender(m.mustAnswer, m.req, m.compress, true)
+		if m.response != nil {
+			m.response.WriteTo(h.conn)
+			atomic.AddInt32(&h.answers, -1)
+		}
+		if m.req == nil {
+			continue
+		}
+		h.sender(m, true)
+		if m.mustAnswer {
+			atomic.AddInt32(&h.answers, -1)
+		}
+		if m.tracked {
+			h.pendingKeys.Done(m.keys, m.allKeys)
+		}
 	}
 }
 
-func (h *connHandler) sender(mustAnswer bool, req *redis.Resp, compress bool, async bool) {
-	if compress {
+func (h *connHandler) sender(m reqData, async bool) {
+	req, mustAnswer := m.req, m.mustAnswer
+	if m.compress {
 		switch {
 		case h.srv.config.Gzip != 0:
 			req.CompressGz(lib.MinCompressSize, h.srv.config.Gzip)
@@ -133,16 +244,33 @@ func (h *connHandler) sender(mustAnswer bool, req *redis.Resp, compress bool, as
 		args = append(args, b)
 	}
 
-	resp := h.srv.pool.Cmd(cmd, args[1:])
+	var resp *redis.Resp
+	if err := h.srv.breaker.Allow(); err != nil {
+		resp = redis.NewResp(err)
+	} else {
+		start := time.Now()
+		resp = h.srv.cmd(cmd, a, args[1:])
+		commandLatency.With(h.srv.config.Listen, strings.ToUpper(cmd)).Observe(time.Since(start).Seconds())
+		if resp.IsType(redis.IOErr) || resp.Err == cluster.ErrClusterUnavailable {
+			atomic.AddInt64(&h.srv.stats.Errors, 1)
+			h.srv.breaker.Record(start, resp.Err)
+		} else {
+			h.srv.breaker.Record(start, nil)
+		}
+	}
 	if h.srv.config.Gunzip || h.srv.config.Gzip != 0 || h.srv.config.Compress || h.srv.config.Uncompress {
 		resp.Uncompress()
 	}
+	if m.prefix != "" {
+		resp = stripPrefix(strings.ToUpper(cmd), resp, m.prefix)
+	}
 
 	if mustAnswer {
 		resp.WriteTo(h.conn)
 	}
 	if async {
 		atomic.AddInt32(&h.pending, -1)
+		atomic.AddInt64(&h.srv.stats.Queued, -1)
 	}
 	req.ReleaseBuffers()
 	resp.ReleaseBuffers()
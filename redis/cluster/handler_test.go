@@ -0,0 +1,345 @@
+package cluster
+
+import (
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/cluster"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+	"github.com/gallir/smart-relayer/redis/redistest"
+)
+
+func startRelayer(t *testing.T, c lib.RelayerConfig) (*Server, net.Conn) {
+	srv, err := New(c, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, conn
+}
+
+// waitCluster waits until the cluster client got the slots
+func waitCluster(t *testing.T, srv *Server) {
+	for i := 0; srv.pool.(*cluster.Cluster).IsFaulty(); i++ {
+		if i > 100 {
+			t.Fatal("the cluster didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsistentReads(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetDelay("SET", 100*time.Millisecond)
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis-plus",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Consistent:         true,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+
+	// A key without pending writes doesn't wait for the SET
+	start := time.Now()
+	redis.NewResp([]interface{}{"GET", "b"}).WriteTo(conn)
+	if r := reader.Read(); !r.IsType(redis.Nil) {
+		t.Fatalf("GET b: expected nil, got %s", r)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("GET b waited for the pending SET: %s", d)
+	}
+
+	redis.NewResp([]interface{}{"GET", "a"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "1" {
+		t.Fatalf("GET a: expected 1, got %q", s)
+	}
+}
+
+func TestSplitCrossSlot(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetCluster()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:       "redis-cluster",
+		Mode:           "sync",
+		Listen:         "tcp://127.0.0.1:0",
+		URL:            rs.URL(),
+		MaxConnections: 2,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	waitCluster(t, srv)
+
+	// a, b and c are in different slots, {a}x in the same as a
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"MSET", "a", "1", "b", "2", "{a}x", "3"}).WriteTo(conn)
+	if r := reader.Read(); r.Err != nil {
+		t.Fatalf("MSET: expected OK, got %s", r)
+	}
+	if n := rs.Count("MSET"); n != 2 {
+		t.Errorf("expected 2 MSET parts, got %d", n)
+	}
+
+	redis.NewResp([]interface{}{"MGET", "b", "c", "a", "{a}x"}).WriteTo(conn)
+	l, err := reader.Read().Array()
+	if err != nil || len(l) != 4 {
+		t.Fatalf("MGET: bad reply %v %v", l, err)
+	}
+	for i, expected := range []string{"2", "", "1", "3"} {
+		if expected == "" {
+			if !l[i].IsType(redis.Nil) {
+				t.Errorf("MGET %d: expected nil, got %s", i, l[i])
+			}
+			continue
+		}
+		if s, _ := l[i].Str(); s != expected {
+			t.Errorf("MGET %d: expected %s, got %q", i, expected, s)
+		}
+	}
+
+	redis.NewResp([]interface{}{"EXISTS", "a", "b", "c"}).WriteTo(conn)
+	if n, _ := reader.Read().Int(); n != 2 {
+		t.Errorf("EXISTS: expected 2, got %d", n)
+	}
+
+	redis.NewResp([]interface{}{"DEL", "a", "b", "{a}x"}).WriteTo(conn)
+	if n, _ := reader.Read().Int(); n != 3 {
+		t.Errorf("DEL: expected 3, got %d", n)
+	}
+	if _, ok := rs.Get(0, "b"); ok {
+		t.Error("b wasn't deleted")
+	}
+}
+
+func TestReadFromReplica(t *testing.T) {
+	master, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+	replica, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	master.SetCluster(replica.Addr())
+	replica.SetReplica(master.Addr())
+
+	// Different values to know where the reads go
+	master.Set(0, "k", "master")
+	replica.Set(0, "k", "replica")
+
+	get := func(conn net.Conn) string {
+		redis.NewResp([]interface{}{"GET", "k"}).WriteTo(conn)
+		s, _ := redis.NewRespReader(conn).Read().Str()
+		return s
+	}
+
+	t.Run("prefer-replica", func(t *testing.T) {
+		srv, conn := startRelayer(t, lib.RelayerConfig{
+			Protocol:       "redis-cluster",
+			Mode:           "sync",
+			Listen:         "tcp://127.0.0.1:0",
+			URL:            master.URL(),
+			MaxConnections: 2,
+			ReadFrom:       "prefer-replica",
+		})
+		defer srv.Exit()
+		defer conn.Close()
+		waitCluster(t, srv)
+
+		for i := 0; i < 3; i++ {
+			if s := get(conn); s != "replica" {
+				t.Fatalf("GET %d: expected the replica, got %q", i, s)
+			}
+		}
+		if replica.Count("READONLY") == 0 {
+			t.Error("READONLY wasn't sent to the replica")
+		}
+
+		redis.NewResp([]interface{}{"SET", "w", "1"}).WriteTo(conn)
+		redis.NewRespReader(conn).Read()
+		if _, ok := master.Get(0, "w"); !ok {
+			t.Error("the write wasn't sent to the master")
+		}
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		srv, conn := startRelayer(t, lib.RelayerConfig{
+			Protocol:       "redis-cluster",
+			Mode:           "sync",
+			Listen:         "tcp://127.0.0.1:0",
+			URL:            master.URL(),
+			MaxConnections: 2,
+			ReadFrom:       "round-robin",
+		})
+		defer srv.Exit()
+		defer conn.Close()
+		waitCluster(t, srv)
+
+		seen := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			seen[get(conn)]++
+		}
+		if seen["master"] != 2 || seen["replica"] != 2 {
+			t.Errorf("expected 2 reads from each node, got %v", seen)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		srv, conn := startRelayer(t, lib.RelayerConfig{
+			Protocol:       "redis-cluster",
+			Mode:           "sync",
+			Listen:         "tcp://127.0.0.1:0",
+			URL:            master.URL(),
+			MaxConnections: 2,
+			ReadFrom:       "prefer-replica",
+		})
+		defer srv.Exit()
+		defer conn.Close()
+		waitCluster(t, srv)
+
+		replica.Close()
+		if s := get(conn); s != "master" {
+			t.Fatalf("expected the master after the replica failure, got %q", s)
+		}
+	})
+}
+
+func TestUnreachableReplica(t *testing.T) {
+	master, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	master.SetCluster(l.Addr().String())
+	master.Set(0, "k", "master")
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:       "redis-cluster",
+		Mode:           "sync",
+		Listen:         "tcp://127.0.0.1:0",
+		URL:            master.URL(),
+		MaxConnections: 2,
+		ReadFrom:       "prefer-replica",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+	waitCluster(t, srv)
+
+	// Every reset tries to connect to the replica again, the pools of the
+	// failed attempts must not be left behind
+	c := srv.pool.(*cluster.Cluster)
+	reset := func() {
+		time.Sleep(600 * time.Millisecond) // The default reset throttle
+		if err := c.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset()
+	n := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		reset()
+	}
+	// The ping goroutines of the closed pools may not have run yet
+	for i := 0; runtime.NumGoroutine() > n; i++ {
+		if i > 100 {
+			t.Errorf("%d goroutines leaked by the replica pools", runtime.NumGoroutine()-n)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	redis.NewResp([]interface{}{"GET", "k"}).WriteTo(conn)
+	if s, _ := redis.NewRespReader(conn).Read().Str(); s != "master" {
+		t.Errorf("expected the master, got %q", s)
+	}
+}
+
+func TestSelectPrefix(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetCluster()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:       "redis-cluster",
+		Mode:           "sync",
+		Listen:         "tcp://127.0.0.1:0",
+		URL:            rs.URL(),
+		MaxConnections: 2,
+		DBPrefix:       "db%d:",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+	waitCluster(t, srv)
+
+	reader := redis.NewRespReader(conn)
+	send := func(args ...interface{}) *redis.Resp {
+		redis.NewResp(args).WriteTo(conn)
+		return reader.Read()
+	}
+
+	send("SET", "a", "0")
+	if s, _ := send("SELECT", "3").Str(); s != "OK" {
+		t.Fatalf("SELECT: expected OK, got %q", s)
+	}
+	send("MSET", "a", "3", "b", "3")
+	if s, _ := send("GET", "a").Str(); s != "3" {
+		t.Errorf("GET a in db 3: expected 3, got %q", s)
+	}
+	if v, _ := rs.Get(0, "db3:a"); v != "3" {
+		t.Errorf("expected db3:a in the server, got %q", v)
+	}
+	if v, _ := rs.Get(0, "db0:a"); v != "0" {
+		t.Errorf("expected db0:a in the server, got %q", v)
+	}
+
+	l, err := send("KEYS", "*").List()
+	sort.Strings(l)
+	if err != nil || !reflect.DeepEqual(l, []string{"a", "b"}) {
+		t.Errorf("KEYS: expected [a b], got %v %v", l, err)
+	}
+
+	if r := send("RANDOMKEY"); r.Err == nil {
+		t.Errorf("RANDOMKEY: expected an error, got %s", r)
+	}
+}
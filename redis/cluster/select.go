@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The cluster has only one database. If DBPrefix is defined SELECT is
+// emulated: the keys of every command are prefixed with the template with
+// the selected database, and the prefix is removed from the keys of the
+// replies of KEYS, SCAN, BLPOP and BRPOP.
+
+var (
+	errInvalidDB   = errors.New("ERR invalid DB index")
+	errSelectArgs  = errors.New("ERR wrong number of arguments for 'select' command")
+	respInvalidDB  = redis.NewResp(errInvalidDB)
+	respSelectArgs = redis.NewResp(errSelectArgs)
+)
+
+// dbPrefix returns the prefix of the keys of the database db
+func dbPrefix(template string, db int) string {
+	return strings.Replace(template, "%d", strconv.Itoa(db), -1)
+}
+
+// selectDB changes the prefix of the connection
+func (h *connHandler) selectDB(items []*redis.Resp) *redis.Resp {
+	if len(items) != 2 {
+		return respSelectArgs
+	}
+	db, err := items[1].Int()
+	if err != nil || db < 0 {
+		return respInvalidDB
+	}
+	h.prefix = dbPrefix(h.srv.config.DBPrefix, db)
+	return respOK
+}
+
+// prefixKeys returns the command with the prefix added to its keys
+func prefixKeys(cmd string, items []*redis.Resp, prefix string) (*redis.Resp, error) {
+	args := make([]interface{}, len(items))
+	for i, item := range items {
+		b, err := item.Bytes()
+		if err != nil {
+			return nil, errBadCmd
+		}
+		args[i] = b
+	}
+
+	switch cmd {
+	case "KEYS":
+		if len(args) != 2 {
+			return nil, errBadCmd
+		}
+		args[1] = globPrefix(prefix) + string(args[1].([]byte))
+	case "SCAN":
+		args = prefixScan(args, prefix)
+	default:
+		c := rediscmd.Get(cmd)
+		positions, ok := c.Keys(items)
+		if !ok || c.Has(rediscmd.AnyKey) {
+			return nil, fmt.Errorf("ERR '%s' command is not supported with databases", strings.ToLower(cmd))
+		}
+		for _, i := range positions {
+			args[i] = prefix + string(args[i].([]byte))
+		}
+	}
+	return redis.NewResp(args), nil
+}
+
+// prefixScan adds the prefix to the MATCH pattern, the option is added if
+// it wasn't given
+func prefixScan(args []interface{}, prefix string) []interface{} {
+	for i := 2; i < len(args)-1; i++ {
+		if strings.ToUpper(string(args[i].([]byte))) == "MATCH" {
+			args[i+1] = globPrefix(prefix) + string(args[i+1].([]byte))
+			return args
+		}
+	}
+	return append(args, "MATCH", globPrefix(prefix)+"*")
+}
+
+// globPrefix escapes the special characters of the patterns in the prefix
+func globPrefix(prefix string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// stripPrefix removes the prefix from the keys of the replies
+func stripPrefix(cmd string, resp *redis.Resp, prefix string) *redis.Resp {
+	switch cmd {
+	case "KEYS":
+		return stripKeys(resp, prefix)
+	case "SCAN":
+		l, err := resp.Array()
+		if err != nil || len(l) != 2 {
+			return resp
+		}
+		return redis.NewResp([]interface{}{l[0], stripKeys(l[1], prefix)})
+	case "BLPOP", "BRPOP":
+		l, err := resp.Array()
+		if err != nil || len(l) != 2 {
+			return resp
+		}
+		key, _ := l[0].Str()
+		return redis.NewResp([]interface{}{strings.TrimPrefix(key, prefix), l[1]})
+	}
+	return resp
+}
+
+func stripKeys(resp *redis.Resp, prefix string) *redis.Resp {
+	l, err := resp.Array()
+	if err != nil {
+		return resp
+	}
+	keys := make([]interface{}, len(l))
+	for i, k := range l {
+		s, _ := k.Str()
+		keys[i] = strings.TrimPrefix(s, prefix)
+	}
+	return redis.NewResp(keys)
+}
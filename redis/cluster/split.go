@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/cluster"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The multi-key commands with keys in different slots are rejected by the
+// cluster with CROSSSLOT. They are split in one command per slot, sent in
+// parallel to their nodes and the replies merged in the order of the keys.
+
+type splitCommand struct {
+	step  int // Arguments of every key: 1 for the key alone, 2 for key and value
+	merge func(parts []*slotPart, keys int) *redis.Resp
+}
+
+// slotPart is the command for the keys of the same slot
+type slotPart struct {
+	args    []interface{}
+	indexes []int // Position of every key in the original command
+	resp    *redis.Resp
+}
+
+var (
+	errSplitReply = errors.New("ERR unexpected reply of a multi-key command part")
+
+	splitCommands = map[string]splitCommand{
+		"MGET":   {1, mergeValues},
+		"MSET":   {2, mergeOK},
+		"DEL":    {1, mergeSum},
+		"EXISTS": {1, mergeSum},
+		"UNLINK": {1, mergeSum},
+		"TOUCH":  {1, mergeSum},
+	}
+
+	splitCounter = lib.NewCounterVec("cluster_split_commands_total", "Multi-key commands split by slot", "relayer", "command")
+)
+
+// split groups the keys of a multi-key command by slot, it returns nil
+// if the command can't be split or all the keys are in the same slot
+func split(cmd string, args []interface{}) []*slotPart {
+	sc, ok := splitCommands[cmd]
+	if !ok || len(args) == 0 || len(args)%sc.step != 0 {
+		return nil
+	}
+
+	slots := make(map[uint16]*slotPart)
+	parts := make([]*slotPart, 0, 2)
+	for i := 0; i < len(args); i += sc.step {
+		key, ok := args[i].([]byte)
+		if !ok {
+			return nil
+		}
+		slot := cluster.Slot(string(key))
+		p, ok := slots[slot]
+		if !ok {
+			p = &slotPart{}
+			slots[slot] = p
+			parts = append(parts, p)
+		}
+		p.args = append(p.args, args[i:i+sc.step]...)
+		p.indexes = append(p.indexes, i/sc.step)
+	}
+
+	if len(parts) < 2 {
+		return nil
+	}
+	return parts
+}
+
+// splitCmd sends the parts in parallel and merges the replies, the first
+// error is returned if any part failed
+func (srv *Server) splitCmd(c *cluster.Cluster, cmd string, parts []*slotPart, keys int) *redis.Resp {
+	splitCounter.With(srv.config.Listen, cmd).Inc()
+
+	var wg sync.WaitGroup
+	for _, p := range parts {
+		wg.Add(1)
+		go func(p *slotPart) {
+			defer wg.Done()
+			p.resp = clusterCmd(c, cmd, "", p.args)
+		}(p)
+	}
+	wg.Wait()
+
+	for i, p := range parts {
+		if p.resp.Err != nil {
+			for j, o := range parts {
+				if j != i {
+					o.resp.ReleaseBuffers()
+				}
+			}
+			return p.resp
+		}
+	}
+	return splitCommands[cmd].merge(parts, keys)
+}
+
+// mergeValues puts the values of every part in the position of its keys
+func mergeValues(parts []*slotPart, keys int) *redis.Resp {
+	values := make([]interface{}, keys)
+	for _, p := range parts {
+		l, err := p.resp.Array()
+		if err != nil || len(l) != len(p.indexes) {
+			return redis.NewResp(errSplitReply)
+		}
+		for i, v := range l {
+			values[p.indexes[i]] = v
+		}
+	}
+	return redis.NewResp(values)
+}
+
+// mergeSum adds the integer replies
+func mergeSum(parts []*slotPart, keys int) *redis.Resp {
+	total := int64(0)
+	for _, p := range parts {
+		n, err := p.resp.Int64()
+		if err != nil {
+			return redis.NewResp(errSplitReply)
+		}
+		total += n
+	}
+	return redis.NewResp(total)
+}
+
+func mergeOK(parts []*slotPart, keys int) *redis.Resp {
+	return respOK
+}
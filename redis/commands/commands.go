@@ -0,0 +1,136 @@
+// Package commands describes the Redis commands: their arity, the position
+// of their keys and if they read, write or block. The built-in table can be
+// updated with the COMMAND reply of the upstream server.
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// Flags of a command
+type Flags int
+
+const (
+	// ReadOnly commands don't modify the data
+	ReadOnly Flags = 1 << iota
+	// Write commands can modify the data
+	Write
+	// Blocking commands can wait for data
+	Blocking
+	// AnyKey commands use all the keys of the database, e.g. KEYS or FLUSHDB
+	AnyKey
+	// Movable commands have keys out of FirstKey and LastKey, their number
+	// is in the argument NumKeys
+	Movable
+)
+
+// Command is the metadata of a command, as in COMMAND INFO
+type Command struct {
+	Name     string
+	Arity    int // Items including the command name, negative is the minimum
+	FirstKey int // Position of the first key, 0 if it has no keys
+	LastKey  int // Position of the last key, negative counts from the end
+	Step     int
+	Flags    Flags
+	NumKeys  int // Position of the number of keys of the Movable commands, 0 if unknown
+}
+
+var table atomic.Value // map[string]*Command
+
+func init() {
+	m := make(map[string]*Command, len(builtin))
+	for _, c := range builtin {
+		m[c.Name] = c
+	}
+	table.Store(m)
+}
+
+// Get returns the metadata of the command, nil if it's unknown. The name
+// must be in upper case
+func Get(name string) *Command {
+	return table.Load().(map[string]*Command)[name]
+}
+
+// Has returns true if the command has all the flags
+func (c *Command) Has(f Flags) bool {
+	return c != nil && c.Flags&f == f
+}
+
+// CheckArity returns the error of Redis if the number of items, the
+// command and its arguments, is wrong
+func (c *Command) CheckArity(n int) error {
+	if c == nil || c.Arity == 0 {
+		return nil
+	}
+	if (c.Arity > 0 && n != c.Arity) || (c.Arity < 0 && n < -c.Arity) {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(c.Name))
+	}
+	return nil
+}
+
+// Keys returns the positions in items of the keys of the command, items
+// are the command and its arguments. ok is false if they can't be found
+func (c *Command) Keys(items []*redis.Resp) (positions []int, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	if c.FirstKey > 0 {
+		last := c.LastKey
+		if last < 0 {
+			last = len(items) + last
+		}
+		if c.FirstKey >= len(items) || last >= len(items) || last < c.FirstKey {
+			return nil, false
+		}
+		step := c.Step
+		if step < 1 {
+			step = 1
+		}
+		for i := c.FirstKey; i <= last; i += step {
+			positions = append(positions, i)
+		}
+	}
+
+	if c.Flags&Movable != 0 {
+		if c.NumKeys == 0 || c.NumKeys >= len(items) {
+			return nil, false
+		}
+		n, err := items[c.NumKeys].Int()
+		if err != nil || n < 0 || c.NumKeys+1+n > len(items) {
+			return nil, false
+		}
+		for i := c.NumKeys + 1; i <= c.NumKeys+n; i++ {
+			positions = append(positions, i)
+		}
+	}
+	return positions, true
+}
+
+// CheckArity checks the arity of a command, the unknown ones are accepted
+func CheckArity(name string, n int) error {
+	return Get(name).CheckArity(n)
+}
+
+// KeyPositions returns the positions of the keys of a command, ok is false
+// if the command is unknown or its keys can't be found
+func KeyPositions(name string, items []*redis.Resp) ([]int, bool) {
+	return Get(name).Keys(items)
+}
+
+// IsReadOnly returns true if the command is known and only reads
+func IsReadOnly(name string) bool {
+	c := Get(name)
+	return c.Has(ReadOnly) && !c.Has(Blocking)
+}
+
+// CanBeAsync returns false for the known commands that can't be answered
+// before they are executed: the reads and the blocking ones
+func CanBeAsync(name string) bool {
+	c := Get(name)
+	return c == nil || (!c.Has(ReadOnly) && !c.Has(Blocking))
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestKeyPositions(t *testing.T) {
+	tests := []struct {
+		args      []interface{}
+		positions []int
+		ok        bool
+	}{
+		{[]interface{}{"GET", "a"}, []int{1}, true},
+		{[]interface{}{"PING"}, nil, true},
+		{[]interface{}{"MSET", "a", "1", "b", "2"}, []int{1, 3}, true},
+		{[]interface{}{"BLPOP", "a", "b", "0"}, []int{1, 2}, true},
+		{[]interface{}{"BITOP", "AND", "d", "a", "b"}, []int{2, 3, 4}, true},
+		{[]interface{}{"EVAL", "return 1", "1", "a", "x"}, []int{3}, true},
+		{[]interface{}{"ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2"}, []int{1, 3, 4}, true},
+		{[]interface{}{"EVAL", "return 1", "3", "a"}, nil, false},
+		{[]interface{}{"GET"}, nil, false},
+		{[]interface{}{"UNKNOWN", "a"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		items, _ := redis.NewResp(tt.args).Array()
+		positions, ok := KeyPositions(tt.args[0].(string), items)
+		if !reflect.DeepEqual(positions, tt.positions) || ok != tt.ok {
+			t.Errorf("%v: got %v %v, expected %v %v", tt.args, positions, ok, tt.positions, tt.ok)
+		}
+	}
+}
+
+func TestCheckArity(t *testing.T) {
+	tests := []struct {
+		cmd string
+		n   int
+		ok  bool
+	}{
+		{"GET", 2, true},
+		{"GET", 3, false},
+		{"SET", 3, true},
+		{"SET", 5, true},
+		{"SET", 2, false},
+		{"PING", 1, true},
+		{"UNKNOWN", 1, true},
+	}
+
+	for _, tt := range tests {
+		if err := CheckArity(tt.cmd, tt.n); (err == nil) != tt.ok {
+			t.Errorf("%s with %d items: got %v", tt.cmd, tt.n, err)
+		}
+	}
+	if err := CheckArity("GET", 1); err == nil || err.Error() != "ERR wrong number of arguments for 'get' command" {
+		t.Errorf("bad error message: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	reply := redis.NewResp([]interface{}{
+		[]interface{}{"newcmd", -2, []interface{}{"readonly"}, 1, 1, 1},
+		[]interface{}{"blpop", -3, []interface{}{"write", "noscript"}, 1, -2, 1},
+		[]interface{}{"eval", -3, []interface{}{"noscript", "movablekeys"}, 0, 0, 0},
+	})
+	cmds, err := Parse(reply)
+	if err != nil || len(cmds) != 3 {
+		t.Fatalf("Parse: got %d commands, %v", len(cmds), err)
+	}
+	Update(cmds)
+
+	if !IsReadOnly("NEWCMD") || CheckArity("NEWCMD", 1) == nil {
+		t.Error("NEWCMD wasn't added")
+	}
+	if !Get("BLPOP").Has(Blocking) || CanBeAsync("BLPOP") {
+		t.Error("BLPOP lost the blocking flag")
+	}
+	items, _ := redis.NewResp([]interface{}{"EVAL", "return 1", "1", "a"}).Array()
+	if positions, ok := KeyPositions("EVAL", items); !ok || !reflect.DeepEqual(positions, []int{3}) {
+		t.Errorf("EVAL keys: got %v %v", positions, ok)
+	}
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+var errBadInfo = errors.New("bad COMMAND reply")
+
+// Parse reads the reply of COMMAND or COMMAND INFO. Every command is an
+// array with its name, arity, flags, first key, last key and step
+func Parse(resp *redis.Resp) ([]*Command, error) {
+	l, err := resp.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*Command, 0, len(l))
+	for _, item := range l {
+		if item.IsType(redis.Nil) {
+			continue // COMMAND INFO of an unknown command
+		}
+		info, err := item.Array()
+		if err != nil || len(info) < 6 {
+			return nil, errBadInfo
+		}
+
+		c := &Command{}
+		name, err := info[0].Str()
+		if err != nil {
+			return nil, errBadInfo
+		}
+		c.Name = strings.ToUpper(name)
+		if c.Arity, err = info[1].Int(); err != nil {
+			return nil, errBadInfo
+		}
+		flags, _ := info[2].List()
+		for _, f := range flags {
+			switch f {
+			case "readonly":
+				c.Flags |= ReadOnly
+			case "write":
+				c.Flags |= Write
+			case "blocking":
+				c.Flags |= Blocking
+			case "movablekeys":
+				c.Flags |= Movable
+			}
+		}
+		if c.FirstKey, err = info[3].Int(); err != nil {
+			return nil, errBadInfo
+		}
+		if c.LastKey, err = info[4].Int(); err != nil {
+			return nil, errBadInfo
+		}
+		if c.Step, err = info[5].Int(); err != nil {
+			return nil, errBadInfo
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds, nil
+}
+
+// Update adds the commands to the table or replaces the existing ones.
+// The flags that the servers don't report and the position of the number
+// of keys are kept from the built-in table
+func Update(cmds []*Command) {
+	old := table.Load().(map[string]*Command)
+	m := make(map[string]*Command, len(old)+len(cmds))
+	for name, c := range old {
+		m[name] = c
+	}
+	for _, c := range cmds {
+		if prev, ok := m[c.Name]; ok {
+			c.Flags |= prev.Flags & (Blocking | AnyKey)
+			if c.Flags&Movable != 0 && c.NumKeys == 0 {
+				c.NumKeys = prev.NumKeys
+				if c.FirstKey == 0 {
+					c.FirstKey, c.LastKey, c.Step = prev.FirstKey, prev.LastKey, prev.Step
+				}
+			}
+		}
+		m[c.Name] = c
+	}
+	table.Store(m)
+}
+
+// Load sends COMMAND to the server and updates the table with the reply,
+// it returns the number of commands received
+func Load(rw io.ReadWriter) (int, error) {
+	if _, err := redis.NewResp([]interface{}{"COMMAND"}).WriteTo(rw); err != nil {
+		return 0, err
+	}
+	resp := redis.NewRespReader(rw).Read()
+	if resp.Err != nil {
+		return 0, resp.Err
+	}
+
+	cmds, err := Parse(resp)
+	if err != nil {
+		return 0, err
+	}
+	Update(cmds)
+	return len(cmds), nil
+}
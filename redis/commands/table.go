@@ -0,0 +1,195 @@
+package commands
+
+const (
+	rd = ReadOnly
+	wr = Write
+	bw = Blocking | Write
+)
+
+// The built-in table: name, arity, first key, last key, step, flags and
+// the position of the number of keys of the movable ones
+var builtin = []*Command{
+	// Strings
+	{"GET", 2, 1, 1, 1, rd, 0},
+	{"SET", -3, 1, 1, 1, wr, 0},
+	{"SETEX", 4, 1, 1, 1, wr, 0},
+	{"PSETEX", 4, 1, 1, 1, wr, 0},
+	{"SETNX", 3, 1, 1, 1, wr, 0},
+	{"GETSET", 3, 1, 1, 1, wr, 0},
+	{"GETDEL", 2, 1, 1, 1, wr, 0},
+	{"GETEX", -2, 1, 1, 1, wr, 0},
+	{"APPEND", 3, 1, 1, 1, wr, 0},
+	{"STRLEN", 2, 1, 1, 1, rd, 0},
+	{"GETRANGE", 4, 1, 1, 1, rd, 0},
+	{"SUBSTR", 4, 1, 1, 1, rd, 0},
+	{"SETRANGE", 4, 1, 1, 1, wr, 0},
+	{"GETBIT", 3, 1, 1, 1, rd, 0},
+	{"SETBIT", 4, 1, 1, 1, wr, 0},
+	{"BITCOUNT", -2, 1, 1, 1, rd, 0},
+	{"BITPOS", -3, 1, 1, 1, rd, 0},
+	{"BITFIELD", -2, 1, 1, 1, wr, 0},
+	{"BITFIELD_RO", -2, 1, 1, 1, rd, 0},
+	{"BITOP", -4, 2, -1, 1, wr, 0},
+	{"INCR", 2, 1, 1, 1, wr, 0},
+	{"DECR", 2, 1, 1, 1, wr, 0},
+	{"INCRBY", 3, 1, 1, 1, wr, 0},
+	{"DECRBY", 3, 1, 1, 1, wr, 0},
+	{"INCRBYFLOAT", 3, 1, 1, 1, wr, 0},
+	{"MGET", -2, 1, -1, 1, rd, 0},
+	{"MSET", -3, 1, -1, 2, wr, 0},
+	{"MSETNX", -3, 1, -1, 2, wr, 0},
+
+	// Keys
+	{"DEL", -2, 1, -1, 1, wr, 0},
+	{"UNLINK", -2, 1, -1, 1, wr, 0},
+	{"EXISTS", -2, 1, -1, 1, rd, 0},
+	{"TOUCH", -2, 1, -1, 1, rd, 0},
+	{"EXPIRE", -3, 1, 1, 1, wr, 0},
+	{"EXPIREAT", -3, 1, 1, 1, wr, 0},
+	{"PEXPIRE", -3, 1, 1, 1, wr, 0},
+	{"PEXPIREAT", -3, 1, 1, 1, wr, 0},
+	{"PERSIST", 2, 1, 1, 1, wr, 0},
+	{"TTL", 2, 1, 1, 1, rd, 0},
+	{"PTTL", 2, 1, 1, 1, rd, 0},
+	{"TYPE", 2, 1, 1, 1, rd, 0},
+	{"DUMP", 2, 1, 1, 1, rd, 0},
+	{"RESTORE", -4, 1, 1, 1, wr, 0},
+	{"OBJECT", -2, 2, 2, 1, rd, 0},
+	{"RENAME", 3, 1, 2, 1, wr, 0},
+	{"RENAMENX", 3, 1, 2, 1, wr, 0},
+	{"COPY", -3, 1, 2, 1, wr, 0},
+	{"SORT", -2, 1, 1, 1, wr, 0},
+	{"KEYS", 2, 0, 0, 0, rd | AnyKey, 0},
+	{"SCAN", -2, 0, 0, 0, rd | AnyKey, 0},
+	{"RANDOMKEY", 1, 0, 0, 0, rd | AnyKey, 0},
+	{"DBSIZE", 1, 0, 0, 0, rd | AnyKey, 0},
+	{"FLUSHDB", -1, 0, 0, 0, wr | AnyKey, 0},
+	{"FLUSHALL", -1, 0, 0, 0, wr | AnyKey, 0},
+
+	// Hashes
+	{"HSET", -4, 1, 1, 1, wr, 0},
+	{"HSETNX", 4, 1, 1, 1, wr, 0},
+	{"HMSET", -4, 1, 1, 1, wr, 0},
+	{"HGET", 3, 1, 1, 1, rd, 0},
+	{"HMGET", -3, 1, 1, 1, rd, 0},
+	{"HGETALL", 2, 1, 1, 1, rd, 0},
+	{"HDEL", -3, 1, 1, 1, wr, 0},
+	{"HEXISTS", 3, 1, 1, 1, rd, 0},
+	{"HLEN", 2, 1, 1, 1, rd, 0},
+	{"HKEYS", 2, 1, 1, 1, rd, 0},
+	{"HVALS", 2, 1, 1, 1, rd, 0},
+	{"HINCRBY", 4, 1, 1, 1, wr, 0},
+	{"HINCRBYFLOAT", 4, 1, 1, 1, wr, 0},
+	{"HSTRLEN", 3, 1, 1, 1, rd, 0},
+	{"HSCAN", -3, 1, 1, 1, rd, 0},
+	{"HRANDFIELD", -2, 1, 1, 1, rd, 0},
+
+	// Lists
+	{"LPUSH", -3, 1, 1, 1, wr, 0},
+	{"RPUSH", -3, 1, 1, 1, wr, 0},
+	{"LPUSHX", -3, 1, 1, 1, wr, 0},
+	{"RPUSHX", -3, 1, 1, 1, wr, 0},
+	{"LPOP", -2, 1, 1, 1, wr, 0},
+	{"RPOP", -2, 1, 1, 1, wr, 0},
+	{"LLEN", 2, 1, 1, 1, rd, 0},
+	{"LRANGE", 4, 1, 1, 1, rd, 0},
+	{"LINDEX", 3, 1, 1, 1, rd, 0},
+	{"LSET", 4, 1, 1, 1, wr, 0},
+	{"LREM", 4, 1, 1, 1, wr, 0},
+	{"LTRIM", 4, 1, 1, 1, wr, 0},
+	{"LINSERT", 5, 1, 1, 1, wr, 0},
+	{"LPOS", -3, 1, 1, 1, rd, 0},
+	{"RPOPLPUSH", 3, 1, 2, 1, wr, 0},
+	{"LMOVE", 5, 1, 2, 1, wr, 0},
+	{"BLPOP", -3, 1, -2, 1, bw, 0},
+	{"BRPOP", -3, 1, -2, 1, bw, 0},
+	{"BRPOPLPUSH", 4, 1, 2, 1, bw, 0},
+	{"BLMOVE", 6, 1, 2, 1, bw, 0},
+
+	// Sets
+	{"SADD", -3, 1, 1, 1, wr, 0},
+	{"SREM", -3, 1, 1, 1, wr, 0},
+	{"SMEMBERS", 2, 1, 1, 1, rd, 0},
+	{"SISMEMBER", 3, 1, 1, 1, rd, 0},
+	{"SMISMEMBER", -3, 1, 1, 1, rd, 0},
+	{"SCARD", 2, 1, 1, 1, rd, 0},
+	{"SPOP", -2, 1, 1, 1, wr, 0},
+	{"SRANDMEMBER", -2, 1, 1, 1, rd, 0},
+	{"SSCAN", -3, 1, 1, 1, rd, 0},
+	{"SMOVE", 4, 1, 2, 1, wr, 0},
+	{"SINTER", -2, 1, -1, 1, rd, 0},
+	{"SUNION", -2, 1, -1, 1, rd, 0},
+	{"SDIFF", -2, 1, -1, 1, rd, 0},
+	{"SINTERSTORE", -3, 1, -1, 1, wr, 0},
+	{"SUNIONSTORE", -3, 1, -1, 1, wr, 0},
+	{"SDIFFSTORE", -3, 1, -1, 1, wr, 0},
+
+	// Sorted sets
+	{"ZADD", -4, 1, 1, 1, wr, 0},
+	{"ZREM", -3, 1, 1, 1, wr, 0},
+	{"ZINCRBY", 4, 1, 1, 1, wr, 0},
+	{"ZSCORE", 3, 1, 1, 1, rd, 0},
+	{"ZMSCORE", -3, 1, 1, 1, rd, 0},
+	{"ZCARD", 2, 1, 1, 1, rd, 0},
+	{"ZCOUNT", 4, 1, 1, 1, rd, 0},
+	{"ZRANK", -3, 1, 1, 1, rd, 0},
+	{"ZREVRANK", -3, 1, 1, 1, rd, 0},
+	{"ZRANGE", -4, 1, 1, 1, rd, 0},
+	{"ZREVRANGE", -4, 1, 1, 1, rd, 0},
+	{"ZRANGEBYSCORE", -4, 1, 1, 1, rd, 0},
+	{"ZREVRANGEBYSCORE", -4, 1, 1, 1, rd, 0},
+	{"ZRANGEBYLEX", -4, 1, 1, 1, rd, 0},
+	{"ZREVRANGEBYLEX", -4, 1, 1, 1, rd, 0},
+	{"ZLEXCOUNT", 4, 1, 1, 1, rd, 0},
+	{"ZREMRANGEBYRANK", 4, 1, 1, 1, wr, 0},
+	{"ZREMRANGEBYSCORE", 4, 1, 1, 1, wr, 0},
+	{"ZREMRANGEBYLEX", 4, 1, 1, 1, wr, 0},
+	{"ZSCAN", -3, 1, 1, 1, rd, 0},
+	{"ZPOPMIN", -2, 1, 1, 1, wr, 0},
+	{"ZPOPMAX", -2, 1, 1, 1, wr, 0},
+	{"BZPOPMIN", -3, 1, -2, 1, bw, 0},
+	{"BZPOPMAX", -3, 1, -2, 1, bw, 0},
+	{"ZUNIONSTORE", -4, 1, 1, 1, wr | Movable, 2},
+	{"ZINTERSTORE", -4, 1, 1, 1, wr | Movable, 2},
+
+	// HyperLogLog, geo and streams
+	{"PFADD", -2, 1, 1, 1, wr, 0},
+	{"PFCOUNT", -2, 1, -1, 1, rd, 0},
+	{"PFMERGE", -2, 1, -1, 1, wr, 0},
+	{"GEOADD", -5, 1, 1, 1, wr, 0},
+	{"GEOPOS", -2, 1, 1, 1, rd, 0},
+	{"GEODIST", -4, 1, 1, 1, rd, 0},
+	{"GEOHASH", -2, 1, 1, 1, rd, 0},
+	{"GEORADIUS", -6, 1, 1, 1, wr, 0},
+	{"GEORADIUSBYMEMBER", -5, 1, 1, 1, wr, 0},
+	{"GEOSEARCH", -7, 1, 1, 1, rd, 0},
+	{"XADD", -5, 1, 1, 1, wr, 0},
+	{"XLEN", 2, 1, 1, 1, rd, 0},
+	{"XRANGE", -4, 1, 1, 1, rd, 0},
+	{"XREVRANGE", -4, 1, 1, 1, rd, 0},
+	{"XDEL", -3, 1, 1, 1, wr, 0},
+	{"XTRIM", -4, 1, 1, 1, wr, 0},
+
+	// Scripting and transactions
+	{"EVAL", -3, 0, 0, 0, wr | Movable, 2},
+	{"EVALSHA", -3, 0, 0, 0, wr | Movable, 2},
+	{"MULTI", 1, 0, 0, 0, AnyKey, 0},
+	{"EXEC", 1, 0, 0, 0, wr | AnyKey, 0},
+	{"DISCARD", 1, 0, 0, 0, 0, 0},
+	{"WATCH", -2, 1, -1, 1, rd, 0},
+	{"UNWATCH", 1, 0, 0, 0, 0, 0},
+
+	// Connection and server
+	{"PING", -1, 0, 0, 0, 0, 0},
+	{"ECHO", 2, 0, 0, 0, 0, 0},
+	{"QUIT", -1, 0, 0, 0, 0, 0},
+	{"AUTH", -2, 0, 0, 0, 0, 0},
+	{"SELECT", 2, 0, 0, 0, 0, 0},
+	{"HELLO", -1, 0, 0, 0, 0, 0},
+	{"CLIENT", -2, 0, 0, 0, 0, 0},
+	{"COMMAND", -1, 0, 0, 0, 0, 0},
+	{"CONFIG", -2, 0, 0, 0, 0, 0},
+	{"INFO", -1, 0, 0, 0, 0, 0},
+	{"TIME", 1, 0, 0, 0, 0, 0},
+	{"PUBLISH", 3, 0, 0, 0, 0, 0},
+}
@@ -0,0 +1,287 @@
+package fs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// The archiver packs the minute directories that are closed, older than
+// ArchiveGrace, in tar files with the names expected by ifaceS3:
+//
+//	project/2018/02/16/02/project_2018-02-16-02_17-17_0.tar
+//
+// The files of all the shards of the minute are in the tar without
+// directories. The tar files are uploaded to S3Bucket, verified and the
+// local directory is deleted.
+
+const (
+	defaultArchiveGrace   = 120 * time.Second
+	defaultArchiveMaxSize = 512 // MB
+	maxArchiveParts       = 100 // The part of the name has up to 2 digits
+	minuteLayout          = "2006/01/02/15/04"
+)
+
+var (
+	archiveInterval = 30 * time.Second
+
+	archivedFiles = lib.NewCounterVec("fs_archived_total", "Tar files uploaded to S3 by the archiver", "relayer")
+	archiveErrors = lib.NewCounterVec("fs_archive_errors_total", "Minute directories the archiver failed to upload", "relayer")
+)
+
+type archiver struct {
+	srv    *Server
+	files  int64
+	errors int64
+	exitCh chan bool
+}
+
+func newArchiver(srv *Server) *archiver {
+	a := &archiver{
+		srv:    srv,
+		exitCh: make(chan bool),
+	}
+	go a.listen()
+	return a
+}
+
+func (a *archiver) listen() {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.exitCh:
+			return
+		case <-ticker.C:
+			a.run(time.Now())
+		}
+	}
+}
+
+func (a *archiver) exit() {
+	close(a.exitCh)
+}
+
+// run archives the minute directories closed before now
+func (a *archiver) run(now time.Time) {
+	a.srv.Lock()
+	c := a.srv.config
+	sess := a.srv.s3sess
+	a.srv.Unlock()
+
+	if sess == nil || c.S3Bucket == "" {
+		log.Printf("FS ERROR archiver: %s has no S3 session or bucket", c.Listen)
+		return
+	}
+	grace := time.Duration(c.ArchiveGrace) * time.Second
+	if grace <= 0 {
+		grace = defaultArchiveGrace
+	}
+
+	for _, d := range minuteDirs(c.Path) {
+		if d.t.Add(time.Minute + grace).After(now) {
+			continue
+		}
+
+		if err := a.archive(&c, sess, d.project, d.t, d.path); err != nil {
+			atomic.AddInt64(&a.errors, 1)
+			archiveErrors.With(c.Listen).Inc()
+			log.Printf("FS ERROR archiver: %s %s", d.path, err)
+		}
+	}
+}
+
+// minuteDir is a directory with the files of a project in a minute
+type minuteDir struct {
+	project string
+	t       time.Time
+	path    string
+}
+
+// minuteDirs returns the minute directories of all the projects under root,
+// project/YYYY/MM/DD/HH/MM, sorted by project and the oldest first
+func minuteDirs(root string) []minuteDir {
+	var dirs []minuteDir
+	paths, _ := filepath.Glob(filepath.Join(root, "*", "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	for _, path := range paths {
+		rel, _ := filepath.Rel(root, path)
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		t, err := time.Parse(minuteLayout, parts[1])
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, minuteDir{project: parts[0], t: t, path: path})
+	}
+	return dirs
+}
+
+// removeMinute deletes the minute directory and its parents if they are
+// empty, up to the directory of the project
+func removeMinute(root string, d minuteDir) error {
+	if err := os.RemoveAll(d.path); err != nil {
+		return err
+	}
+	dirCache.forget(d.path)
+	for parent := filepath.Dir(d.path); parent != filepath.Join(root, d.project); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// archive uploads the files of the minute directory and deletes it
+func (a *archiver) archive(c *lib.RelayerConfig, sess *session.Session, project string, t time.Time, dir string) error {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		// project/2018/02/16/02/project_2018-02-16-02_17-17_
+		prefix := fmt.Sprintf("%s/%s/%s_%s_%s-%s_", project, t.Format("2006/01/02/15"),
+			project, t.Format("2006-01-02-15"), t.Format("04"), t.Format("04"))
+
+		// The minute could have been archived before, e.g. writes with
+		// an old timestamp, the new parts go after the existing ones
+		part, err := countObjects(sess, c.S3Bucket, prefix)
+		if err != nil {
+			return err
+		}
+
+		maxSize := int64(c.ArchiveMaxSize) << 20
+		if maxSize <= 0 {
+			maxSize = defaultArchiveMaxSize << 20
+		}
+		for len(files) > 0 {
+			if part >= maxArchiveParts {
+				return fmt.Errorf("too many parts for %s", prefix)
+			}
+			n, err := a.uploadPart(c, sess, fmt.Sprintf("%s%d.tar", prefix, part), files, maxSize)
+			if err != nil {
+				return err
+			}
+			files = files[n:]
+			part++
+		}
+	}
+
+	return removeMinute(c.Path, minuteDir{project: project, t: t, path: dir})
+}
+
+// uploadPart packs files in a tar up to maxSize, at least one file,
+// uploads it to key and returns the number of files in it
+func (a *archiver) uploadPart(c *lib.RelayerConfig, sess *session.Session, key string, files []string, maxSize int64) (int, error) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "smart-relayer-archive-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tw := tar.NewWriter(tmp)
+	n := 0
+	var size int64
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && size+fi.Size() > maxSize {
+			break
+		}
+		if err := addToTar(tw, name, fi); err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	size, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(c.S3Bucket),
+		Key:    aws.String(key),
+		Body:   tmp,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Verify the uploaded object before deleting the local files
+	head, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(c.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if head.ContentLength == nil || *head.ContentLength != size {
+		return 0, fmt.Errorf("%s uploaded with a wrong size", key)
+	}
+
+	atomic.AddInt64(&a.files, 1)
+	archivedFiles.With(c.Listen).Inc()
+	lib.Debugf("FS archiver: uploaded %s with %d files, %d bytes", key, n, size)
+	return n, nil
+}
+
+func addToTar(tw *tar.Writer, name string, fi os.FileInfo) error {
+	h, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	h.Name = filepath.Base(name)
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+func countObjects(sess *session.Session, bucket, prefix string) (int, error) {
+	n := 0
+	err := s3.New(sess).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(p *s3.ListObjectsOutput, last bool) bool {
+		n += len(p.Contents)
+		return true
+	})
+	return n, err
+}
@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// fakeS3 stores the objects of a bucket in memory, it understands the
+// PUT, HEAD and GET of objects and the listing with a prefix
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+type listResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key  string
+		Size int
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Path style: /bucket/key
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		var l listResult
+		keys := make([]string, 0, len(s.objects))
+		for k := range s.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				l.Contents = append(l.Contents, struct {
+					Key  string
+					Size int
+				}{k, len(s.objects[k])})
+			}
+		}
+		xml.NewEncoder(w).Encode(l)
+		return
+	}
+
+	key := parts[1]
+	switch r.Method {
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = b
+		w.Header().Set("ETag", `"etag"`)
+	case "GET", "HEAD":
+		b, ok := s.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, strings.NewReader(string(b)))
+	}
+}
+
+func TestArchiver(t *testing.T) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(s3)
+	defer ts.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	dir, err := ioutil.TempDir("", "fs-archiver-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:   "fs",
+		Mode:       "sync",
+		Listen:     "tcp://127.0.0.1:0",
+		Path:       dir,
+		Shards:     2,
+		Writers:    1,
+		Region:     "us-east-1",
+		S3Bucket:   "bucket",
+		S3Endpoint: ts.URL,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// 2018-02-16 02:17:30 UTC
+	const ts1 = "1518747450"
+	for _, k := range []string{"a", "b", "c"} {
+		redis.NewResp([]interface{}{"SET", "main", k, ts1, "value-" + k}).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET %s: %s", k, r.Err)
+		}
+	}
+	minute := filepath.Join(dir, "main", "2018", "02", "16", "02", "17")
+	waitFiles(t, minute, 3)
+
+	a := &archiver{srv: srv}
+	a.run(time.Now())
+
+	const object = "main/2018/02/16/02/main_2018-02-16-02_17-17_0.tar"
+	if _, ok := s3.objects[object]; !ok || len(s3.objects) != 1 {
+		t.Fatalf("expected %s, the objects are %v", object, s3.objects)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main", "2018")); !os.IsNotExist(err) {
+		t.Errorf("the local directories weren't deleted: %v", err)
+	}
+	if a.files != 1 || a.errors != 0 {
+		t.Errorf("expected 1 file and no errors, got %d and %d", a.files, a.errors)
+	}
+
+	// The GET finds it in the tar
+	redis.NewResp([]interface{}{"GET", "main", "b", ts1}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "value-b" {
+		t.Fatalf("GET from S3: expected value-b, got %q", s)
+	}
+
+	// A late write of the same minute goes to the next part
+	redis.NewResp([]interface{}{"SET", "main", "d", ts1, "value-d"}).WriteTo(conn)
+	reader.Read()
+	waitFiles(t, minute, 1)
+	a.run(time.Now())
+	if _, ok := s3.objects["main/2018/02/16/02/main_2018-02-16-02_17-17_1.tar"]; !ok {
+		t.Fatalf("expected the second part, the objects are %v", s3.objects)
+	}
+
+	// The newest part is the one with the highest number, _10 after _2
+	for part := 2; part <= 10; part++ {
+		redis.NewResp([]interface{}{"SET", "main", "b", ts1, fmt.Sprintf("value-b%d", part)}).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET part %d: %s", part, r.Err)
+		}
+		waitFiles(t, minute, 1)
+		a.run(time.Now())
+	}
+	redis.NewResp([]interface{}{"GET", "main", "b", ts1}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "value-b10" {
+		t.Errorf("GET from S3: expected value-b10, got %q", s)
+	}
+	redis.NewResp([]interface{}{"MGETTIME", "main", "b", ts1, ts1}).WriteTo(conn)
+	if versions, _ := reader.Read().Array(); len(versions) != 2 {
+		t.Errorf("MGETTIME from S3: expected a version, got %v", versions)
+	} else if s, _ := versions[1].Str(); s != "value-b10" {
+		t.Errorf("MGETTIME from S3: expected value-b10, got %q", s)
+	}
+}
+
+// waitFiles waits until the writers stored n files in dir
+func waitFiles(t *testing.T, dir string, n int) {
+	t.Helper()
+	for i := 0; ; i++ {
+		found := 0
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				found++
+			}
+			return nil
+		})
+		if found == n {
+			return
+		}
+		if i > 100 {
+			t.Fatalf("expected %d files in %s, found %d", n, dir, found)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,6 +3,8 @@ package fs
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -103,3 +105,15 @@ func (d *MkDirCache) makeAll(key string) error {
 
 	return nil
 }
+
+// forget removes from the cache the directory and its subdirectories, they
+// were deleted
+func (d *MkDirCache) forget(dir string) {
+	dir = filepath.Clean(dir)
+	d.m.Range(func(key, val interface{}) bool {
+		if k := filepath.Clean(key.(string)); k == dir || strings.HasPrefix(k, dir+"/") {
+			d.m.Delete(key)
+		}
+		return true
+	})
+}
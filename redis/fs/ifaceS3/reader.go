@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -24,9 +25,18 @@ import (
 
 var (
 	// main/2018/02/16/02/main_2018-02-16-02_17-25_3.tar
-	fileRegexp, _ = regexp.Compile(`.*[\w\_]+_\d{4}-\d{2}-\d{2}-\d{2}_(\d{2})-(\d{2})_\d{1,2}\.tar`)
+	fileRegexp, _ = regexp.Compile(`.*[\w\_]+_\d{4}-\d{2}-\d{2}-\d{2}_(\d{2})-(\d{2})_(\d{1,2})\.tar`)
 )
 
+// archive is a tar file with the minutes from-to, the parts of the same
+// minutes are numbered in the order they were uploaded
+type archive struct {
+	key  *string
+	from int
+	to   int
+	part int
+}
+
 func NewReaderUncompress(sess *session.Session, bucket string) *ReaderUncompress {
 	r := &ReaderUncompress{
 		sess:   sess,
@@ -46,42 +56,97 @@ type ReaderUncompress struct {
 func (r *ReaderUncompress) Get(key, path string, t time.Time) ([]byte, error) {
 	lib.Debugf("S3 Get: %s: %s/%s", t.UTC(), path, key)
 
-	svc := s3.New(r.sess)
+	archives, err := r.archives(path)
+	if err != nil {
+		return nil, err
+	}
 
-	var response []byte
+	// The minute can be split in several parts, the newest is the last one
+	minute := t.UTC().Minute()
+	for i := len(archives) - 1; i >= 0; i-- {
+		a := archives[i]
+		if minute < a.from || minute > a.to {
+			continue
+		}
+		lib.Debugf("S3 Bucket: %s: %s", t.UTC(), *a.key)
+		if b, err := r.download(key, a.key); err == nil && b != nil {
+			return b, nil
+		}
+	}
+	return nil, nil
+}
 
-	err := svc.ListObjectsPages(&s3.ListObjectsInput{
-		Bucket: aws.String(r.bucket),
-		Prefix: aws.String(path),
-	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
-		for _, obj := range p.Contents {
-			s := fileRegexp.FindStringSubmatch(*obj.Key)
+// GetMinutes returns the versions of key in the tar files of the hour path
+// that cover any of the minutes, by the first of the minutes in each file
+func (r *ReaderUncompress) GetMinutes(key, path string, minutes []int) (map[int][]byte, error) {
+	lib.Debugf("S3 GetMinutes: %s/%s %v", path, key, minutes)
 
-			from, err := strconv.ParseInt(s[1], 10, 64)
-			if err != nil {
+	archives, err := r.archives(path)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make(map[int][]byte)
+	for _, a := range archives {
+		for _, m := range minutes {
+			if m < a.from || m > a.to {
 				continue
 			}
-			to, err := strconv.ParseInt(s[2], 10, 64)
-			if err != nil {
-				continue
+			// The next parts of the minute replace the previous ones
+			if b, err := r.download(key, a.key); err == nil && b != nil {
+				response[m] = b
 			}
+			break
+		}
+	}
+	return response, nil
+}
 
-			if t.UTC().Minute() >= int(from) && t.UTC().Minute() <= int(to) {
-				lib.Debugf("S3 Bucket: %s: %s", t.UTC(), *obj.Key)
-				if r, err := r.download(key, obj.Key); err == nil {
-					response = r
-					return true
-				}
+// archives returns the tar files of the hour path sorted by part, as
+// numbers, the newest parts are the last ones
+func (r *ReaderUncompress) archives(path string) ([]archive, error) {
+	var archives []archive
+	err := s3.New(r.sess).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(path),
+	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
+		for _, obj := range p.Contents {
+			if a, ok := parseArchive(obj.Key); ok {
+				archives = append(archives, a)
 			}
 		}
 		return true
 	})
-
 	if err != nil {
 		log.Printf("FS S3 ERROR: %s", err)
+		return nil, err
 	}
 
-	return response, err
+	sort.SliceStable(archives, func(i, j int) bool {
+		return archives[i].part < archives[j].part
+	})
+	return archives, nil
+}
+
+// parseArchive returns the minutes and the part in the name of a tar file
+func parseArchive(key *string) (a archive, ok bool) {
+	s := fileRegexp.FindStringSubmatch(*key)
+	if s == nil {
+		return a, false
+	}
+
+	a.key = key
+	var err error
+	if a.from, err = strconv.Atoi(s[1]); err != nil {
+		return a, false
+	}
+	if a.to, err = strconv.Atoi(s[2]); err != nil {
+		return a, false
+	}
+	if a.part, err = strconv.Atoi(s[3]); err != nil {
+		return a, false
+	}
+	return a, true
 }
 
 func (r *ReaderUncompress) download(key string, objKey *string) ([]byte, error) {
@@ -117,7 +182,7 @@ func (r *ReaderUncompress) download(key string, objKey *string) ([]byte, error)
 
 		switch h.Typeflag {
 		case tar.TypeReg:
-			if strings.HasPrefix(h.Name, key) {
+			if strings.TrimSuffix(strings.TrimSuffix(h.Name, ".gz"), ".log") == key {
 				b := &bytes.Buffer{}
 
 				lib.Debugf("S3 Object: %s", h.Name)
@@ -0,0 +1,237 @@
+package fs
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The janitor applies the retention policies of the projects, configured
+// in Retention as "project:maxAge:maxMB" separated by spaces, the project
+// "*" is the policy of the projects without one, e.g.
+//
+//	retention = "*:24h:10240 debug:1h:0"
+//
+// The minute directories older than maxAge are deleted, and the oldest
+// ones while the project uses more than maxMB, the last minute is always
+// kept because it's still being written. A zero is unlimited. The
+// SETs of a project are rejected while it uses more than QuotaHighWater
+// percent of its maxMB.
+
+const (
+	defaultPolicy    = "*"
+	defaultHighWater = 95 // percent
+)
+
+var (
+	janitorInterval = 30 * time.Second
+
+	errQuota  = errors.New("ERR - Quota exceeded")
+	respQuota = redis.NewResp(errQuota)
+
+	retentionRemoved = lib.NewCounterVec("fs_retention_removed_total", "Minute directories deleted by the retention policies", "relayer")
+	quotaRejected    = lib.NewCounterVec("fs_quota_rejected_total", "SETs rejected because the project was over its quota", "relayer")
+	projectBytes     = lib.NewGaugeVec("fs_project_bytes", "Bytes stored by each project", "relayer", "project")
+)
+
+type policy struct {
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+type janitor struct {
+	sync.Mutex
+	srv       *Server
+	name      string
+	policies  map[string]policy
+	highWater int64
+	usage     map[string]int64 // Bytes of each project
+	removed   int64
+	rejected  int64
+	exitCh    chan bool
+}
+
+func newJanitor(srv *Server) *janitor {
+	j := &janitor{
+		srv:    srv,
+		usage:  make(map[string]int64),
+		exitCh: make(chan bool),
+	}
+	go j.listen()
+	return j
+}
+
+// reload parses the policies, the invalid ones are logged and ignored
+func (j *janitor) reload(c *lib.RelayerConfig) {
+	policies := make(map[string]policy)
+	for _, s := range strings.Fields(c.Retention) {
+		f := strings.Split(s, ":")
+		if len(f) != 3 {
+			log.Printf("FS ERROR: invalid retention policy %s at port %s, ignored", s, c.Listen)
+			continue
+		}
+		var p policy
+		var err error
+		if f[1] != "0" {
+			if p.maxAge, err = time.ParseDuration(f[1]); err != nil {
+				log.Printf("FS ERROR: invalid max age in retention policy %s at port %s, ignored", s, c.Listen)
+				continue
+			}
+		}
+		mb, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil || mb < 0 {
+			log.Printf("FS ERROR: invalid max size in retention policy %s at port %s, ignored", s, c.Listen)
+			continue
+		}
+		p.maxBytes = mb << 20
+		policies[f[0]] = p
+	}
+
+	highWater := int64(c.QuotaHighWater)
+	if highWater <= 0 || highWater > 100 {
+		highWater = defaultHighWater
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	j.name = c.Listen
+	j.policies = policies
+	j.highWater = highWater
+}
+
+func (j *janitor) policy(project string) (policy, bool) {
+	if p, ok := j.policies[project]; ok {
+		return p, true
+	}
+	p, ok := j.policies[defaultPolicy]
+	return p, ok
+}
+
+// allow returns errQuota if the project is over the high-watermark
+func (j *janitor) allow(project string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	p, ok := j.policy(project)
+	if !ok || p.maxBytes == 0 || j.usage[project]*100 < p.maxBytes*j.highWater {
+		return nil
+	}
+	atomic.AddInt64(&j.rejected, 1)
+	quotaRejected.With(j.name).Inc()
+	return errQuota
+}
+
+// add counts the bytes written by the writers until the next scan, n is
+// negative if the new version of a file is smaller
+func (j *janitor) add(project string, n int64) {
+	j.Lock()
+	defer j.Unlock()
+	j.usage[project] += n
+}
+
+func (j *janitor) listen() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.exitCh:
+			return
+		case <-ticker.C:
+			j.run(time.Now())
+		}
+	}
+}
+
+func (j *janitor) exit() {
+	close(j.exitCh)
+}
+
+// run deletes the minute directories out of the policies, the oldest
+// first, and updates the usage of the projects
+func (j *janitor) run(now time.Time) {
+	j.srv.Lock()
+	root := j.srv.config.Path
+	listen := j.srv.config.Listen
+	j.srv.Unlock()
+
+	j.Lock()
+	policies := len(j.policies)
+	j.Unlock()
+	if policies == 0 {
+		return
+	}
+
+	sizes := make(map[string]int64)
+	byProject := make(map[string][]minuteDir)
+	dirSize := make(map[string]int64)
+	for _, d := range minuteDirs(root) {
+		n := sizeOf(d.path)
+		dirSize[d.path] = n
+		sizes[d.project] += n
+		byProject[d.project] = append(byProject[d.project], d)
+	}
+
+	for project, dirs := range byProject {
+		j.Lock()
+		p, ok := j.policy(project)
+		j.Unlock()
+		if !ok {
+			continue
+		}
+
+		for _, d := range dirs {
+			if d.t.After(now.Add(-time.Minute)) {
+				// The writers are still using it
+				break
+			}
+			expired := p.maxAge > 0 && d.t.Add(time.Minute+p.maxAge).Before(now)
+			over := p.maxBytes > 0 && sizes[project] > p.maxBytes
+			if !expired && !over {
+				// The next ones are newer
+				break
+			}
+			if err := removeMinute(root, d); err != nil {
+				log.Printf("FS ERROR janitor: %s %s", d.path, err)
+				continue
+			}
+			lib.Debugf("FS janitor: removed %s, %d bytes", d.path, dirSize[d.path])
+			sizes[project] -= dirSize[d.path]
+			atomic.AddInt64(&j.removed, 1)
+			retentionRemoved.With(listen).Inc()
+		}
+	}
+
+	j.Lock()
+	for project := range j.usage {
+		if _, ok := sizes[project]; !ok {
+			projectBytes.Delete(listen, project)
+		}
+	}
+	j.usage = sizes
+	j.Unlock()
+	for project, n := range sizes {
+		projectBytes.With(listen, project).Set(float64(n))
+	}
+}
+
+// sizeOf returns the bytes of the files in dir
+func sizeOf(dir string) int64 {
+	var n int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
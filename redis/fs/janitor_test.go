@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestJanitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-janitor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:       "fs",
+		Mode:           "sync",
+		Listen:         "tcp://127.0.0.1:0",
+		Path:           dir,
+		Shards:         2,
+		Writers:        1,
+		Retention:      "*:1h:0 big:0:1 small:0:1 bad:1x:1",
+		QuotaHighWater: 50,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+
+	if _, ok := srv.janitor.policies["bad"]; ok {
+		t.Errorf("the invalid policy wasn't ignored")
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	minute := func(project string, ago time.Duration, size int) string {
+		path := filepath.Join(dir, project, now.Add(-ago).Format(minuteLayout))
+		if err := os.MkdirAll(filepath.Join(path, "00"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "00", "file"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// By age with the default policy
+	oldMain := minute("main", 2*time.Hour, 10)
+	newMain := minute("main", 10*time.Minute, 10)
+	// By size, the oldest first
+	big1 := minute("big", 3*time.Hour, 600<<10)
+	big2 := minute("big", 2*time.Hour, 600<<10)
+	big3 := minute("big", time.Hour, 600<<10)
+	// The current minute is kept even if it's over the quota
+	oldSmall := minute("small", time.Hour, 2<<20)
+	newSmall := minute("small", 0, 2<<20)
+
+	srv.janitor.run(now)
+
+	for _, path := range []string{oldMain, big1, big2, oldSmall} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't deleted: %v", path, err)
+		}
+	}
+	for _, path := range []string{newMain, big3, newSmall} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was deleted: %s", path, err)
+		}
+	}
+	if srv.janitor.removed != 4 {
+		t.Errorf("expected 4 removed directories, got %d", srv.janitor.removed)
+	}
+	if u := srv.janitor.usage["big"]; u != 600<<10 {
+		t.Errorf("expected the usage of the remaining minute, got %d", u)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// big is above the high-watermark, 50% of 1 MB
+	redis.NewResp([]interface{}{"SET", "big", "k", "v"}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil || r.Err.Error() != errQuota.Error() {
+		t.Errorf("expected the quota error, got %v", r)
+	}
+	if s := srv.Stats(); s.Gauges["quotaRejected"] != 1 || s.Gauges["retentionRemoved"] != 4 {
+		t.Errorf("unexpected stats %v", s.Gauges)
+	}
+
+	// The usage counts only the last version of a file, 10 bytes were in
+	// the remaining minute of main
+	for _, v := range []string{"a long value", "short"} {
+		redis.NewResp([]interface{}{"SET", "main", "k", fmt.Sprint(now.Unix()), v}).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET of a project without quota: %s", r.Err)
+		}
+		for i := 0; ; i++ {
+			srv.janitor.Lock()
+			u := srv.janitor.usage["main"]
+			srv.janitor.Unlock()
+			if u == int64(10+len(v)) {
+				break
+			}
+			if i > 100 {
+				t.Fatalf("SET %s: expected the usage %d, got %d", v, 10+len(v), u)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,13 +31,21 @@ type Server struct {
 
 	breakPoint  int64
 	running     int64
+	durability  int
 	shardServer *ShardsServer
 	shards      uint32
 
 	lastError time.Time
 	errors    int64
 
-	s3sess *session.Session
+	storages  atomic.Value // *storages, replaced by Reload
+	fallbacks int64
+	dropped   int64
+
+	s3sess   *session.Session
+	archiver *archiver
+	janitor  *janitor
+	stats    lib.Counters
 }
 
 var (
@@ -53,6 +62,7 @@ var (
 	errNotFound    = errors.New("KO - Key not found")
 	errExiting     = errors.New("ERR - System exiting")
 	errFailing     = errors.New("ERR - System failing")
+	errName        = errors.New("ERR - Invalid project or key name")
 	respOK         = redis.NewRespSimple("OK")
 	respTrue       = redis.NewResp(1)
 	respBadCommand = redis.NewResp(errBadCmd)
@@ -65,6 +75,9 @@ var (
 	respFailing    = redis.NewResp(errFailing)
 	commands       map[string]*redis.Resp
 
+	runningGauge    = lib.NewGaugeVec("fs_running", "Messages accepted and not yet sent to the shards", "relayer")
+	breakPointGauge = lib.NewGaugeVec("fs_break_point", "Limit of running messages to declare the relayer as failing", "relayer")
+
 	defaultWritersByShard        = 2
 	defaultShards                = 32
 	defaultInterval              = 500 * time.Millisecond
@@ -77,9 +90,11 @@ var (
 
 func init() {
 	commands = map[string]*redis.Resp{
-		"PING": respOK,
-		"SET":  respOK,
-		"GET":  respOK,
+		"PING":     respOK,
+		"SET":      respOK,
+		"GET":      respOK,
+		"KEYS":     respOK,
+		"MGETTIME": respOK,
 	}
 }
 
@@ -91,6 +106,14 @@ func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 	}
 
 	srv.Reload(&c)
+	srv.recoverTmp()
+
+	runningGauge.SetFunc(func() float64 {
+		return float64(atomic.LoadInt64(&srv.running))
+	}, srv.config.Listen)
+	breakPointGauge.SetFunc(func() float64 {
+		return float64(atomic.LoadInt64(&srv.breakPoint))
+	}, srv.config.Listen)
 
 	return srv, nil
 }
@@ -100,7 +123,7 @@ func (srv *Server) exitingOrFailing() error {
 		return errExiting
 	}
 
-	if atomic.LoadInt64(&srv.running) >= srv.breakPoint {
+	if atomic.LoadInt64(&srv.running) >= atomic.LoadInt64(&srv.breakPoint) {
 		return errFailing
 	}
 
@@ -120,6 +143,33 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 	if srv.config.Path == "" {
 		srv.config.Path = defaultPath
 	}
+	if err := os.MkdirAll(srv.tmpPath(), os.ModePerm); err != nil {
+		log.Printf("FS ERROR: creating the directory of the temporary files: %s", err)
+	}
+
+	if srv.config.WriteRetries <= 0 {
+		srv.config.WriteRetries = defaultWriteRetries
+	}
+	st := &storages{storage: newStorage(srv)}
+	if srv.config.FallbackPath != "" {
+		if err := os.MkdirAll(srv.config.FallbackPath, os.ModePerm); err != nil {
+			log.Printf("FS ERROR: creating the fallback path: %s", err)
+		}
+		st.fallback = &localStorage{srv: srv, root: srv.config.FallbackPath}
+	}
+	srv.storages.Store(st)
+
+	switch srv.config.Durability {
+	case "file":
+		srv.durability = durabilityFile
+	case "dir":
+		srv.durability = durabilityDir
+	case "", "none":
+		srv.durability = durabilityNone
+	default:
+		log.Printf("FS ERROR: invalid durability %s at port %s, using none", srv.config.Durability, srv.config.Listen)
+		srv.durability = durabilityNone
+	}
 
 	// If Shards is 0 we manage it as undefined so we apply the default value
 	if srv.config.Shards == 0 {
@@ -141,7 +191,7 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 	if srv.config.BreakMultiplier == 0 {
 		srv.config.BreakMultiplier = defaultBreakMultiplier
 	}
-	srv.breakPoint = int64(srv.config.Shards * srv.config.Writers * srv.config.BreakMultiplier)
+	atomic.StoreInt64(&srv.breakPoint, int64(srv.config.Shards*srv.config.Writers*srv.config.BreakMultiplier))
 
 	// Create new shards servers or update the config
 	if srv.shardServer == nil {
@@ -156,6 +206,10 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 			Region: &srv.config.Region,
 		},
 	}
+	if srv.config.S3Endpoint != "" {
+		awsOpt.Config.Endpoint = aws.String(srv.config.S3Endpoint)
+		awsOpt.Config.S3ForcePathStyle = aws.Bool(true)
+	}
 
 	if sess, err := session.NewSessionWithOptions(awsOpt); err == nil {
 		srv.s3sess = sess
@@ -164,6 +218,19 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 		srv.s3sess = nil
 	}
 
+	if srv.janitor == nil {
+		srv.janitor = newJanitor(srv)
+	}
+	srv.janitor.reload(&srv.config)
+
+	switch {
+	case srv.config.Archive && srv.archiver == nil:
+		srv.archiver = newArchiver(srv)
+	case !srv.config.Archive && srv.archiver != nil:
+		srv.archiver.exit()
+		srv.archiver = nil
+	}
+
 	shardLen, shardCap := srv.shardServer.Len()
 
 	log.Printf("FS %s config Buffer %d Shards %d %dw %d/%d, total writers %d, running %d/%d",
@@ -208,6 +275,28 @@ func (srv *Server) Start() (e error) {
 	return
 }
 
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	shardLen, shardCap := srv.shardServer.Len()
+	s.Queued = int64(shardLen)
+	s.Gauge("capacity", int64(shardCap))
+	s.Gauge("running", atomic.LoadInt64(&srv.running))
+	s.Gauge("breakPoint", atomic.LoadInt64(&srv.breakPoint))
+	if srv.archiver != nil {
+		s.Gauge("archived", atomic.LoadInt64(&srv.archiver.files))
+		s.Gauge("archiveErrors", atomic.LoadInt64(&srv.archiver.errors))
+	}
+	s.Gauge("retentionRemoved", atomic.LoadInt64(&srv.janitor.removed))
+	s.Gauge("quotaRejected", atomic.LoadInt64(&srv.janitor.rejected))
+	s.Gauge("fallbackWrites", atomic.LoadInt64(&srv.fallbacks))
+	s.Gauge("droppedWrites", atomic.LoadInt64(&srv.dropped))
+	return s
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	atomic.StoreUint32(&srv.exiting, 1)
@@ -233,6 +322,17 @@ func (srv *Server) Exit() {
 
 	srv.shardServer.Exit()
 
+	srv.Lock()
+	if srv.archiver != nil {
+		srv.archiver.exit()
+		srv.archiver = nil
+	}
+	srv.janitor.exit()
+	srv.Unlock()
+
+	runningGauge.Delete(srv.config.Listen)
+	breakPointGauge.Delete(srv.config.Listen)
+
 	// finishing the server
 	srv.done <- true
 }
@@ -241,7 +341,10 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 
 	defer netCon.Close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(netCon)
+	session := lib.NewSession(&srv.config)
 
 	for {
 
@@ -263,11 +366,17 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			continue
 		}
 
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			resp.WriteTo(netCon)
+			continue
+		}
+
 		fastResponse, ok := commands[req.Command]
 		if !ok {
 			respBadCommand.WriteTo(netCon)
 			continue
 		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
 
 		switch req.Command {
 		case "PING":
@@ -293,10 +402,15 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 				log.Printf("FS ERROR: %s", err)
 				switch err {
 				case errFailing:
+					atomic.AddInt64(&srv.stats.Overloaded, 1)
 					respFailing.WriteTo(netCon)
+				case errQuota:
+					atomic.AddInt64(&srv.stats.Overloaded, 1)
+					respQuota.WriteTo(netCon)
 				case errExiting:
 					respExiting.WriteTo(netCon)
 				default:
+					atomic.AddInt64(&srv.stats.Errors, 1)
 					redis.NewResp(err).WriteTo(netCon)
 				}
 			}
@@ -308,14 +422,38 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			}
 
 			if err := srv.get(netCon, req.Items); err != nil {
-				switch err {
-				case err.(*os.PathError):
+				if _, ok := err.(*os.PathError); ok {
 					respNotFound.WriteTo(netCon)
-				default:
+				} else {
+					atomic.AddInt64(&srv.stats.Errors, 1)
 					log.Printf("FS ERROR GET: %s", err)
 					redis.NewResp(err).WriteTo(netCon)
 				}
 			}
+		case "KEYS":
+			// KEYS project from to [pattern]
+			if len(req.Items) < 4 || len(req.Items) > 5 {
+				respBadKeys.WriteTo(netCon)
+				continue
+			}
+
+			if err := srv.keys(netCon, req.Items); err != nil {
+				atomic.AddInt64(&srv.stats.Errors, 1)
+				log.Printf("FS ERROR KEYS: %s", err)
+				redis.NewResp(err).WriteTo(netCon)
+			}
+		case "MGETTIME":
+			// MGETTIME project key from to
+			if len(req.Items) != 5 {
+				respBadMGet.WriteTo(netCon)
+				continue
+			}
+
+			if err := srv.mgettime(netCon, req.Items); err != nil {
+				atomic.AddInt64(&srv.stats.Errors, 1)
+				log.Printf("FS ERROR MGETTIME: %s", err)
+				redis.NewResp(err).WriteTo(netCon)
+			}
 		default:
 			log.Panicf("FS ERROR: Invalid command: This never should happen, check the cases or the list of valid command")
 		}
@@ -329,6 +467,17 @@ func (srv *Server) set(netCon net.Conn, items []*redis.Resp) (err error) {
 		return err
 	}
 
+	project, err := items[1].Str()
+	if err != nil {
+		return err
+	}
+	if err := checkName(project); err != nil {
+		return err
+	}
+	if err := srv.janitor.allow(project); err != nil {
+		return err
+	}
+
 	atomic.AddInt64(&srv.running, 1)
 
 	// Reduce running counter if found some failure
@@ -342,17 +491,16 @@ func (srv *Server) set(netCon net.Conn, items []*redis.Resp) (err error) {
 	// Get a message struct from the pool
 	msg := getMsg(srv)
 
-	// Find the project name
-	msg.project, err = items[1].Str()
-	if err != nil {
-		return err
-	}
+	msg.project = project
 
 	// Find the key name of the message
 	msg.k, err = items[2].Str()
 	if err != nil {
 		return err
 	}
+	if err = checkName(msg.k); err != nil {
+		return err
+	}
 	// Calculate the shard for this message
 	msg.getShard()
 
@@ -400,6 +548,7 @@ func (srv *Server) set(netCon net.Conn, items []*redis.Resp) (err error) {
 
 	// Send response to the client
 	redis.NewResp(r).WriteTo(netCon)
+	atomic.AddInt64(&srv.stats.Async, 1)
 
 	if err = msg.storeTmp(); err != nil {
 		return err
@@ -419,12 +568,18 @@ func (srv *Server) get(netCon net.Conn, items []*redis.Resp) (err error) {
 	if err != nil {
 		return err
 	}
+	if err = checkName(msg.project); err != nil {
+		return err
+	}
 
 	// Find the key name
 	msg.k, err = items[2].Str()
 	if err != nil {
 		return err
 	}
+	if err = checkName(msg.k); err != nil {
+		return err
+	}
 	msg.getShard()
 
 	// Verify if the 3th item is a int64 value to be converted in time
@@ -445,3 +600,12 @@ func (srv *Server) get(netCon net.Conn, items []*redis.Resp) (err error) {
 	redis.NewResp(b).WriteTo(netCon)
 	return nil
 }
+
+// checkName returns errName if the project or the key are empty or could
+// be a path out of the directories of the storage
+func checkName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return errName
+	}
+	return nil
+}
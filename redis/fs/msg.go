@@ -40,6 +40,7 @@ func getMsg(srv *Server) *Msg {
 	m.shard = -1
 	m.srv = srv
 	m.disableShards = false
+	m.retries = 0
 	return m
 }
 
@@ -63,16 +64,23 @@ type Msg struct {
 	disableShards bool
 	tmp           string
 	gz            bool
+	retries       int // Failed writes in the storage
 }
 
+// storeTmp writes the message in a temporary file in the same filesystem
+// than the destination, the writers rename it into place
 func (m *Msg) storeTmp() error {
-	tmp, err := ioutil.TempFile(os.TempDir(), "smart-relayer-fs-")
+	tmp, err := ioutil.TempFile(m.srv.tmpPath(), tmpPrefix)
 	if err != nil {
 		return err
 	}
 	defer tmp.Close()
 
 	m.tmp = tmp.Name()
+	if err := tmp.Chmod(fileMode); err != nil {
+		log.Printf("File ERROR: chmod: %s", err)
+		return err
+	}
 
 	// Use the compression if is active in the configuration and the message
 	// is bigger than 512 bytes (minSizeForCompress)
@@ -81,7 +89,7 @@ func (m *Msg) storeTmp() error {
 			log.Printf("File ERROR: writing log: %s", err)
 			return err
 		}
-		return nil
+		return m.srv.syncFile(tmp)
 	}
 
 	m.gz = true
@@ -94,6 +102,9 @@ func (m *Msg) storeTmp() error {
 	}
 	zw.Close()
 
+	if err := m.srv.syncFile(tmp); err != nil {
+		return err
+	}
 	if err := tmp.Close(); err != nil {
 		return err
 	}
@@ -106,16 +117,23 @@ func (m *Msg) storeTmp() error {
 }
 
 func (m *Msg) sentToShard() error {
+	// The message could be reused once it's sent
+	srv := m.srv
 	defer func() {
-		atomic.AddInt64(&m.srv.running, -1)
+		atomic.AddInt64(&srv.running, -1)
 	}()
 
-	ss, err := m.srv.shardServer.get(m.shard)
+	ss, err := srv.shardServer.get(m.shard)
 	if err != nil {
-		return fmt.Errorf("shardServer: %s", err)
+		err = fmt.Errorf("shardServer: %s", err)
+		if srv.toFallback(m) != nil {
+			return err
+		}
+		log.Printf("FS ERROR: %s", err)
+		putMsg(m)
+		return nil
 	}
 
-	// TODO: find another storage in case of failure
 	ss.C <- m
 	return nil
 }
@@ -177,36 +195,30 @@ func (m *Msg) filenamePlain() string {
 }
 
 func (m *Msg) Bytes() (b []byte, err error) {
-
-	if m.srv.config.Compress {
-		lib.Debugf("FS Read local file: %s/%s - %s", m.fullpath(), m.filenameGz(), m.t.UTC())
-		b, err = m.bytesFile(fmt.Sprintf("%s/%s", m.fullpath(), m.filenameGz()), true)
-		if err == nil {
-			return
-		}
-		// If the file is empty, that means the file exists so we return here
-		if err == io.EOF {
-			return
-		}
-	}
-
-	lib.Debugf("FS Read local file: %s/%s - %s", m.fullpath(), m.filenamePlain(), m.t.UTC())
-	b, err = m.bytesFile(fmt.Sprintf("%s/%s", m.fullpath(), m.filenamePlain()), false)
-	if err == nil {
+	b, err = m.bytesStored()
+	if err == nil || err == io.EOF {
 		return
 	}
 
-	// check if the file exists disabling the shards just for this message
-	if m.srv.shards > 0 && !m.disableShards {
-		m.disableShards = true
-		return m.Bytes()
-	}
-
 	lib.Debugf("FS Read S3: %s/%s - %s", m.path(), m.filenamePlain(), m.t.UTC())
 	b, err = m.bytesS3()
 	return
 }
 
+// bytesStored reads the message from the storage and the fallback path
+func (m *Msg) bytesStored() ([]byte, error) {
+	b, err := m.srv.getStorage().read(m)
+	fallback := m.srv.getFallback()
+	if err == nil || err == io.EOF || fallback == nil {
+		return b, err
+	}
+
+	if fb, ferr := fallback.read(m); ferr == nil || ferr == io.EOF {
+		return fb, ferr
+	}
+	return b, err
+}
+
 func (m *Msg) bytesFile(filename string, gz bool) ([]byte, error) {
 	file, err := os.Open(filename)
 	if err != nil {
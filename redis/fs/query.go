@@ -0,0 +1,211 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/fs/ifaceS3"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The queries of a time range, from and to are unix timestamps:
+//
+//	KEYS project from to [pattern]
+//	MGETTIME project key from to
+//
+// KEYS returns the keys stored locally, in Path and FallbackPath, in the
+// minutes of the range that match the pattern, as in filepath.Match. It's
+// rejected with the s3 storage, the keys aren't listed from S3.
+// MGETTIME returns the versions of the key in the range as pairs of the
+// timestamp of the minute and the value, from the local files and the tar
+// files in S3. The minutes not found locally are read from S3 in up to
+// maxS3Hours different hours, the query fails if it needs more.
+
+const (
+	maxQueryRange = 7 * 24 * time.Hour
+	maxS3Hours    = 24
+)
+
+var (
+	errKeys     = errors.New("ERR - syntax: KEYS project from to [pattern]")
+	errMGetTime = errors.New("ERR - syntax: MGETTIME project key from to")
+	errRange    = errors.New("ERR - Invalid time range")
+	errS3Range  = fmt.Errorf("ERR - The range needs more than %d hours from S3", maxS3Hours)
+	errKeysS3   = errors.New("ERR - KEYS is not available with the s3 storage")
+	respBadKeys = redis.NewResp(errKeys)
+	respBadMGet = redis.NewResp(errMGetTime)
+)
+
+// timeRange returns the first and last minutes of the range in the items
+func timeRange(from, to *redis.Resp) (time.Time, time.Time, error) {
+	f, err := from.Int64()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	t, err := to.Int64()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Unix(f, 0).UTC().Truncate(time.Minute)
+	end := time.Unix(t, 0).UTC().Truncate(time.Minute)
+	if end.Before(start) || end.Sub(start) > maxQueryRange {
+		return time.Time{}, time.Time{}, errRange
+	}
+	return start, end, nil
+}
+
+func (srv *Server) keys(netCon net.Conn, items []*redis.Resp) error {
+	if _, ok := srv.getStorage().(*localStorage); !ok {
+		return errKeysS3
+	}
+	project, err := items[1].Str()
+	if err != nil {
+		return err
+	}
+	if err := checkName(project); err != nil {
+		return err
+	}
+	start, end, err := timeRange(items[2], items[3])
+	if err != nil {
+		return err
+	}
+	pattern := "*"
+	if len(items) > 4 {
+		if pattern, err = items[4].Str(); err != nil {
+			return err
+		}
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	roots := []string{srv.config.Path}
+	if srv.config.FallbackPath != "" {
+		roots = append(roots, srv.config.FallbackPath)
+	}
+
+	found := make(map[string]bool)
+	for _, root := range roots {
+		for hour := start.Truncate(time.Hour); !hour.After(end); hour = hour.Add(time.Hour) {
+			hourDir := filepath.Join(root, project, hour.Format("2006/01/02/15"))
+			if _, err := os.Stat(hourDir); err != nil {
+				continue
+			}
+			for t := hour; t.Before(hour.Add(time.Hour)) && !t.After(end); t = t.Add(time.Minute) {
+				if t.Before(start) {
+					continue
+				}
+				addKeys(found, filepath.Join(hourDir, t.Format("04")), pattern)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	redis.NewResp(keys).WriteTo(netCon)
+	return nil
+}
+
+// addKeys adds the keys of the files of the minute directory, and of its
+// shard directories, that match the pattern
+func addKeys(found map[string]bool, dir, pattern string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			addKeys(found, filepath.Join(dir, fi.Name()), pattern)
+			continue
+		}
+		k := strings.TrimSuffix(fi.Name(), "."+extGz)
+		k = strings.TrimSuffix(k, "."+extPlain)
+		if ok, _ := filepath.Match(pattern, k); ok {
+			found[k] = true
+		}
+	}
+}
+
+func (srv *Server) mgettime(netCon net.Conn, items []*redis.Resp) error {
+	project, err := items[1].Str()
+	if err != nil {
+		return err
+	}
+	if err := checkName(project); err != nil {
+		return err
+	}
+	k, err := items[2].Str()
+	if err != nil {
+		return err
+	}
+	if err := checkName(k); err != nil {
+		return err
+	}
+	start, end, err := timeRange(items[3], items[4])
+	if err != nil {
+		return err
+	}
+
+	versions := []interface{}{}
+	s3Hours := 0
+	for hour := start.Truncate(time.Hour); !hour.After(end); hour = hour.Add(time.Hour) {
+		found := make(map[int][]byte)
+		var missing []int
+		var hourpath string
+
+		for t := hour; t.Before(hour.Add(time.Hour)) && !t.After(end); t = t.Add(time.Minute) {
+			if t.Before(start) {
+				continue
+			}
+			msg := getMsg(srv)
+			msg.project = project
+			msg.k = k
+			msg.t = t
+			msg.getShard()
+			hourpath = msg.hourpath()
+			if b, err := msg.bytesStored(); err == nil {
+				found[t.Minute()] = b
+			} else {
+				missing = append(missing, t.Minute())
+			}
+			putMsg(msg)
+		}
+
+		if len(missing) > 0 && srv.s3sess != nil && srv.config.S3Bucket != "" {
+			// Every hour is a listing and its downloads in S3
+			if s3Hours++; s3Hours > maxS3Hours {
+				return errS3Range
+			}
+			r := ifaceS3.NewReaderUncompress(srv.s3sess, srv.config.S3Bucket)
+			archived, err := r.GetMinutes(k, hourpath, missing)
+			if err != nil {
+				return err
+			}
+			for m, b := range archived {
+				found[m] = b
+			}
+		}
+
+		minutes := make([]int, 0, len(found))
+		for m := range found {
+			minutes = append(minutes, m)
+		}
+		sort.Ints(minutes)
+		for _, m := range minutes {
+			versions = append(versions, hour.Add(time.Duration(m)*time.Minute).Unix(), found[m])
+		}
+	}
+
+	redis.NewResp(versions).WriteTo(netCon)
+	return nil
+}
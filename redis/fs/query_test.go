@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestQueries(t *testing.T) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(s3)
+	defer ts.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	dir, err := ioutil.TempDir("", "fs-queries-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:   "fs",
+		Mode:       "sync",
+		Listen:     "tcp://127.0.0.1:0",
+		Path:       dir,
+		Shards:     2,
+		Writers:    1,
+		Region:     "us-east-1",
+		S3Bucket:   "bucket",
+		S3Endpoint: ts.URL,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// 2018-02-16 02:17:30 and 02:18:30 UTC
+	const ts1, ts2 = 1518747450, 1518747510
+	for _, s := range []struct {
+		project, k string
+		ts         int64
+		v          string
+	}{
+		{"main", "a", ts1, "a1"},
+		{"main", "b", ts1, "b1"},
+		{"main", "a", ts2, "a2"},
+		{"other", "c", ts1, "c1"},
+	} {
+		redis.NewResp([]interface{}{"SET", s.project, s.k, s.ts, s.v}).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET %s: %s", s.k, r.Err)
+		}
+	}
+	waitFiles(t, filepath.Join(dir, "main"), 3)
+
+	keys := func(args ...interface{}) []string {
+		redis.NewResp(append([]interface{}{"KEYS", "main"}, args...)).WriteTo(conn)
+		l, err := reader.Read().List()
+		if err != nil {
+			t.Fatalf("KEYS %v: %s", args, err)
+		}
+		return l
+	}
+	if l := keys(ts1-3600, ts2); !reflect.DeepEqual(l, []string{"a", "b"}) {
+		t.Errorf("expected a and b, got %v", l)
+	}
+	if l := keys(ts1, ts2, "b*"); !reflect.DeepEqual(l, []string{"b"}) {
+		t.Errorf("expected b, got %v", l)
+	}
+	if l := keys(ts2, ts2); !reflect.DeepEqual(l, []string{"a"}) {
+		t.Errorf("expected a, got %v", l)
+	}
+	redis.NewResp([]interface{}{"KEYS", "main", ts2, ts1}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil || r.Err.Error() != errRange.Error() {
+		t.Errorf("expected the range error, got %v", r)
+	}
+
+	// The first minute is only in S3
+	a := &archiver{srv: srv}
+	for _, d := range minuteDirs(dir) {
+		if d.project == "main" && d.t.Unix() == ts1-30 {
+			if err := a.archive(&srv.config, srv.s3sess, d.project, d.t, d.path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	redis.NewResp([]interface{}{"MGETTIME", "main", "a", ts1 - 3600, ts2}).WriteTo(conn)
+	versions, err := reader.Read().Array()
+	if err != nil || len(versions) != 4 {
+		t.Fatalf("MGETTIME: expected 2 versions, got %v %v", versions, err)
+	}
+	for i, expected := range []struct {
+		ts int64
+		v  string
+	}{
+		{ts1 - 30, "a1"},
+		{ts2 - 30, "a2"},
+	} {
+		ts, _ := versions[2*i].Int64()
+		v, _ := versions[2*i+1].Str()
+		if ts != expected.ts || v != expected.v {
+			t.Errorf("expected %d %s, got %d %s", expected.ts, expected.v, ts, v)
+		}
+	}
+
+	// The hours without local files are read from S3, up to maxS3Hours
+	redis.NewResp([]interface{}{"MGETTIME", "main", "a", ts1 - (maxS3Hours+1)*3600, ts2}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil || r.Err.Error() != errS3Range.Error() {
+		t.Errorf("expected the S3 range error, got %v", r)
+	}
+
+	// The names can't be paths out of the storage
+	for _, args := range [][]interface{}{
+		{"KEYS", "../..", ts1, ts2},
+		{"KEYS", "", ts1, ts2},
+		{"MGETTIME", "main", "../a", ts1, ts2},
+		{"MGETTIME", `..\main`, "a", ts1, ts2},
+		{"GET", "main", "../../a", ts1},
+		{"SET", "/main", "a", ts1, "x"},
+	} {
+		redis.NewResp(args).WriteTo(conn)
+		if r := reader.Read(); r.Err == nil || r.Err.Error() != errName.Error() {
+			t.Errorf("%v: expected the name error, got %v", args, r)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// The storage keeps the messages written by the writers and read by GET,
+// it's selected with Storage:
+//
+//	local: the files in Path, project/YYYY/MM/DD/HH/MM/shard/key.log
+//	s3:    an object in S3Bucket for each message with the same name
+//
+// The messages that fail WriteRetries times are written in FallbackPath,
+// if it's defined, with the same names than in Path.
+
+const (
+	defaultWriteRetries = 3
+)
+
+var (
+	errNoFallback = errors.New("no fallback path")
+
+	fallbackWrites = lib.NewCounterVec("fs_fallback_total", "Messages written in the fallback path after failing in the storage", "relayer")
+	droppedWrites  = lib.NewCounterVec("fs_dropped_total", "Messages discarded after failing in the storage without a fallback path", "relayer")
+)
+
+type storage interface {
+	// write moves the temporary file of the message to the storage
+	write(m *Msg) error
+	// read returns the content of the message, a *os.PathError if it
+	// doesn't exist
+	read(m *Msg) ([]byte, error)
+}
+
+// storages are the storage and the fallback of the configuration, they
+// are replaced together by Reload while the writers use them
+type storages struct {
+	storage  storage
+	fallback storage // nil if there is no FallbackPath
+}
+
+func (srv *Server) getStorage() storage {
+	return srv.storages.Load().(*storages).storage
+}
+
+func (srv *Server) getFallback() storage {
+	return srv.storages.Load().(*storages).fallback
+}
+
+// newStorage returns the storage selected in the configuration
+func newStorage(srv *Server) storage {
+	switch srv.config.Storage {
+	case "s3":
+		return &s3Storage{srv: srv}
+	case "", "local":
+	default:
+		log.Printf("FS ERROR: invalid storage %s at port %s, using local", srv.config.Storage, srv.config.Listen)
+	}
+	return &localStorage{srv: srv, root: srv.config.Path, quota: true}
+}
+
+// toFallback writes the message in the fallback path
+func (srv *Server) toFallback(m *Msg) error {
+	fallback := srv.getFallback()
+	if fallback == nil {
+		return errNoFallback
+	}
+	if err := fallback.write(m); err != nil {
+		log.Printf("FS ERROR fallback: %s", err)
+		return err
+	}
+	atomic.AddInt64(&srv.fallbacks, 1)
+	fallbackWrites.With(srv.config.Listen).Inc()
+	log.Printf("FS ERROR: %s/%s written in the fallback path %s", m.project, m.k, srv.config.FallbackPath)
+	return nil
+}
+
+// drop discards the message that failed WriteRetries times in the storage
+// when there is no fallback path
+func (srv *Server) drop(m *Msg) {
+	if m.tmp != "" {
+		if err := os.Remove(m.tmp); err != nil {
+			log.Printf("FS ERROR: removing the temporary file: %s", err)
+		}
+	}
+	atomic.AddInt64(&srv.dropped, 1)
+	droppedWrites.With(srv.config.Listen).Inc()
+	log.Printf("FS ERROR: %s/%s dropped after %d failed writes", m.project, m.k, m.retries)
+}
+
+// localStorage keeps the files in the directory root
+type localStorage struct {
+	srv   *Server
+	root  string
+	quota bool // Count the bytes for the quota of the projects
+}
+
+func (s *localStorage) write(m *Msg) error {
+	dirName := fmt.Sprintf("%s/%s", s.root, m.path())
+	if err := dirCache.makeAll(dirName); err != nil {
+		log.Printf("File ERROR mkdir: %s", err)
+		return err
+	}
+
+	var fileName string
+	if !s.srv.config.Compress || !m.gz {
+		// Use the file name without .gz extension if the compression is
+		// not active or if the size is smaller than 512 bytes (minSizeForCompress)
+		fileName = dirName + "/" + m.filenamePlain()
+	} else {
+		// Use the extension .gz in the file name if is able to use the compression
+		fileName = dirName + "/" + m.filenameGz()
+	}
+
+	fi, err := os.Stat(m.tmp)
+	if err != nil {
+		log.Printf("File ERROR tmp: %s", err)
+		return err
+	}
+
+	// The rename replaces the previous version of the file atomically, the
+	// readers never see a partial file
+	size := fi.Size()
+	if old, err := os.Stat(fileName); err == nil {
+		size -= old.Size()
+	}
+	if err := rename(m.tmp, fileName); err != nil {
+		log.Printf("File ERROR rename: %s", err)
+		return err
+	}
+	if s.quota {
+		s.srv.janitor.add(m.project, size)
+	}
+
+	// The file is already in place, the message must not be written again
+	if err := s.srv.syncDir(dirName); err != nil {
+		atomic.AddInt64(&s.srv.stats.Errors, 1)
+		log.Printf("File ERROR sync dir: %s", err)
+	}
+
+	return nil
+}
+
+// rename moves the file, with a copy if the destination is in another
+// filesystem, e.g. the fallback path
+func rename(from, to string) error {
+	err := os.Rename(from, to)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Copy to a temporary file in the destination to rename it atomically
+	dst, err := ioutil.TempFile(filepath.Dir(to), tmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Chmod(fileMode); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(dst.Name(), to); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+func (s *localStorage) read(m *Msg) (b []byte, err error) {
+	// The shards are disabled just to check this storage
+	defer func(disabled bool) {
+		m.disableShards = disabled
+	}(m.disableShards)
+
+	for {
+		dirName := fmt.Sprintf("%s/%s", s.root, m.path())
+		if s.srv.config.Compress {
+			lib.Debugf("FS Read local file: %s/%s - %s", dirName, m.filenameGz(), m.t.UTC())
+			b, err = m.bytesFile(fmt.Sprintf("%s/%s", dirName, m.filenameGz()), true)
+			if err == nil {
+				return
+			}
+			// If the file is empty, that means the file exists so we return here
+			if err == io.EOF {
+				return
+			}
+		}
+
+		lib.Debugf("FS Read local file: %s/%s - %s", dirName, m.filenamePlain(), m.t.UTC())
+		b, err = m.bytesFile(fmt.Sprintf("%s/%s", dirName, m.filenamePlain()), false)
+		if err == nil {
+			return
+		}
+
+		// check if the file exists disabling the shards just for this message
+		if s.srv.shards == 0 || m.disableShards {
+			return
+		}
+		m.disableShards = true
+	}
+}
+
+// s3Storage puts an object in S3Bucket for each message
+type s3Storage struct {
+	srv *Server
+}
+
+func (s *s3Storage) write(m *Msg) error {
+	name := m.filenamePlain()
+	if s.srv.config.Compress && m.gz {
+		name = m.filenameGz()
+	}
+	key := m.path() + "/" + name
+
+	f, err := os.Open(m.tmp)
+	if err != nil {
+		log.Printf("File ERROR tmp: %s", err)
+		return err
+	}
+	defer f.Close()
+
+	_, err = s3.New(s.srv.s3sess).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.srv.config.S3Bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	if err != nil {
+		log.Printf("FS ERROR S3 put %s: %s", key, err)
+		return err
+	}
+
+	if err := os.Remove(m.tmp); err != nil {
+		log.Printf("File ERROR remove: %s", err)
+	}
+	return nil
+}
+
+func (s *s3Storage) read(m *Msg) ([]byte, error) {
+	defer func(disabled bool) {
+		m.disableShards = disabled
+	}(m.disableShards)
+
+	for {
+		if s.srv.config.Compress {
+			if b, err := s.get(m.path()+"/"+m.filenameGz(), true); err == nil || !os.IsNotExist(err) {
+				return b, err
+			}
+		}
+		b, err := s.get(m.path()+"/"+m.filenamePlain(), false)
+		if err == nil || !os.IsNotExist(err) {
+			return b, err
+		}
+
+		if s.srv.shards == 0 || m.disableShards {
+			return nil, err
+		}
+		m.disableShards = true
+	}
+}
+
+func (s *s3Storage) get(key string, gz bool) ([]byte, error) {
+	lib.Debugf("FS Read S3 object: %s", key)
+	out, err := s3.New(s.srv.s3sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.srv.config.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == 404 {
+			return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	b, err := ioutil.ReadAll(out.Body)
+	if err != nil || !gz {
+		return b, err
+	}
+
+	zr, err := lib.GetGzipReader(bytes.NewReader(b))
+	defer lib.PutGzipReader(zr)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return ioutil.ReadAll(zr)
+}
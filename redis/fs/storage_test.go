@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestS3Storage(t *testing.T) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(s3)
+	defer ts.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	dir, err := ioutil.TempDir("", "fs-storage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:   "fs",
+		Mode:       "sync",
+		Listen:     "tcp://127.0.0.1:0",
+		Path:       dir,
+		Shards:     1,
+		Writers:    1,
+		Storage:    "s3",
+		Region:     "us-east-1",
+		S3Bucket:   "bucket",
+		S3Endpoint: ts.URL,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// 2018-02-16 02:17:30 UTC
+	const ts1 = "1518747450"
+	redis.NewResp([]interface{}{"SET", "main", "k", ts1, "value"}).WriteTo(conn)
+	if r := reader.Read(); r.Err != nil {
+		t.Fatalf("SET: %s", r.Err)
+	}
+
+	const object = "main/2018/02/16/02/17/00/k.log"
+	for i := 0; ; i++ {
+		s3.Lock()
+		b := s3.objects[object]
+		s3.Unlock()
+		if string(b) == "value" {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected %s, the objects are %v", object, s3.objects)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	redis.NewResp([]interface{}{"GET", "main", "k", ts1}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "value" {
+		t.Errorf("GET: expected value, got %q", s)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, tmpDir)); len(files) != 0 {
+		t.Errorf("temporary files weren't deleted: %d", len(files))
+	}
+
+	redis.NewResp([]interface{}{"KEYS", "main", ts1, ts1}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil || r.Err.Error() != errKeysS3.Error() {
+		t.Errorf("expected KEYS to be rejected, got %v", r)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-fallback-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "path")
+	fallback := filepath.Join(dir, "fallback")
+	// The files of the project can't be written in the path
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "main"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:     "fs",
+		Mode:         "sync",
+		Listen:       "tcp://127.0.0.1:0",
+		Path:         path,
+		Shards:       1,
+		Writers:      1,
+		FallbackPath: fallback,
+		WriteRetries: 1,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// 2018-02-16 02:17:30 UTC
+	const ts1 = "1518747450"
+	redis.NewResp([]interface{}{"SET", "main", "k", ts1, "value"}).WriteTo(conn)
+	if r := reader.Read(); r.Err != nil {
+		t.Fatalf("SET: %s", r.Err)
+	}
+	waitContent(t, filepath.Join(fallback, "main", "2018", "02", "16", "02", "17", "00", "k.log"), "value")
+
+	redis.NewResp([]interface{}{"GET", "main", "k", ts1}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "value" {
+		t.Errorf("GET: expected value, got %q", s)
+	}
+	redis.NewResp([]interface{}{"KEYS", "main", ts1, ts1}).WriteTo(conn)
+	if l, _ := reader.Read().List(); !reflect.DeepEqual(l, []string{"k"}) {
+		t.Errorf("KEYS: expected k, got %v", l)
+	}
+	if s := srv.Stats(); s.Gauges["fallbackWrites"] != 1 {
+		t.Errorf("unexpected stats %v", s.Gauges)
+	}
+}
+
+func TestDropWithoutFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-drop-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The files of the project can't be written in the path
+	if err := ioutil.WriteFile(filepath.Join(dir, "main"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:     "fs",
+		Mode:         "sync",
+		Listen:       "tcp://127.0.0.1:0",
+		Path:         dir,
+		Shards:       1,
+		Writers:      1,
+		WriteRetries: 1,
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 2018-02-16 02:17:30 UTC
+	redis.NewResp([]interface{}{"SET", "main", "k", "1518747450", "value"}).WriteTo(conn)
+	if r := redis.NewRespReader(conn).Read(); r.Err != nil {
+		t.Fatalf("SET: %s", r.Err)
+	}
+	for i := 0; srv.Stats().Gauges["droppedWrites"] != 1; i++ {
+		if i > 100 {
+			t.Fatalf("the message wasn't dropped, stats %v", srv.Stats().Gauges)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files, _ := ioutil.ReadDir(srv.tmpPath()); len(files) != 0 {
+		t.Errorf("the temporary file of the message wasn't deleted: %d", len(files))
+	}
+}
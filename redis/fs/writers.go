@@ -1,18 +1,27 @@
 package fs
 
 import (
-	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync/atomic"
 	"time"
 )
 
 const (
-	timeOutWrite       = 5 * time.Second
 	retryWriter        = 2 * time.Second
 	minSizeForCompress = 512
+	tmpDir             = ".tmp" // Directory of the temporary files inside the path
+	tmpPrefix          = "smart-relayer-fs-"
+	fileMode           = 0644 // The temporary files are created with 0600
+)
+
+// The durability levels of the files
+const (
+	durabilityNone = iota
+	durabilityFile // fsync the file before renaming it
+	durabilityDir  // fsync also the directory after the rename
 )
 
 var (
@@ -54,7 +63,18 @@ func (w *writer) listen() {
 			if err := w.writeTo(m); err == nil {
 				putMsg(m)
 			} else {
+				atomic.AddInt64(&w.srv.stats.Errors, 1)
 				log.Printf("FS ERROR Writer: %s", err)
+				m.retries++
+				if m.retries >= w.srv.config.WriteRetries {
+					if err := w.srv.toFallback(m); err == nil || err == errNoFallback {
+						if err == errNoFallback {
+							w.srv.drop(m)
+						}
+						putMsg(m)
+						continue
+					}
+				}
 				// send message back to the channel
 				time.Sleep(retryWriter)
 				w.C <- m
@@ -66,50 +86,46 @@ func (w *writer) listen() {
 }
 
 func (w *writer) writeTo(m *Msg) error {
-	dirName := m.fullpath()
-	if err := dirCache.makeAll(dirName); err != nil {
-		log.Printf("File ERROR mkdir: %s", err)
-		return err
-	}
+	return w.srv.getStorage().write(m)
+}
 
-	var fileName string
-	if !w.srv.config.Compress || !m.gz {
-		// Use the file name without .gz extension if the compression is
-		// not active or if the size is smaller than 512 bytes (minSizeForCompress)
-		fileName = dirName + "/" + m.filenamePlain()
-	} else {
-		// Use the extension .gz in the file name if is able to use the compression
-		fileName = dirName + "/" + m.filenameGz()
-	}
+// tmpPath returns the directory of the temporary files, it's inside the
+// path to be able to rename them to the destination
+func (srv *Server) tmpPath() string {
+	return filepath.Join(srv.config.Path, tmpDir)
+}
 
-	tmpFile, err := os.Open(m.tmp)
-	if err != nil {
-		log.Printf("File ERROR tmp: %s", err)
-		return err
+func (srv *Server) syncFile(f *os.File) error {
+	if srv.durability < durabilityFile {
+		return nil
 	}
-	defer tmpFile.Close()
+	return f.Sync()
+}
 
-	newFile, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0644)
+func (srv *Server) syncDir(dir string) error {
+	if srv.durability < durabilityDir {
+		return nil
+	}
+	d, err := os.Open(dir)
 	if err != nil {
-		log.Printf("File ERROR dst: %s", err)
 		return err
 	}
-	defer newFile.Close()
-
-	// After the time defined in timeOutWrite the write operation will return an error
-	newFile.SetWriteDeadline(time.Now().Add(timeOutWrite))
+	defer d.Close()
+	return d.Sync()
+}
 
-	if _, err := io.Copy(newFile, tmpFile); err != nil {
-		log.Printf("File ERROR copy: %s", err)
-		return err
+// recoverTmp deletes the temporary files of a previous execution that were
+// never renamed to their destination
+func (srv *Server) recoverTmp() {
+	files, _ := filepath.Glob(filepath.Join(srv.tmpPath(), tmpPrefix+"*"))
+	for _, name := range files {
+		if err := os.Remove(name); err != nil {
+			log.Printf("FS ERROR: removing orphaned file: %s", err)
+		}
 	}
-
-	if err := os.Remove(tmpFile.Name()); err != nil {
-		log.Printf("File ERROR remove: %s", err)
-		return err
+	if len(files) > 0 {
+		log.Printf("FS %s: found %d orphaned temporary files in %s, messages lost", srv.config.Listen, len(files), srv.tmpPath())
 	}
-
-	return nil
 }
 
 func (w *writer) exit() {
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+func TestWriteRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-writers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An orphaned file of a previous execution
+	if err := os.MkdirAll(filepath.Join(dir, tmpDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, tmpDir, tmpPrefix+"123")
+	if err := ioutil.WriteFile(orphan, []byte("lost"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := New(lib.RelayerConfig{
+		Protocol:   "fs",
+		Mode:       "sync",
+		Listen:     "tcp://127.0.0.1:0",
+		Path:       dir,
+		Shards:     1,
+		Writers:    1,
+		Durability: "dir",
+	}, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Exit()
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("the orphaned file wasn't deleted: %v", err)
+	}
+	if srv.durability != durabilityDir {
+		t.Errorf("expected the durability dir, got %d", srv.durability)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	// 2018-02-16 02:17:30 UTC, a shorter value replaces the longer one
+	const ts1 = "1518747450"
+	minute := filepath.Join(dir, "main", "2018", "02", "16", "02", "17")
+	for _, v := range []string{"a long value", "short"} {
+		redis.NewResp([]interface{}{"SET", "main", "k", ts1, v}).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET %s: %s", v, r.Err)
+		}
+		waitContent(t, filepath.Join(minute, "00", "k.log"), v)
+	}
+	if fi, err := os.Stat(filepath.Join(minute, "00", "k.log")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != fileMode {
+		t.Errorf("expected the mode %o, got %o", fileMode, fi.Mode().Perm())
+	}
+
+	redis.NewResp([]interface{}{"GET", "main", "k", ts1}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "short" {
+		t.Errorf("expected short, got %q", s)
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, tmpDir)); len(files) != 0 {
+		t.Errorf("temporary files weren't renamed: %d", len(files))
+	}
+}
+
+// waitContent waits until the writers stored the file with the value
+func waitContent(t *testing.T, name, value string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		b, err := ioutil.ReadFile(name)
+		if err == nil && string(b) == value {
+			return
+		}
+		if i > 100 {
+			t.Fatalf("expected %q in %s, found %q %v", value, name, b, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gabrielperezs/streamspooler/kinesis"
@@ -23,6 +24,7 @@ type Server struct {
 	ks             *kinesisPool.Server
 	lastConnection time.Time
 	lastError      time.Time
+	stats          lib.Counters
 }
 
 const (
@@ -44,6 +46,8 @@ var (
 	respBadCommand = redis.NewResp(errBadCmd)
 	respKO         = redis.NewResp(errKO)
 	commands       map[string]*redis.Resp
+
+	dropped = lib.NewCounterVec("kinesis_dropped_total", "Records discarded because the channel to Kinesis was full", "relayer")
 )
 
 func init() {
@@ -142,6 +146,17 @@ func (srv *Server) Start() (e error) {
 	return
 }
 
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	s.Queued = int64(len(srv.ks.C))
+	s.Gauge("capacity", int64(cap(srv.ks.C)))
+	return s
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
@@ -171,7 +186,10 @@ func (srv *Server) sendRecord(r *lib.InterRecord) {
 
 	select {
 	case srv.ks.C <- r.Bytes():
+		atomic.AddInt64(&srv.stats.Async, 1)
 	default:
+		atomic.AddInt64(&srv.stats.Overloaded, 1)
+		dropped.With(srv.config.Listen).Inc()
 		log.Printf("Kinesis: channel is full. Queued messages %d", len(srv.ks.C))
 	}
 }
@@ -187,7 +205,10 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 
 	defer netCon.Close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(netCon)
+	session := lib.NewSession(&srv.config)
 
 	// Active transaction
 	multi := false
@@ -219,17 +240,24 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			continue
 		}
 
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			resp.WriteTo(netCon)
+			continue
+		}
+
 		fastResponse, ok := commands[req.Command]
 		if !ok {
 			respBadCommand.WriteTo(netCon)
 			continue
 		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
 
 		fastResponse.WriteTo(netCon)
 
 		switch req.Command {
 		case "RAWSET":
 			if multi || len(req.Items) > 2 {
+				atomic.AddInt64(&srv.stats.Errors, 1)
 				respKO.WriteTo(netCon)
 				continue
 			}
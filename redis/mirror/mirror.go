@@ -0,0 +1,312 @@
+// Package mirror sends a copy of the commands of a relayer to a secondary
+// Redis server, e.g. to test a new target with the production writes. The
+// commands are sent in background, in order, by its own connection: the
+// replies of the mirror are discarded and its errors or delays never affect
+// the clients, if the mirror can't keep up the commands are dropped.
+package mirror
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+const (
+	queueSize      = 1024
+	maxBatch       = 64 // Commands written together to the mirror
+	connectTimeout = 5 * time.Second
+	retryPeriod    = 1 * time.Second
+)
+
+var (
+	mirrorCommands = lib.NewCounterVec("mirror_commands_total", "Commands sent to the mirror", "relayer")
+	mirrorErrors   = lib.NewCounterVec("mirror_errors_total", "Commands that failed in the mirror", "relayer")
+	mirrorDropped  = lib.NewCounterVec("mirror_dropped_total", "Commands not sent to the mirror because its queue was full", "relayer")
+	mirrorLatency  = lib.NewHistogramVec("mirror_seconds", "Time to get the reply of the mirror", nil, "relayer")
+
+	// Commands of the connection that are not mirrored
+	skipCommands = map[string]bool{
+		"SELECT":  true,
+		"AUTH":    true,
+		"HELLO":   true,
+		"QUIT":    true,
+		"RELAYER": true,
+		"WATCH":   true,
+		"UNWATCH": true,
+	}
+
+	// The transactions are mirrored as a whole with a Tx
+	txCommands = map[string]bool{
+		"MULTI":   true,
+		"EXEC":    true,
+		"DISCARD": true,
+	}
+)
+
+type command struct {
+	db      int
+	data    []byte
+	replies int // Replies of the mirror to the data
+}
+
+// Tx keeps the transaction of a local connection until its EXEC, the
+// commands of a transaction are sent together to the mirror
+type Tx struct {
+	open    bool
+	db      int
+	data    bytes.Buffer
+	replies int
+}
+
+// Mirror is the connection to the secondary server. The commands are sent
+// in order by only one connection, so the mirror receives the writes of a
+// key in the same order than the upstream
+type Mirror struct {
+	sync.RWMutex
+	config   lib.RelayerConfig
+	all      bool
+	ch       chan command
+	closed   bool
+	commands int64
+	errors   int64
+	dropped  int64
+}
+
+// New returns the mirror of the configuration, nil if MirrorURL is empty.
+// The connections use the credentials and TLS options of the relayer
+func New(c *lib.RelayerConfig) *Mirror {
+	if c.MirrorURL == "" {
+		return nil
+	}
+
+	m := &Mirror{
+		config: *c,
+		all:    c.MirrorAll,
+		ch:     make(chan command, queueSize),
+	}
+	m.config.URL = c.MirrorURL
+	go m.worker()
+	log.Printf("Mirror of %s to %s", c.Listen, c.MirrorURL)
+	return m
+}
+
+// Changed returns true if the mirror must be created again for the new
+// configuration
+func (m *Mirror) Changed(c *lib.RelayerConfig) bool {
+	if m == nil {
+		return c.MirrorURL != ""
+	}
+	return m.config.URL != c.MirrorURL || m.all != c.MirrorAll || m.config.ConnectionChanged(withURL(c, c.MirrorURL))
+}
+
+func withURL(c *lib.RelayerConfig, url string) *lib.RelayerConfig {
+	cc := *c
+	cc.URL = url
+	return &cc
+}
+
+// Send queues a copy of the command if it must be mirrored: the writes or
+// all the commands with MirrorAll, but never the blocking ones. It doesn't
+// block, the command is dropped if the queue is full. tx is the transaction
+// of the local connection, the transactions are not mirrored if it's nil
+func (m *Mirror) Send(tx *Tx, cmd string, db int, resp *redis.Resp) {
+	if m == nil || skipCommands[cmd] {
+		return
+	}
+
+	if txCommands[cmd] {
+		if tx == nil {
+			return
+		}
+		switch cmd {
+		case "MULTI":
+			tx.open, tx.db, tx.replies = true, db, 1
+			tx.data.Reset()
+			resp.WriteTo(&tx.data)
+		case "DISCARD":
+			tx.open = false
+		case "EXEC":
+			if !tx.open {
+				return
+			}
+			tx.open = false
+			resp.WriteTo(&tx.data)
+			m.queue(command{db: tx.db, data: append([]byte(nil), tx.data.Bytes()...), replies: tx.replies + 1})
+		}
+		return
+	}
+
+	c := rediscmd.Get(cmd)
+	if c.Has(rediscmd.Blocking) || (!m.all && c != nil && !c.Has(rediscmd.Write)) {
+		return
+	}
+
+	if tx != nil && tx.open {
+		if _, err := resp.WriteTo(&tx.data); err == nil {
+			tx.replies++
+		}
+		return
+	}
+
+	var b bytes.Buffer
+	if _, err := resp.WriteTo(&b); err != nil {
+		return
+	}
+	m.queue(command{db: db, data: b.Bytes(), replies: 1})
+}
+
+func (m *Mirror) queue(cmd command) {
+	// The lock avoids sending to the channel once it's closed
+	m.RLock()
+	defer m.RUnlock()
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.ch <- cmd:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+		mirrorDropped.With(m.config.Listen).Inc()
+	}
+}
+
+// Close stops the worker once the queued commands are sent, the next
+// commands are ignored
+func (m *Mirror) Close() {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.ch)
+}
+
+// AddStats adds the counters of the mirror to the stats of the relayer
+func (m *Mirror) AddStats(s *lib.Stats) {
+	if m == nil {
+		return
+	}
+	s.Gauge("mirrorCommands", atomic.LoadInt64(&m.commands))
+	s.Gauge("mirrorErrors", atomic.LoadInt64(&m.errors))
+	s.Gauge("mirrorDropped", atomic.LoadInt64(&m.dropped))
+}
+
+func (m *Mirror) worker() {
+	var conn net.Conn
+	var reader *redis.RespReader
+	var lastFailure time.Time
+	db := 0
+
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	defer disconnect()
+
+	timeout := m.config.ResponseTimeout()
+	batch := make([]command, 0, maxBatch)
+	var buf bytes.Buffer
+	for cmd := range m.ch {
+		// Take the commands already queued to write them together
+		batch = append(batch[:0], cmd)
+	queued:
+		for len(batch) < maxBatch {
+			select {
+			case cmd, ok := <-m.ch:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, cmd)
+			default:
+				break queued
+			}
+		}
+		atomic.AddInt64(&m.commands, int64(len(batch)))
+		mirrorCommands.With(m.config.Listen).Add(int64(len(batch)))
+
+		if conn == nil {
+			if time.Since(lastFailure) < retryPeriod {
+				m.failed(len(batch), nil)
+				continue
+			}
+			c, err := lib.DialRedis(&m.config, m.config.Scheme(), m.config.Host(), connectTimeout)
+			if err != nil {
+				log.Println("Mirror ERROR:", m.config.Host(), err)
+				lastFailure = time.Now()
+				m.failed(len(batch), nil)
+				continue
+			}
+			conn, reader, db = c, redis.NewRespReader(c), 0
+		}
+
+		// selects[i] is true if the command i of the batch is preceded by
+		// a SELECT because it's in another database
+		buf.Reset()
+		selects := make([]bool, len(batch))
+		for i, cmd := range batch {
+			if cmd.db != db {
+				redis.NewResp([]interface{}{"SELECT", strconv.Itoa(cmd.db)}).WriteTo(&buf)
+				selects[i] = true
+				db = cmd.db
+			}
+			buf.Write(cmd.data)
+		}
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		start := time.Now()
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			m.failed(len(batch), err)
+			disconnect()
+			continue
+		}
+		for i, cmd := range batch {
+			n := cmd.replies
+			if selects[i] {
+				n++
+			}
+			var err error
+			for ; n > 0; n-- {
+				r := reader.Read()
+				if r.IsType(redis.IOErr) {
+					m.failed(len(batch)-i, r.Err)
+					disconnect()
+					break
+				}
+				if r.Err != nil && err == nil {
+					err = r.Err
+				}
+			}
+			if conn == nil {
+				break
+			}
+			mirrorLatency.With(m.config.Listen).Observe(time.Since(start).Seconds())
+			if err != nil {
+				m.failed(1, err)
+			}
+		}
+	}
+}
+
+// failed counts n errors, the error is logged in debug mode if it's not nil
+func (m *Mirror) failed(n int, err error) {
+	atomic.AddInt64(&m.errors, int64(n))
+	mirrorErrors.With(m.config.Listen).Add(int64(n))
+	if err != nil {
+		lib.Debugf("Mirror ERROR: %s %s", m.config.Host(), err)
+	}
+}
@@ -61,6 +61,9 @@ type Cluster struct {
 	o Opts
 	mapping
 	pools            map[string]clusterPool
+	replicas         map[string][]string // Master address -> replica addresses
+	replicaPools     map[string]clusterPool
+	reads            uint32 // Counter to choose the replica of the reads
 	poolThrottles    map[string]<-chan time.Time
 	resetThrottle    *time.Ticker
 	callCh           chan func(*Cluster)
@@ -110,6 +113,13 @@ type Opts struct {
 	// each redis cluster instance. The common use-case is to do authentication
 	// for new connections. Defaults to using redis.DialTimeout if not set.
 	Dialer DialFunc
+
+	// Where ReadCmd sends the read-only commands. Default is ReadFromMaster
+	ReadFrom ReadFrom
+
+	// Called with the result of every check of the nodes while the cluster
+	// is faulty, e.g. to notify a circuit breaker. Optional
+	CheckFunc func(start time.Time, err error)
 }
 
 // New will perform the following steps to initialize:
@@ -160,6 +170,8 @@ func NewWithOpts(o Opts) (*Cluster, error) {
 		o:             o,
 		mapping:       mapping{},
 		pools:         map[string]clusterPool{},
+		replicas:      map[string][]string{},
+		replicaPools:  map[string]clusterPool{},
 		poolThrottles: map[string]<-chan time.Time{},
 		callCh:        make(chan func(*Cluster)),
 		stopCh:        make(chan struct{}),
@@ -230,6 +242,13 @@ func (c *Cluster) startWithRetry() {
 }
 
 func (c *Cluster) newPool(addr string, clearThrottle bool) (clusterPool, error) {
+	df := func(network, addr string) (*redis.Client, error) {
+		return c.o.Dialer(network, addr)
+	}
+	return c.newPoolWithDialer(addr, clearThrottle, df)
+}
+
+func (c *Cluster) newPoolWithDialer(addr string, clearThrottle bool, df pool.DialFunc) (clusterPool, error) {
 	if clearThrottle {
 		delete(c.poolThrottles, addr)
 	} else if throttle, ok := c.poolThrottles[addr]; ok {
@@ -241,11 +260,11 @@ func (c *Cluster) newPool(addr string, clearThrottle bool) (clusterPool, error)
 		}
 	}
 
-	df := func(network, addr string) (*redis.Client, error) {
-		return c.o.Dialer(network, addr)
-	}
 	p, err := pool.NewCustom("tcp", addr, c.o.PoolSize, df)
 	if err != nil {
+		if p != nil {
+			p.Empty() // Stop its ping goroutine
+		}
 		c.poolThrottles[addr] = time.After(c.o.PoolThrottle)
 		return clusterPool{}, err
 	}
@@ -371,6 +390,7 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 	defer p.Put(client)
 
 	pools := map[string]clusterPool{}
+	replicas := map[string][]string{}
 
 	elems, err := client.Cmd("CLUSTER", "SLOTS").Array()
 	if err != nil {
@@ -416,6 +436,9 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 		for i := start; i <= end; i++ {
 			c.mapping[i] = slotAddr
 		}
+		if c.o.ReadFrom != ReadFromMaster {
+			replicas[slotAddr] = replicaAddrs(slotElems[3:], replicas[slotAddr])
+		}
 		if slotPool, ok = c.pools[slotAddr]; ok {
 			pools[slotAddr] = slotPool
 		} else if _, ok = pools[slotAddr]; !ok {
@@ -441,6 +464,7 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 		return err
 	}
 	c.pools = pools
+	c.setReplicas(replicas)
 
 	if changed {
 		select {
@@ -484,14 +508,20 @@ func (c *Cluster) Cmd(cmd string, args ...interface{}) *redis.Resp {
 		return errorResp(ErrBadCmdNoKey)
 	}
 
-	if c.isFaulty() {
-		return errorResp(ErrClusterUnavailable)
-	}
-
 	key, err := redis.KeyFromArgs(args)
 	if err != nil {
 		return errorResp(err)
 	}
+	return c.CmdKey(key, cmd, args...)
+}
+
+// CmdKey is like Cmd but the node is chosen by the given key instead of the
+// first argument, for the commands whose first argument isn't a key, e.g.
+// EVAL
+func (c *Cluster) CmdKey(key, cmd string, args ...interface{}) *redis.Resp {
+	if c.isFaulty() {
+		return errorResp(ErrClusterUnavailable)
+	}
 
 	client, err := c.getConn(key, "")
 	if err != nil {
@@ -538,77 +568,81 @@ func (c *Cluster) isFaulty() bool {
 	return s > 0
 }
 
+// IsFaulty returns true if the cluster is not available, the faulty monitor
+// is checking the nodes and the commands are rejected with ErrClusterUnavailable
+func (c *Cluster) IsFaulty() bool {
+	return c.isFaulty()
+}
+
 func (c *Cluster) faultyMonitor() {
 	defer func() {
 		atomic.StoreInt32(&c.ioMonitorRunning, 0)
 	}()
 
-	failures := 0
-	checked := make(chan bool)
+	checked := make(chan error)
 	for {
+		start := time.Now()
 		c.callCh <- func(c *Cluster) {
-			defer func() {
-				checked <- true
-			}()
-
-			p := c.getRandomPoolInner()
-			if p.Pool == nil {
-				c.setFaulty(true)
-				return
-			}
-
-			if e := c.resetInnerUsingPool(p); e != nil {
-				c.setFaulty(true)
-				return
-			}
-
-			if len(c.pools) == 0 {
-				c.setFaulty(true)
-				return
-			}
+			checked <- c.checkNodes()
+		} // End of spinner func
 
-			// Check that all pools in the cluster are available
-			for _, p := range c.pools {
-				client, err := p.Get()
-				if err != nil {
-					c.setFaulty(true)
-					return
-				}
-				r := client.Cmd("CLUSTER", "INFO")
-				if r.Err != nil {
-					c.setFaulty(true)
-					return
-				}
-				p.Put(client)
-				// Check the node in the cluster and it's ok
-				if !strings.Contains(r.String(), "cluster_state:ok") {
-					c.setFaulty(true)
-					return
-				}
-			}
+		err := <-checked
+		if c.o.CheckFunc != nil {
+			c.o.CheckFunc(start, err)
+		}
+		if err == nil {
 			if c.isFaulty() {
 				c.setFaulty(false)
 				log.Printf("Cluster %s recovered", c.o.Addr)
 			}
-		} // End of spinner func
-
-		<-checked
-		if !c.isFaulty() {
 			return
 		}
 
-		failures++
-		if failures == 1 {
+		if !c.isFaulty() {
 			log.Printf("Cluster %s entered into faulty mode", c.o.Addr)
+			c.setFaulty(true)
 		}
-		if failures%2 == 0 {
-			log.Printf("Trying reset on cluster %s after %d failures", c.o.Addr, failures)
-			c.Reset()
-		}
+		log.Printf("Trying reset on cluster %s: %s", c.o.Addr, err)
+		c.Reset()
 		time.Sleep(faultyCheckPeriod)
 	}
 }
 
+// checkNodes returns an error if a node of the cluster isn't available, it
+// must be called from the spinner
+func (c *Cluster) checkNodes() error {
+	p := c.getRandomPoolInner()
+	if p.Pool == nil {
+		return ErrClusterUnavailable
+	}
+
+	if err := c.resetInnerUsingPool(p); err != nil {
+		return err
+	}
+
+	if len(c.pools) == 0 {
+		return ErrClusterUnavailable
+	}
+
+	// Check that all pools in the cluster are available
+	for _, p := range c.pools {
+		client, err := p.Get()
+		if err != nil {
+			return err
+		}
+		r := client.Cmd("CLUSTER", "INFO")
+		if r.Err != nil {
+			return r.Err
+		}
+		p.Put(client)
+		// Check the node in the cluster and it's ok
+		if !strings.Contains(r.String(), "cluster_state:ok") {
+			return fmt.Errorf("%s: cluster state is not ok", p.Addr)
+		}
+	}
+	return nil
+}
+
 func (c *Cluster) clientCmd(
 	client *redis.Client, cmd string, args []interface{}, ask bool,
 	tried map[string]bool, haveReset bool,
@@ -759,6 +793,10 @@ func (c *Cluster) Close() {
 				p.Empty()
 				delete(c.pools, addr)
 			}
+			for addr, p := range c.replicaPools {
+				p.Empty()
+				delete(c.replicaPools, addr)
+			}
 			if c.resetThrottle != nil {
 				c.resetThrottle.Stop()
 			}
@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// ReadFrom is the policy to choose the node of the read-only commands
+type ReadFrom int
+
+const (
+	// ReadFromMaster sends all the commands to the masters
+	ReadFromMaster ReadFrom = iota
+	// ReadFromPreferReplica sends the reads to the replicas of the slot in
+	// turn, to the master if it has no replicas
+	ReadFromPreferReplica
+	// ReadFromRoundRobin distributes the reads among the master and its replicas
+	ReadFromRoundRobin
+)
+
+// replicaAddrs adds the addresses of the replicas in the elements of a
+// slot range of CLUSTER SLOTS, the ones after the master
+func replicaAddrs(elems []*redis.Resp, addrs []string) []string {
+	for _, e := range elems {
+		l, err := e.Array()
+		if err != nil || len(l) < 2 {
+			continue
+		}
+		ip, err := l[0].Str()
+		if err != nil || ip == "" {
+			continue
+		}
+		port, err := l[1].Int()
+		if err != nil {
+			continue
+		}
+
+		addr := ip + ":" + strconv.Itoa(port)
+		found := false
+		for _, a := range addrs {
+			if a == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// setReplicas creates the pools of the new replicas and closes the ones
+// that are gone. A replica that can't be connected is ignored until the
+// next reset. Must be called from the spin goroutine
+func (c *Cluster) setReplicas(replicas map[string][]string) {
+	pools := map[string]clusterPool{}
+	available := map[string][]string{}
+	for master, addrs := range replicas {
+		for _, addr := range addrs {
+			p, ok := c.replicaPools[addr]
+			if !ok {
+				p, ok = pools[addr]
+			}
+			if !ok {
+				var err error
+				if p, err = c.newReplicaPool(addr); err != nil {
+					log.Printf("E: Error connecting to replica %s: %s", addr, err)
+					continue
+				}
+			}
+			pools[addr] = p
+			available[master] = append(available[master], addr)
+		}
+	}
+
+	for addr, p := range c.replicaPools {
+		if _, ok := pools[addr]; !ok {
+			p.Empty()
+		}
+	}
+	c.replicaPools = pools
+	c.replicas = available
+}
+
+// newReplicaPool creates a pool whose connections send READONLY after
+// connecting, so the replica accepts the reads of its slots
+func (c *Cluster) newReplicaPool(addr string) (clusterPool, error) {
+	df := func(network, addr string) (*redis.Client, error) {
+		client, err := c.o.Dialer(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.Cmd("READONLY").Err; err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+
+	return c.newPoolWithDialer(addr, true, df)
+}
+
+// getReplicaConn returns a connection to the replica that must execute
+// a read of the key, nil if the read must be sent to the master
+func (c *Cluster) getReplicaConn(key string) (*redis.Client, clusterPool) {
+	respCh := make(chan clusterPool, 1)
+	c.callCh <- func(c *Cluster) {
+		addrs := c.replicas[keyToAddr(key, &c.mapping)]
+		if len(addrs) == 0 {
+			respCh <- clusterPool{}
+			return
+		}
+
+		n := int(c.reads)
+		c.reads++
+		if c.o.ReadFrom == ReadFromRoundRobin {
+			// The master is the last one of the turn
+			n = n % (len(addrs) + 1)
+			if n == len(addrs) {
+				respCh <- clusterPool{}
+				return
+			}
+		}
+		respCh <- c.replicaPools[addrs[n%len(addrs)]]
+	}
+
+	p := <-respCh
+	if p.Pool == nil {
+		return nil, p
+	}
+	client, err := p.Get()
+	if err != nil {
+		return nil, p
+	}
+	return client, p
+}
+
+// ReadCmd is like Cmd for the read-only commands, they are sent to the
+// replicas of the slot of the key as defined in Opts.ReadFrom. The command
+// is sent to the master if the replica fails or answers with an error,
+// MOVED included
+func (c *Cluster) ReadCmd(cmd string, args ...interface{}) *redis.Resp {
+	if len(args) < 1 {
+		return c.Cmd(cmd, args...)
+	}
+	key, err := redis.KeyFromArgs(args)
+	if err != nil {
+		return c.Cmd(cmd, args...)
+	}
+	return c.ReadCmdKey(key, cmd, args...)
+}
+
+// ReadCmdKey is like ReadCmd with the key that chooses the node
+func (c *Cluster) ReadCmdKey(key, cmd string, args ...interface{}) *redis.Resp {
+	if c.o.ReadFrom == ReadFromMaster || c.isFaulty() {
+		return c.CmdKey(key, cmd, args...)
+	}
+
+	client, p := c.getReplicaConn(key)
+	if client == nil {
+		return c.CmdKey(key, cmd, args...)
+	}
+
+	r := client.Cmd(cmd, args...)
+	p.Put(client)
+	if r.Err != nil {
+		return c.CmdKey(key, cmd, args...)
+	}
+	return r
+}
@@ -55,7 +55,11 @@ func NewCustom(network, addr string, size int, df DialFunc) (*Pool, error) {
 	go func() {
 		for {
 			if len(p.pool) == 0 {
-				time.Sleep(time.Second)
+				select {
+				case <-p.stopCh:
+					return
+				case <-time.After(time.Second):
+				}
 				continue
 			}
 			time.Sleep(10 * time.Second / time.Duration(len(p.pool)))
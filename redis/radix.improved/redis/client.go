@@ -63,7 +63,13 @@ func DialTimeout(network, addr string, timeout time.Duration) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewClient(conn, network, addr, timeout), nil
+}
 
+// NewClient creates a Client over an already established connection, e.g. a
+// TLS connection or one that was already authenticated. The timeout is used
+// as the read/write timeout as in DialTimeout
+func NewClient(conn net.Conn, network, addr string, timeout time.Duration) *Client {
 	completed := make([]*Resp, 0, 10)
 	return &Client{
 		conn:          conn,
@@ -76,7 +82,7 @@ func DialTimeout(network, addr string, timeout time.Duration) (*Client, error) {
 		completedHead: completed,
 		Network:       network,
 		Addr:          addr,
-	}, nil
+	}
 }
 
 // Dial connects to the given Redis server.
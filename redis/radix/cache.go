@@ -0,0 +1,289 @@
+package redis2
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+)
+
+// The cache answers locally the GETs of the keys that match CachePatterns.
+// The values are removed after CacheTTL, by the writes to the same keys
+// sent through the relayer and, if the server supports the client tracking
+// of Redis 6, by its invalidation messages. Inside a transaction the GETs
+// go to the server, they must be queued, and the writes are invalidated
+// when the EXEC is sent.
+
+const (
+	defaultCacheSize = 10000
+	getCommand       = "GET"
+	multiCommand     = "MULTI"
+	execCommand      = "EXEC"
+	discardCommand   = "DISCARD"
+)
+
+var (
+	cacheHits   = lib.NewCounterVec("redis_cache_hits_total", "GETs answered from the local cache", "relayer")
+	cacheMisses = lib.NewCounterVec("redis_cache_misses_total", "GETs of cached keys sent to the server", "relayer")
+)
+
+type cacheKey struct {
+	db  int
+	key string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   []byte // The response, nil while the GET is pending
+	token   uint64 // Identifies the pending GET that can fill the value
+	expires time.Time
+}
+
+type cache struct {
+	sync.Mutex
+	listen   string
+	patterns []string
+	size     int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[cacheKey]*list.Element
+	dbs      map[int]bool
+	lastID   uint64
+	hits     int64
+	misses   int64
+	tracker  *tracker
+}
+
+// cacheWriter sends the response of a GET to the client and keeps a copy
+type cacheWriter struct {
+	io.Writer
+	buf bytes.Buffer
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	return w.Writer.Write(p)
+}
+
+// newCache returns nil if there are no patterns in the configuration
+func newCache(c *lib.RelayerConfig) *cache {
+	patterns := strings.Fields(c.CachePatterns)
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	ch := &cache{
+		listen:   c.Listen,
+		patterns: patterns,
+		size:     c.CacheSize,
+		ttl:      time.Duration(c.CacheTTL) * time.Second,
+		ll:       list.New(),
+		items:    make(map[cacheKey]*list.Element),
+		dbs:      make(map[int]bool),
+	}
+	if ch.size <= 0 {
+		ch.size = defaultCacheSize
+	}
+	ch.tracker = newTracker(ch, c)
+	go ch.tracker.run()
+	return ch
+}
+
+// cacheChanged returns true if the cache must be created again
+func cacheChanged(c, n *lib.RelayerConfig) bool {
+	return c.CachePatterns != n.CachePatterns || c.CacheSize != n.CacheSize || c.CacheTTL != n.CacheTTL
+}
+
+func (ch *cache) matches(key string) bool {
+	for _, p := range ch.patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the response if the request is a GET of a cached key, the
+// caller writes it after the previous responses of the connection.
+// Otherwise it returns the writer for the response: if the key must be
+// cached it keeps the response to store it once the request is done
+func (ch *cache) get(req *lib.Request, w io.Writer) (io.Writer, []byte) {
+	if req.Command != getCommand || len(req.Items) != 2 {
+		return w, nil
+	}
+	key, err := req.Items[1].Str()
+	if err != nil || !ch.matches(key) {
+		return w, nil
+	}
+
+	k := cacheKey{db: req.Database, key: key}
+	value, token := ch.lookup(k)
+	if value != nil {
+		atomic.AddInt64(&ch.hits, 1)
+		cacheHits.With(ch.listen).Inc()
+		return nil, value
+	}
+
+	atomic.AddInt64(&ch.misses, 1)
+	cacheMisses.With(ch.listen).Inc()
+	cw := &cacheWriter{Writer: w}
+	req.OnDone = func() {
+		ch.fill(k, token, cw.buf.Bytes())
+	}
+	return cw, nil
+}
+
+// lookup returns the value of the key, if it's not cached a pending entry
+// is created and its token returned
+func (ch *cache) lookup(k cacheKey) ([]byte, uint64) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	now := time.Now()
+	if elem, ok := ch.items[k]; ok {
+		e := elem.Value.(*cacheEntry)
+		if e.value != nil && (ch.ttl == 0 || now.Before(e.expires)) {
+			ch.ll.MoveToFront(elem)
+			return e.value, 0
+		}
+		ch.lastID++
+		e.value = nil
+		e.token = ch.lastID
+		ch.ll.MoveToFront(elem)
+		return nil, e.token
+	}
+
+	ch.lastID++
+	e := &cacheEntry{key: k, token: ch.lastID}
+	ch.items[k] = ch.ll.PushFront(e)
+	ch.dbs[k.db] = true
+	for ch.ll.Len() > ch.size {
+		ch.remove(ch.ll.Back())
+	}
+	return nil, e.token
+}
+
+// fill stores the response of a GET if the key wasn't invalidated since
+// the GET was sent. The errors are not stored
+func (ch *cache) fill(k cacheKey, token uint64, value []byte) {
+	if len(value) == 0 || value[0] == '-' {
+		return
+	}
+
+	ch.Lock()
+	defer ch.Unlock()
+
+	elem, ok := ch.items[k]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*cacheEntry)
+	if e.token != token || e.value != nil {
+		return
+	}
+	e.value = append([]byte(nil), value...)
+	if ch.ttl > 0 {
+		e.expires = time.Now().Add(ch.ttl)
+	}
+}
+
+func (ch *cache) remove(elem *list.Element) {
+	ch.ll.Remove(elem)
+	delete(ch.items, elem.Value.(*cacheEntry).key)
+}
+
+// invalidate removes the keys written by the request, again once it's
+// done because a GET could have been executed before the write
+func (ch *cache) invalidate(req *lib.Request) {
+	if drop := ch.dropper(req); drop != nil {
+		ch.invalidateOn(req, drop)
+	}
+}
+
+// dropper returns the function that removes the keys written by the
+// request, nil if it doesn't write
+func (ch *cache) dropper(req *lib.Request) func() {
+	if c := rediscmd.Get(req.Command); c != nil && !c.Has(rediscmd.Write) {
+		return nil
+	}
+
+	db := req.Database
+	keys, all := req.Keys()
+	return func() {
+		if all {
+			ch.flush()
+			return
+		}
+		ch.Lock()
+		defer ch.Unlock()
+		for _, key := range keys {
+			if elem, ok := ch.items[cacheKey{db: db, key: key}]; ok {
+				ch.remove(elem)
+			}
+		}
+	}
+}
+
+// invalidateOn drops the keys now and once the request is done, the
+// request is the write itself or the EXEC of the transaction with writes
+func (ch *cache) invalidateOn(req *lib.Request, drops ...func()) {
+	if len(drops) == 0 {
+		return
+	}
+	drop := func() {
+		for _, d := range drops {
+			d()
+		}
+	}
+	drop()
+
+	if f := req.OnDone; f != nil {
+		req.OnDone = func() {
+			f()
+			drop()
+		}
+	} else {
+		req.OnDone = drop
+	}
+}
+
+// invalidateKeys removes the keys from all the databases, they are the
+// keys of the invalidation messages of the server
+func (ch *cache) invalidateKeys(keys []string) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	for db := range ch.dbs {
+		for _, key := range keys {
+			if elem, ok := ch.items[cacheKey{db: db, key: key}]; ok {
+				ch.remove(elem)
+			}
+		}
+	}
+}
+
+func (ch *cache) flush() {
+	ch.Lock()
+	defer ch.Unlock()
+
+	ch.ll.Init()
+	ch.items = make(map[cacheKey]*list.Element)
+}
+
+func (ch *cache) len() int {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.ll.Len()
+}
+
+func (ch *cache) close() {
+	ch.tracker.exit()
+	ch.flush()
+}
@@ -16,44 +16,61 @@ import (
 // Client is the thread that connect to the remote redis server
 type Client struct {
 	sync.Mutex
-	config             *lib.RelayerConfig
-	mode               int
-	ready              int32
-	connected          int32
-	netConn            net.Conn
-	rw                 *lib.NetReadWriter
-	requestChan        chan *lib.Request // The relayer sends the requests via this channel
-	database           int               // The current selected database
-	queueChan          chan *lib.Request // Requests sent to the Redis server, some pending of responses
-	lastConnectFailure time.Time
-	connectedAt        time.Time
-	failures           int64
-	pipelined          int
+	config         atomic.Value // *lib.RelayerConfig
+	ready          int32
+	connected      int32
+	netConn        net.Conn
+	rw             readWriteFlusher
+	requestChan    chan *lib.Request // The relayer sends the requests via this channel
+	database       int               // The current selected database
+	queueChan      chan *lib.Request // Requests sent to the Redis server, some pending of responses
+	connectedAt    time.Time
+	connectBreaker *lib.Breaker // Throttles the connections after a failure
+	pipelined      int          // Commands written and not flushed
+	pipelinedBytes int64
+	stats          *lib.Counters
+	spool          *spool
+	journal        *journal
+	breaker        *lib.Breaker
+	connectFailed  func(url string)
 }
 
-// NewClient creates a new client that connect to a Redis server
-func NewClient(c *lib.RelayerConfig) *Client {
-	clt := &Client{}
+// readWriteFlusher is the connection to the server, buffered when pipelining
+type readWriteFlusher interface {
+	io.ReadWriter
+	Flush() error
+}
+
+// NewClient creates a new client that connect to a Redis server, the
+// failed connections are notified to connectFailed if it isn't nil
+func NewClient(c *lib.RelayerConfig, stats *lib.Counters, spool *spool, journal *journal, breaker *lib.Breaker, connectFailed func(url string)) *Client {
+	clt := &Client{
+		stats:          stats,
+		spool:          spool,
+		journal:        journal,
+		breaker:        breaker,
+		connectBreaker: lib.NewConnectBreaker(reconnectCooldown),
+		connectFailed:  connectFailed,
+	}
 	clt.Reload(c)
 
 	clt.requestChan = make(chan *lib.Request, requestBufferSize)
 	clt.setReady(true)
 	go clt.requestListener(clt.requestChan)
-	lib.Debugf("Client %s for target %s ready", clt.config.Listen, clt.config.Host())
+	lib.Debugf("Client %s for target %s ready", c.Listen, c.Host())
 
 	return clt
 }
 
 // Reload initialize teh configuration
 func (clt *Client) Reload(c *lib.RelayerConfig) {
-	clt.Lock()
-	defer clt.Unlock()
+	// The pipelined commands are flushed by the listener, a change of
+	// pipelining is applied in the next connection
+	clt.config.Store(c)
+}
 
-	if clt.isReady() {
-		clt.flush(true)
-	}
-	clt.config = c
-	clt.mode = clt.config.Type()
+func (clt *Client) getConfig() *lib.RelayerConfig {
+	return clt.config.Load().(*lib.RelayerConfig)
 }
 
 func (clt *Client) setReady(s bool) {
@@ -87,37 +104,52 @@ func (clt *Client) isConnected() bool {
 }
 
 func (clt *Client) connect() bool {
+	failed := "" // The URL that couldn't be connected
+	defer func() {
+		// Without the lock, the failover reloads the server
+		if failed != "" && clt.connectFailed != nil {
+			clt.connectFailed(failed)
+		}
+	}()
+
 	clt.Lock()
 	defer clt.Unlock()
 
-	if clt.failures > 10 {
-		// The pool manager will see we are invalid and kill us
-		clt.setReady(false)
-		return false
-	}
-	if clt.lastConnectFailure.Add(200 * time.Millisecond).After(time.Now()) {
+	if clt.connectBreaker.Allow() != nil {
 		// It failed too recently
 		return false
 	}
 
-	conn, err := net.DialTimeout(clt.config.Scheme(), clt.config.Host(), connectTimeout)
+	config := clt.getConfig()
+	start := time.Now()
+	conn, err := lib.DialRedis(config, config.Scheme(), config.Host(), connectTimeout)
 	if err != nil {
-		lib.Debugf("Failed to connect to %s", clt.config.Host())
+		lib.Debugf("Failed to connect to %s: %s", config.Host(), err)
 		clt.netConn = nil
-		clt.lastConnectFailure = time.Now()
-		clt.failures++
+		clt.connectBreaker.Record(start, err)
+		failed = config.URL
 		return false
 	}
-	clt.failures = 0
+	clt.connectBreaker.Reset()
+	clt.pipelined = 0
+	clt.pipelinedBytes = 0
 	clt.connectedAt = time.Now()
 	lib.Debugf("Connected to %s", conn.RemoteAddr())
 	clt.netConn = conn
 	clt.queueChan = make(chan *lib.Request, requestBufferSize)
-	clt.rw = lib.NewSingleReadWriter(conn, time.Duration(clt.config.Timeout)*time.Second, 0)
+	if clt.pipelining() {
+		clt.rw = lib.NewNetReadWriter(conn, time.Duration(config.Timeout)*time.Second, 0)
+	} else {
+		clt.rw = lib.NewSingleReadWriter(conn, time.Duration(config.Timeout)*time.Second, 0)
+	}
 
-	go clt.redisListener(clt.rw, clt.queueChan)
+	go clt.redisListener(conn, clt.rw, clt.queueChan)
 	clt.setConnected(true)
 
+	if clt.spool != nil && clt.spool.pending() {
+		clt.spool.wake()
+	}
+
 	return true
 }
 
@@ -139,38 +171,146 @@ func (clt *Client) requestListener(ch chan *lib.Request) {
 		}
 	}()
 
+	// Async writes held during the coalescing window
+	var pending *coalescer
+	var window <-chan time.Time
+	// Pipelined commands not flushed yet
+	var linger <-chan time.Time
+	armLinger := func() {
+		if linger == nil && clt.pipelined > 0 && clt.lingerTime() > 0 {
+			linger = time.After(clt.lingerTime())
+		}
+	}
+
 	clt.connect()
 	for {
 		select {
 		case req, more := <-ch:
 			if !more { // exit from the program because the channel was closed
-				clt.disconnect()
+				if pending != nil {
+					clt.writeAll(pending.take())
+				}
+				clt.shutdown()
 				return
 			}
-			_, err := clt.write(req)
-			req.Resp.ReleaseBuffers()
-			if err != nil {
-				log.Println("Error writing:", clt.config.Host(), err)
-				if req.Conn != nil {
-					respKO.WriteTo(req.Conn)
+			atomic.AddInt64(&clt.stats.Queued, -1)
+
+			if d := clt.coalesceWindow(); d > 0 && req.Conn == nil {
+				if pending == nil {
+					pending = newCoalescer()
 				}
-				clt.disconnect()
+				if pending.len() == 0 {
+					window = time.After(d)
+				}
+				if old := pending.add(req); old != nil {
+					coalescedWrites.With(clt.getConfig().Listen).Inc()
+					old.Done()
+					old.Resp.ReleaseBuffers()
+				}
+				if pending.len() < requestBufferSize {
+					continue
+				}
+				req = nil
+			}
+
+			// The held writes go before any other command
+			if pending != nil && pending.len() > 0 {
+				clt.writeAll(pending.take())
+				window = nil
+			}
+			if req != nil {
+				clt.writeRequest(req)
 			}
+			armLinger()
 			timer.Stop()
 			timer.Reset(maxIdle)
+		case <-window:
+			window = nil
+			clt.writeAll(pending.take())
+			armLinger()
+			timer.Stop()
+			timer.Reset(maxIdle)
+		case <-linger:
+			linger = nil
+			if clt.pipelined > 0 && clt.isConnected() {
+				clt.flush(true)
+			}
 		case <-timer.C:
 			if clt.netConn != nil {
-				lib.Debugf("Closing by idle %s", clt.config.Host())
-				clt.disconnect()
+				lib.Debugf("Closing by idle %s", clt.getConfig().Host())
+				clt.shutdown()
 			}
 		}
 	}
 }
 
+func (clt *Client) coalesceWindow() time.Duration {
+	return time.Duration(clt.getConfig().Coalesce) * time.Millisecond
+}
+
+func (clt *Client) writeAll(reqs []*lib.Request) {
+	for _, req := range reqs {
+		clt.writeRequest(req)
+	}
+}
+
+// writeRequest writes the request to the server, if it fails the client is
+// answered with an error or the async request is stored in the spool
+func (clt *Client) writeRequest(req *lib.Request) {
+	if req.Conn == nil && !req.Spooled && clt.spool != nil && clt.spool.pending() {
+		// The async writes go after the ones already stored in the spool
+		clt.toSpool(req)
+		req.Done()
+		req.Resp.ReleaseBuffers()
+		return
+	}
+
+	_, err := clt.write(req)
+	if err != nil {
+		clt.breaker.Record(req.Sent, err)
+		atomic.AddInt64(&clt.stats.Errors, 1)
+		log.Println("Error writing:", clt.getConfig().Host(), err)
+		switch {
+		case req.Conn != nil:
+			respKO.WriteTo(req.Conn)
+		case req.Spooled:
+			// It's still in the spool, it will be replayed again
+		case err == errConnect && clt.spool != nil:
+			// The command wasn't modified nor sent, keep it for later
+			clt.toSpool(req)
+		default:
+			clt.journal.add(req, err)
+		}
+		req.Err = err
+		req.Done()
+		clt.disconnect()
+	}
+	req.Resp.ReleaseBuffers()
+}
+
+// toSpool appends the async request to the spool, it's journaled if it fails
+func (clt *Client) toSpool(req *lib.Request) {
+	if e := clt.spool.append(req); e != nil {
+		log.Println("Spool ERROR:", clt.getConfig().Listen, e)
+		clt.journal.add(req, e)
+	}
+}
+
+// failed finishes a request not answered by the server
+func (clt *Client) failed(req *lib.Request, err error) {
+	if req.Conn != nil {
+		respKO.WriteTo(req.Conn)
+	} else if !req.Spooled {
+		clt.journal.add(req, err)
+	}
+	req.Err = err
+	req.Done()
+}
+
 // This goroutine listens for incoming answers from the Redis server
-func (clt *Client) redisListener(buf io.ReadWriter, queue chan *lib.Request) {
+func (clt *Client) redisListener(conn net.Conn, buf io.ReadWriter, queue chan *lib.Request) {
 	lib.Debugf("Net listener started")
-	defer clt.close() // Will force to close net connection
+	defer clt.close(conn) // Will force to close net connection
 
 	reader := redis.NewRespReader(buf)
 	for req := range queue {
@@ -181,24 +321,29 @@ func (clt *Client) redisListener(buf io.ReadWriter, queue chan *lib.Request) {
 
 		if r.Err != nil && r.IsType(redis.IOErr) {
 			if redis.IsTimeout(r) {
-				log.Printf("Timeout (%d secs) at %s", clt.config.Timeout, clt.config.Host())
+				log.Printf("Timeout (%d secs) at %s", clt.getConfig().Timeout, clt.getConfig().Host())
 			} else {
-				log.Printf("Error with server %s connection: %s", clt.config.Host(), r.Err)
-			}
-			if req.Conn != nil {
-				respKO.WriteTo(req.Conn)
+				log.Printf("Error with server %s connection: %s", clt.getConfig().Host(), r.Err)
 			}
-			clt.disconnect()
+			clt.breaker.Record(req.Sent, r.Err)
+			atomic.AddInt64(&clt.stats.Errors, 1)
+			clt.failed(req, r.Err)
+			clt.abort(queue)
 			return
 		}
+		clt.breaker.Record(req.Sent, nil)
+		if req.Conn == nil && r.IsType(redis.AppErr) {
+			clt.journal.add(req, r.Err)
+		}
 
-		if clt.config.Compress || clt.config.Uncompress || clt.config.Gzip != 0 || clt.config.Gunzip {
+		if c := clt.getConfig(); c.Compress || c.Uncompress || c.Gzip != 0 || c.Gunzip {
 			r.Uncompress()
 		}
 
 		if req.Conn != nil {
 			r.WriteTo(req.Conn)
 		}
+		req.Done()
 		r.ReleaseBuffers()
 	}
 	lib.Debugf("Net listener exiting")
@@ -208,9 +353,10 @@ func (clt *Client) purgeRequests() {
 	for {
 		select {
 		case req := <-clt.queueChan:
-			if req.Conn != nil {
-				respKO.WriteTo(req.Conn)
+			if req == nil {
+				continue
 			}
+			clt.failed(req, errNoResponse)
 		default:
 			return
 		}
@@ -218,12 +364,18 @@ func (clt *Client) purgeRequests() {
 }
 
 func (clt *Client) write(r *lib.Request) (int64, error) {
+	r.Sent = time.Now()
+	defer func(start time.Time) {
+		writeLatency.With(clt.getConfig().Listen, r.Command).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	if !clt.isConnected() && !clt.connect() {
-		return 0, fmt.Errorf("Connection failed")
+		return 0, errConnect
 	}
 
 	if r.Command == selectCommand {
-		if clt.mode == lib.ModeSmart && clt.database == r.Database { // There is no need to select again
+		if clt.getConfig().Type() == lib.ModeSmart && clt.database == r.Database { // There is no need to select again
+			r.Done()
 			return 0, nil
 		}
 		clt.database = r.Database
@@ -239,10 +391,11 @@ func (clt *Client) write(r *lib.Request) (int64, error) {
 	resp := r.Resp
 	// Use compression just if is not an EVAL command
 	if r.Command != evalCommand {
+		c := clt.getConfig()
 		switch {
-		case clt.config.Gzip != 0:
-			resp.CompressGz(lib.MinCompressSize, clt.config.Gzip)
-		case clt.config.Compress:
+		case c.Gzip != 0:
+			resp.CompressGz(lib.MinCompressSize, c.Gzip)
+		case c.Compress:
 			resp.CompressSnappy(lib.MinCompressSize, redis.MarkerSnappy)
 		}
 	}
@@ -262,6 +415,8 @@ func (clt *Client) write(r *lib.Request) (int64, error) {
 		return 0, err
 	}
 
+	clt.pipelined++
+	clt.pipelinedBytes += c
 	err = clt.flush(r.Conn != nil) // Force flush if it's an sync command
 	if err != nil {
 		return 0, err
@@ -276,11 +431,13 @@ func (clt *Client) changeDB(db int) (err error) {
 		selectCommand,
 		fmt.Sprintf("%d", db),
 	})
-	_, err = changer.WriteTo(clt.rw)
+	n, err := changer.WriteTo(clt.rw)
 	if err != nil {
 		log.Println("Error changing database", err)
 		return
 	}
+	clt.pipelined++
+	clt.pipelinedBytes += n
 	err = clt.flush(false)
 	if err != nil {
 		return
@@ -290,22 +447,39 @@ func (clt *Client) changeDB(db int) (err error) {
 
 }
 
+// flush sends the pipelined commands to the server if force or pipelining
+// is disabled. Otherwise they wait until the max commands or bytes are
+// reached, and until the linger time expires or, without it, until there
+// are no more commands queued
 func (clt *Client) flush(force bool) error {
-	if force || clt.config.Pipeline == 0 && clt.pipelined >= clt.config.Pipeline || len(clt.requestChan) == 0 {
-		err := clt.rw.Flush()
-		clt.pipelined = 0
-		if err != nil {
-			lib.Debugf("Failed in flush: %s", err)
-			clt.disconnect()
-			return err
+	c := clt.getConfig()
+	if !force && clt.pipelining() {
+		full := (c.Pipeline > 0 && clt.pipelined >= c.Pipeline) ||
+			(c.PipelineBytes > 0 && clt.pipelinedBytes >= int64(c.PipelineBytes))
+		if !full && (c.PipelineLinger > 0 || len(clt.requestChan) > 0) {
+			return nil
 		}
-	} else {
-		// Don't flush yet, for pipelining
-		clt.pipelined++
+	}
+
+	clt.pipelined = 0
+	clt.pipelinedBytes = 0
+	if err := clt.rw.Flush(); err != nil {
+		lib.Debugf("Failed in flush: %s", err)
+		clt.disconnect()
+		return err
 	}
 	return nil
 }
 
+func (clt *Client) pipelining() bool {
+	c := clt.getConfig()
+	return c.Pipeline > 0 || c.PipelineBytes > 0 || c.PipelineLinger > 0
+}
+
+func (clt *Client) lingerTime() time.Duration {
+	return time.Duration(clt.getConfig().PipelineLinger) * time.Microsecond
+}
+
 // Start disconnection
 func (clt *Client) disconnect() {
 	clt.Lock()
@@ -320,18 +494,50 @@ func (clt *Client) disconnect() {
 	clt.database = 0
 }
 
-// Close connection
-func (clt *Client) close() {
-	if clt.isConnected() {
-		clt.disconnect() // Double check
+// shutdown flushes the pipelined commands and closes the queue without
+// purging it, the listener reads their responses before closing the
+// connection
+func (clt *Client) shutdown() {
+	if clt.pipelined > 0 && clt.isConnected() {
+		clt.flush(true)
 	}
+
 	clt.Lock()
 	defer clt.Unlock()
 
-	if clt.netConn != nil {
-		clt.rw.Flush()
-		lib.Debugf("Closing connection")
-		clt.netConn.Close()
+	clt.setConnected(false)
+	if clt.queueChan != nil {
+		close(clt.queueChan)
+		clt.queueChan = nil
+	}
+	clt.database = 0
+}
+
+// abort fails the requests of the queue of a broken connection, it could
+// be already closed by shutdown
+func (clt *Client) abort(queue chan *lib.Request) {
+	clt.Lock()
+	current := clt.queueChan == queue
+	clt.Unlock()
+
+	if current {
+		clt.disconnect()
+	}
+	for req := range queue {
+		if req != nil {
+			clt.failed(req, errNoResponse)
+		}
+	}
+}
+
+// Close connection
+func (clt *Client) close(conn net.Conn) {
+	clt.Lock()
+	defer clt.Unlock()
+
+	lib.Debugf("Closing connection")
+	conn.Close()
+	if clt.netConn == conn {
 		clt.netConn = nil
 	}
 }
@@ -354,8 +560,9 @@ func (clt *Client) IsValid() bool {
 	return clt.isReady() && clt.isConnected()
 }
 
-// send sends a request to Redis through the requestChan
-func (clt *Client) send(req interface{}) (e error) {
+// Send sends a request to Redis through the requestChan, the response
+// is written to the Conn of the request if it is not nil
+func (clt *Client) Send(req interface{}) (e error) {
 	r := req.(*lib.Request)
 	defer func() {
 		r := recover() // To avoid panic due to closed channels
@@ -366,27 +573,26 @@ func (clt *Client) send(req interface{}) (e error) {
 	}()
 
 	if clt.requestChan == nil {
-		lib.Debugf("Nil channel in send request %s", clt.config.Host())
+		lib.Debugf("Nil channel in send request %s", clt.getConfig().Host())
 		return errKO
 	}
 
 	if !clt.isReady() {
-		lib.Debugf("Client not ready %s", clt.config.Host())
+		lib.Debugf("Client not ready %s", clt.getConfig().Host())
 		return errKO
 	}
 
-	if f := clt.failures; f > 0 {
-		if clt.lastConnectFailure.Add(connectTimeout).After(time.Now()) {
-			lib.Debugf("Client is failing to connect %s", clt.config.Host())
-			return errKO
-		}
+	if err := clt.breaker.Allow(); err != nil {
+		return err
 	}
 
 	if len(clt.requestChan) == requestBufferSize {
-		log.Println("Redis overloaded", clt.config.Host())
+		log.Println("Redis overloaded", clt.getConfig().Host())
+		atomic.AddInt64(&clt.stats.Overloaded, 1)
 		return errOverloaded
 	}
 
+	atomic.AddInt64(&clt.stats.Queued, 1)
 	clt.requestChan <- r
 	return nil
 }
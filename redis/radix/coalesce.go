@@ -0,0 +1,116 @@
+package redis2
+
+import (
+	"strings"
+
+	"github.com/gallir/smart-relayer/lib"
+)
+
+// The coalescer holds the async writes during the Coalesce window. A SET,
+// SETEX, PSETEX, HSET or HMSET replaces the previous one of the same key,
+// database and fields if no other command used the key between them, so
+// only the last value is sent and the order with the other commands of
+// the key is kept.
+
+var coalescedWrites = lib.NewCounterVec("redis_coalesced_total", "Async writes replaced by a later write of the same key", "relayer")
+
+type coalesceKey struct {
+	db  int
+	key string
+}
+
+type coalesced struct {
+	index int    // Position of the last write in reqs
+	group string // Only the writes of the same group replace each other
+}
+
+type coalescer struct {
+	reqs []*lib.Request // nil if it was replaced by a later write
+	last map[coalesceKey]coalesced
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		last: make(map[coalesceKey]coalesced),
+	}
+}
+
+// coalesceGroup returns the group of the write, empty if it can't be
+// replaced: SET with options, the other commands or a bad key
+func coalesceGroup(req *lib.Request) (key, group string) {
+	var err error
+	switch req.Command {
+	case "SET":
+		if len(req.Items) != 3 {
+			return "", ""
+		}
+		group = "string"
+	case "SETEX", "PSETEX":
+		group = "string"
+	case "HSET", "HMSET":
+		if len(req.Items) < 4 || len(req.Items)%2 != 0 {
+			return "", ""
+		}
+		// Only the writes of the same fields replace each other
+		fields := make([]string, 0, len(req.Items)/2)
+		for i := 2; i < len(req.Items); i += 2 {
+			f, err := req.Items[i].Str()
+			if err != nil {
+				return "", ""
+			}
+			fields = append(fields, f)
+		}
+		group = "hash\x00" + strings.Join(fields, "\x00")
+	default:
+		return "", ""
+	}
+
+	if key, err = req.Items[1].Str(); err != nil {
+		return "", ""
+	}
+	return key, group
+}
+
+// add appends the request, it returns the request replaced by it if any
+func (c *coalescer) add(req *lib.Request) (replaced *lib.Request) {
+	key, group := coalesceGroup(req)
+	if group == "" {
+		keys, all := req.Keys()
+		if all {
+			c.last = make(map[coalesceKey]coalesced)
+		}
+		for _, k := range keys {
+			delete(c.last, coalesceKey{db: req.Database, key: k})
+		}
+		c.reqs = append(c.reqs, req)
+		return nil
+	}
+
+	k := coalesceKey{db: req.Database, key: key}
+	if prev, ok := c.last[k]; ok && prev.group == group {
+		replaced = c.reqs[prev.index]
+		c.reqs[prev.index] = nil
+	}
+	c.last[k] = coalesced{index: len(c.reqs), group: group}
+	c.reqs = append(c.reqs, req)
+	return replaced
+}
+
+func (c *coalescer) len() int {
+	return len(c.reqs)
+}
+
+// take returns the pending requests in order and empties the coalescer
+func (c *coalescer) take() []*lib.Request {
+	reqs := make([]*lib.Request, 0, len(c.reqs))
+	for _, r := range c.reqs {
+		if r != nil {
+			reqs = append(reqs, r)
+		}
+	}
+	c.reqs = c.reqs[:0]
+	if len(c.last) > 0 {
+		c.last = make(map[coalesceKey]coalesced)
+	}
+	return reqs
+}
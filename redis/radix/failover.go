@@ -0,0 +1,215 @@
+package redis2
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The failover is used when the URL has several upstreams separated by
+// spaces, in order of preference. The current upstream is probed in
+// background and after FailoverFailures consecutive failed connections,
+// of the probes or of the clients, the relayer switches to the next one
+// that answers. While it's not using the first upstream it's also probed,
+// the relayer fails back to it once it has been healthy for FailbackSecs.
+
+const (
+	defaultFailoverFailures = 3
+	defaultFailbackSecs     = 30
+)
+
+var (
+	failoverProbe = 1 * time.Second
+
+	failoverSwitches = lib.NewCounterVec("redis_failover_total", "Changes of the upstream of the relayer, failovers and failbacks", "relayer")
+)
+
+type failover struct {
+	sync.Mutex
+	srv          *Server
+	config       lib.RelayerConfig // To dial the upstreams
+	list         string            // The URLs as in the configuration
+	urls         []string
+	current      int
+	maxFailures  int
+	failback     time.Duration
+	failures     int
+	healthySince time.Time // Since when the first upstream answers
+	switches     int64
+	checkCh      chan bool // To check before the next probe
+	exitCh       chan bool
+	exiting      bool
+}
+
+func newFailover(srv *Server, c *lib.RelayerConfig) *failover {
+	f := &failover{
+		srv:         srv,
+		config:      *c,
+		list:        c.URL,
+		urls:        c.URLs(),
+		maxFailures: c.FailoverFailures,
+		failback:    time.Duration(c.FailbackSecs) * time.Second,
+		checkCh:     make(chan bool, 1),
+		exitCh:      make(chan bool),
+	}
+	if f.maxFailures <= 0 {
+		f.maxFailures = defaultFailoverFailures
+	}
+	if f.failback <= 0 {
+		f.failback = defaultFailbackSecs * time.Second
+	}
+	return f
+}
+
+// sameConfig returns true if the upstreams, their credentials and the
+// thresholds didn't change
+func (f *failover) sameConfig(c *lib.RelayerConfig) bool {
+	n := newFailover(nil, c)
+	return n.maxFailures == f.maxFailures && n.failback == f.failback && !f.config.ConnectionChanged(c)
+}
+
+func withURL(c *lib.RelayerConfig, url string) *lib.RelayerConfig {
+	cc := *c
+	cc.URL = url
+	return &cc
+}
+
+// currentURL returns the URL of the upstream in use
+func (f *failover) currentURL() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.urls[f.current]
+}
+
+func (f *failover) getSwitches() int64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.switches
+}
+
+func (f *failover) watch() {
+	ticker := time.NewTicker(failoverProbe)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.exitCh:
+			return
+		case <-ticker.C:
+			f.check()
+		case <-f.checkCh:
+			f.check()
+		}
+	}
+}
+
+func (f *failover) check() {
+	f.Lock()
+	current := f.current
+	f.Unlock()
+
+	ok := f.probe(current)
+	f.Lock()
+	if ok {
+		f.failures = 0
+	} else {
+		f.failures++
+		lib.Debugf("Failover: %s failed %d times", f.urls[current], f.failures)
+	}
+	failed := f.failures >= f.maxFailures
+	f.Unlock()
+
+	if failed {
+		for i := 1; i < len(f.urls); i++ {
+			next := (current + i) % len(f.urls)
+			if f.probe(next) {
+				f.switchTo(next, "failover")
+				return
+			}
+		}
+		return
+	}
+
+	if current == 0 {
+		return
+	}
+	if !f.probe(0) {
+		f.healthySince = time.Time{}
+		return
+	}
+	if f.healthySince.IsZero() {
+		f.healthySince = time.Now()
+	}
+	if time.Since(f.healthySince) >= f.failback {
+		f.switchTo(0, "failback")
+	}
+}
+
+// connectFailed counts a failed connection of a client, the upstream is
+// checked as soon as the failures reach the maximum. The failures of the
+// clients of the previous upstreams are ignored
+func (f *failover) connectFailed(url string) {
+	f.Lock()
+	if f.exiting || url != f.urls[f.current] {
+		f.Unlock()
+		return
+	}
+	f.failures++
+	lib.Debugf("Failover: client failed to connect to %s, %d failures", url, f.failures)
+	failed := f.failures >= f.maxFailures
+	f.Unlock()
+
+	if failed {
+		select {
+		case f.checkCh <- true:
+		default:
+		}
+	}
+}
+
+// probe returns true if the upstream accepts a connection and answers PING
+func (f *failover) probe(i int) bool {
+	c := withURL(&f.config, f.urls[i])
+	conn, err := lib.DialRedis(c, c.Scheme(), c.Host(), connectTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	redis.NewResp([]interface{}{"PING"}).WriteTo(conn)
+	r := redis.NewRespReader(conn).Read()
+	return r.Err == nil
+}
+
+// switchTo changes the upstream and reloads the server
+func (f *failover) switchTo(i int, event string) {
+	f.Lock()
+	if f.exiting || i == f.current {
+		f.Unlock()
+		return
+	}
+	log.Printf("Failover: %s of %s from %s to %s", event, f.config.Listen, f.urls[f.current], f.urls[i])
+	f.current = i
+	f.failures = 0
+	f.healthySince = time.Time{}
+	f.switches++
+	f.Unlock()
+
+	failoverSwitches.With(f.config.Listen).Inc()
+	f.srv.upstreamChanged(f.list)
+}
+
+func (f *failover) exit() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.exiting {
+		return
+	}
+	f.exiting = true
+	close(f.exitCh)
+}
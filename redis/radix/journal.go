@@ -0,0 +1,178 @@
+package redis2
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The journal keeps the last async commands that failed, because they
+// couldn't be sent or the server answered with an error. The clients of the
+// relayer get them with the local command RELAYER ERRORS [n], and clear
+// them with RELAYER ERRORS RESET.
+
+const (
+	relayerCommand     = "RELAYER"
+	defaultJournalSize = 128
+	maxJournalArg      = 64 // Longer arguments are truncated
+	maxJournalArgs     = 16 // Arguments of the command kept
+)
+
+var (
+	errRelayerArgs  = errors.New("ERR unknown subcommand or wrong number of arguments for 'relayer' command")
+	respRelayerArgs = redis.NewResp(errRelayerArgs)
+)
+
+type journalEntry struct {
+	id      int64
+	at      time.Time
+	command string
+	err     string
+}
+
+type journal struct {
+	sync.Mutex
+	entries []journalEntry // Circular, next is the oldest when it's full
+	next    int
+	lastID  int64
+}
+
+func newJournal(c *lib.RelayerConfig) *journal {
+	return &journal{
+		entries: make([]journalEntry, 0, journalSize(c)),
+	}
+}
+
+func journalSize(c *lib.RelayerConfig) int {
+	if c.ErrorsJournal <= 0 {
+		return defaultJournalSize
+	}
+	return c.ErrorsJournal
+}
+
+// resize applies the size of the configuration, the newest entries are kept
+func (j *journal) resize(c *lib.RelayerConfig) {
+	size := journalSize(c)
+
+	j.Lock()
+	defer j.Unlock()
+
+	if size == cap(j.entries) {
+		return
+	}
+	n := len(j.entries)
+	if n > size {
+		n = size
+	}
+	// From the oldest to the newest, the next one is appended
+	entries := make([]journalEntry, n, size)
+	for i := 0; i < n; i++ {
+		entries[n-1-i] = j.entries[(j.next-1-i+2*len(j.entries))%len(j.entries)]
+	}
+	j.entries = entries
+	j.next = 0
+}
+
+// add records the failed command, the clients without journal ignore it
+func (j *journal) add(req *lib.Request, err error) {
+	if j == nil {
+		return
+	}
+	e := journalEntry{
+		at:      time.Now(),
+		command: journalCommand(req.Items),
+		err:     err.Error(),
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.lastID++
+	e.id = j.lastID
+	if len(j.entries) < cap(j.entries) {
+		j.entries = append(j.entries, e)
+		return
+	}
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % len(j.entries)
+}
+
+// last returns the last n entries, the newest first
+func (j *journal) last(n int) []journalEntry {
+	j.Lock()
+	defer j.Unlock()
+
+	if n > len(j.entries) {
+		n = len(j.entries)
+	}
+	l := make([]journalEntry, 0, n)
+	for i := 0; i < n; i++ {
+		pos := (j.next - 1 - i + 2*len(j.entries)) % len(j.entries)
+		l = append(l, j.entries[pos])
+	}
+	return l
+}
+
+func (j *journal) reset() {
+	j.Lock()
+	defer j.Unlock()
+
+	j.entries = j.entries[:0]
+	j.next = 0
+}
+
+// journalCommand returns the command as text, the long arguments and
+// commands are truncated
+func journalCommand(items []*redis.Resp) string {
+	args := make([]string, 0, len(items))
+	for i, item := range items {
+		if i == maxJournalArgs {
+			args = append(args, "...")
+			break
+		}
+		s, err := item.Str()
+		if err != nil {
+			s = "?"
+		}
+		if len(s) > maxJournalArg {
+			s = s[:maxJournalArg] + "..."
+		}
+		args = append(args, s)
+	}
+	return strings.Join(args, " ")
+}
+
+// relayerCmd answers the local command RELAYER, the entries of ERRORS are
+// arrays with the id, the unix time, the command and the error
+func (srv *Server) relayerCmd(items []*redis.Resp) *redis.Resp {
+	if len(items) < 2 || len(items) > 3 {
+		return respRelayerArgs
+	}
+	if sub, _ := items[1].Str(); strings.ToUpper(sub) != "ERRORS" {
+		return respRelayerArgs
+	}
+
+	n := 10
+	if len(items) == 3 {
+		arg, _ := items[2].Str()
+		if strings.ToUpper(arg) == "RESET" {
+			srv.journal.reset()
+			return respOK
+		}
+		var err error
+		if n, err = items[2].Int(); err != nil || n < 0 {
+			return respRelayerArgs
+		}
+	}
+
+	entries := srv.journal.last(n)
+	l := make([]interface{}, len(entries))
+	for i, e := range entries {
+		l[i] = []interface{}{e.id, e.at.Unix(), e.command, e.err}
+	}
+	return redis.NewResp(l)
+}
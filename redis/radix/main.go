@@ -2,6 +2,7 @@ package redis2
 
 import (
 	"errors"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -10,19 +11,29 @@ import (
 	"time"
 
 	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/mirror"
 	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
 )
 
 // Server is the thread that listen for clients' connections
 type Server struct {
 	sync.Mutex
-	config       lib.RelayerConfig
+	reloading    sync.Mutex   // The reloads are applied one by one
+	config       atomic.Value // *lib.RelayerConfig, replaced by Reload
 	pool         *Pool
-	mode         int
 	done         chan bool
 	exiting      bool
 	listener     net.Listener
 	asynCommands atomic.Value
+	stats        lib.Counters
+	spool        *spool
+	sentinel     *sentinel
+	failover     *failover
+	cache        atomic.Value // *cache
+	journal      *journal
+	mirror       atomic.Value // *mirror.Mirror
+	breaker      *lib.Breaker
 }
 
 const (
@@ -30,6 +41,7 @@ const (
 	requestBufferSize = 1024
 	listenTimeout     = 0 * time.Second // Don't timeout on local clients
 	connectTimeout    = 5 * time.Second
+	reconnectCooldown = 200 * time.Millisecond // Between the connections of a client after a failure
 	maxIdle           = 60 * time.Second
 	selectCommand     = "SELECT"
 	evalCommand       = "EVAL"
@@ -39,11 +51,16 @@ var (
 	errBadCmd      = errors.New("ERR bad command")
 	errKO          = errors.New("fatal error")
 	errOverloaded  = errors.New("Redis overloaded")
+	errConnect     = errors.New("Connection failed")
+	errPending     = errors.New("ERR timeout waiting for pending writes")
+	errNoResponse  = errors.New("connection closed before the response")
 	respOK         = redis.NewRespSimple("OK")
 	respTrue       = redis.NewResp(1)
 	respBadCommand = redis.NewResp(errBadCmd)
 	respKO         = redis.NewResp(errKO)
 	commands       map[string]*redis.Resp
+
+	writeLatency = lib.NewHistogramVec("redis_write_seconds", "Time spent by the client writing a command to the Redis server", nil, "relayer", "command")
 )
 
 func init() {
@@ -69,9 +86,28 @@ func init() {
 // New creates a new Redis local server
 func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 	srv := &Server{
-		done: done,
+		done:    done,
+		journal: newJournal(&c),
+		breaker: lib.NewBreaker(&c),
+	}
+	if c.Spool != "" {
+		s, err := newSpool(srv, &c)
+		if err != nil {
+			return nil, err
+		}
+		srv.spool = s
+	}
+	if err := srv.Reload(&c); err != nil {
+		if srv.spool != nil {
+			srv.spool.close()
+		}
+		return nil, err
+	}
+	if c.LoadCommands {
+		if err := lib.LoadCommands(srv.getConfig()); err != nil {
+			log.Printf("Error loading the commands from %s: %s", srv.getConfig().Host(), err)
+		}
 	}
-	srv.Reload(&c)
 	return srv, nil
 }
 
@@ -80,7 +116,7 @@ func (srv *Server) Start() (e error) {
 	srv.Lock()
 	defer srv.Unlock()
 
-	srv.listener, e = lib.NewListener(srv.config)
+	srv.listener, e = lib.NewListener(*srv.getConfig())
 	if e != nil {
 		return e
 	}
@@ -93,14 +129,14 @@ func (srv *Server) Start() (e error) {
 			if e != nil {
 				if netErr, ok := e.(net.Error); ok && netErr.Timeout() {
 					// Paranoid, ignore timeout errors
-					log.Println("Timeout at local listener", srv.config.ListenHost(), e)
+					log.Println("Timeout at local listener", srv.getConfig().ListenHost(), e)
 					continue
 				}
 				if srv.exiting {
-					log.Println("Exiting local listener", srv.config.ListenHost())
+					log.Println("Exiting local listener", srv.getConfig().ListenHost())
 					return
 				}
-				log.Fatalln("Emergency error in local listener", srv.config.ListenHost(), e)
+				log.Fatalln("Emergency error in local listener", srv.getConfig().ListenHost(), e)
 				return
 			}
 			go srv.handleConnection(netConn)
@@ -112,34 +148,86 @@ func (srv *Server) Start() (e error) {
 
 // Reload the configuration
 func (srv *Server) Reload(c *lib.RelayerConfig) error {
+	srv.reloading.Lock()
+	defer srv.reloading.Unlock()
+
+	return srv.reload(c)
+}
+
+func (srv *Server) reload(c *lib.RelayerConfig) error {
+	if c.Sentinels != "" {
+		var err error
+		if c, err = srv.sentinelConfig(c); err != nil {
+			return err
+		}
+	} else {
+		srv.stopSentinel()
+	}
+	if len(c.URLs()) > 1 && c.Sentinels == "" {
+		c = srv.failoverConfig(c)
+	} else {
+		srv.stopFailover()
+	}
+
+	// The configuration is never modified once published, the readers
+	// keep using the previous one until they load it again
+	cc := *c
+	c = &cc
+
 	srv.Lock()
+	old := srv.getConfig()
+	if old == nil {
+		old = &lib.RelayerConfig{}
+	}
 	reset := false
-	if srv.config.URL != c.URL {
+	if old.ConnectionChanged(c) {
 		reset = true
 	}
+	resetCache := reset || cacheChanged(old, c)
+	srv.breaker.Reload(c)
+	if reset {
+		srv.breaker.Reset()
+	}
+	srv.journal.resize(c)
+	if m := srv.getMirror(); m.Changed(c) {
+		m.Close()
+		srv.mirror.Store(mirror.New(c))
+	}
+	if srv.pool != nil && old.Spool != c.Spool {
+		log.Printf("Spool change at port %s requires a restart, still using %s", c.Listen, old.Spool)
+	}
 
-	srv.config = *c
-	srv.mode = c.Type()
+	srv.config.Store(c)
 
 	if reset {
 		if srv.pool != nil {
-			log.Printf("Reset redis server at port %s for target %s", srv.config.Listen, srv.config.Host())
+			log.Printf("Reset redis server at port %s for target %s", c.Listen, c.Host())
 			srv.pool.Reset()
 		}
-		srv.pool = NewPool(c)
+		srv.pool = NewPool(c, &srv.stats, srv.spool, srv.journal, srv.breaker, srv.connectFailed)
 	} else {
-		log.Printf("Reload redis config at port %s for target %s", srv.config.Listen, srv.config.Host())
+		log.Printf("Reload redis config at port %s for target %s", c.Listen, c.Host())
 		srv.pool.Reload(c)
 	}
 
+	if resetCache {
+		if old := srv.getCache(); old != nil {
+			old.close()
+		}
+		srv.cache.Store(newCache(c))
+	}
+
 	async := make(map[string]*redis.Resp)
 	for r, s := range commands {
 		async[r] = s
 	}
-	if srv.config.AsynCommands != "" {
-		for _, s := range strings.Split(srv.config.AsynCommands, " ") {
-			async[strings.ToUpper(s)] = respOK
+	for _, s := range strings.Fields(c.AsynCommands) {
+		name := strings.ToUpper(s)
+		if !rediscmd.CanBeAsync(name) {
+			log.Printf("Command %s can't be async at port %s, ignored", name, c.Listen)
+			continue
 		}
+		async[name] = respOK
 	}
 	srv.Unlock()
 
@@ -148,70 +236,336 @@ func (srv *Server) Reload(c *lib.RelayerConfig) error {
 	return nil
 }
 
+// sentinelConfig returns a copy of the configuration with the URL of the
+// master, the sentinel is created if it didn't exist or its config changed
+func (srv *Server) sentinelConfig(c *lib.RelayerConfig) (*lib.RelayerConfig, error) {
+	srv.Lock()
+	s := srv.sentinel
+	srv.Unlock()
+
+	if s == nil || !s.sameConfig(c) {
+		n := newSentinel(srv, c)
+		if err := n.resolve(); err != nil {
+			return nil, err
+		}
+		srv.stopSentinel()
+		srv.Lock()
+		srv.sentinel = n
+		srv.Unlock()
+		go n.watch()
+		s = n
+	}
+
+	cc := *c
+	cc.URL = s.masterURL()
+	return &cc, nil
+}
+
+func (srv *Server) stopSentinel() {
+	srv.Lock()
+	s := srv.sentinel
+	srv.sentinel = nil
+	srv.Unlock()
+
+	if s != nil {
+		s.exit()
+	}
+}
+
+// masterChanged is called by the sentinel after a failover, the pool
+// is created again with the new master
+func (srv *Server) masterChanged() {
+	srv.reloading.Lock()
+	defer srv.reloading.Unlock()
+
+	c := *srv.getConfig()
+	if err := srv.reload(&c); err != nil {
+		log.Printf("Error reloading %s after master change: %s", c.Listen, err)
+	}
+}
+
+// failoverConfig returns a copy of the configuration with the URL of the
+// current upstream, the failover is created if it didn't exist or its
+// config changed
+func (srv *Server) failoverConfig(c *lib.RelayerConfig) *lib.RelayerConfig {
+	srv.Lock()
+	f := srv.failover
+	srv.Unlock()
+
+	if f == nil || !f.sameConfig(c) {
+		srv.stopFailover()
+		f = newFailover(srv, c)
+		srv.Lock()
+		srv.failover = f
+		srv.Unlock()
+		go f.watch()
+	}
+	return withURL(c, f.currentURL())
+}
+
+func (srv *Server) stopFailover() {
+	srv.Lock()
+	f := srv.failover
+	srv.failover = nil
+	srv.Unlock()
+
+	if f != nil {
+		f.exit()
+	}
+}
+
+// upstreamChanged is called by the failover after a switch, the pool
+// is created again with the new upstream
+func (srv *Server) upstreamChanged(urls string) {
+	srv.reloading.Lock()
+	defer srv.reloading.Unlock()
+
+	c := *srv.getConfig()
+	c.URL = urls
+	if err := srv.reload(&c); err != nil {
+		log.Printf("Error reloading %s after upstream change: %s", c.Listen, err)
+	}
+}
+
+// connectFailed is called by the clients when they can't connect, the
+// failures count for the failover
+func (srv *Server) connectFailed(url string) {
+	srv.Lock()
+	f := srv.failover
+	srv.Unlock()
+
+	if f != nil {
+		f.connectFailed(url)
+	}
+}
+
+func (srv *Server) getConfig() *lib.RelayerConfig {
+	c, _ := srv.config.Load().(*lib.RelayerConfig)
+	return c
+}
+
+func (srv *Server) getPool() *Pool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.pool
+}
+
+func (srv *Server) getMirror() *mirror.Mirror {
+	m, _ := srv.mirror.Load().(*mirror.Mirror)
+	return m
+}
+
+func (srv *Server) getCache() *cache {
+	ch, _ := srv.cache.Load().(*cache)
+	return ch
+}
+
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(srv.getConfig())
+	if srv.spool != nil {
+		s.Gauge("spoolRecords", atomic.LoadInt64(&srv.spool.records))
+		s.Gauge("spoolBytes", atomic.LoadInt64(&srv.spool.size))
+	}
+	if ch := srv.getCache(); ch != nil {
+		s.Gauge("cacheHits", atomic.LoadInt64(&ch.hits))
+		s.Gauge("cacheMisses", atomic.LoadInt64(&ch.misses))
+		s.Gauge("cacheKeys", int64(ch.len()))
+	}
+	if srv.failover != nil {
+		s.Gauge("failovers", srv.failover.getSwitches())
+	}
+	srv.getMirror().AddStats(s)
+	srv.breaker.AddStats(s)
+	return s
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
 	if srv.listener != nil {
 		srv.listener.Close()
 	}
+	if srv.spool != nil {
+		srv.spool.close()
+	}
+	srv.stopSentinel()
+	srv.stopFailover()
+	if ch := srv.getCache(); ch != nil {
+		ch.close()
+	}
+	srv.getMirror().Close()
+	srv.breaker.Close()
 	srv.done <- true
 }
 
 func (srv *Server) handleConnection(netCon net.Conn) {
 	defer netCon.Close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(netCon)
-	client := srv.pool.Get()
-	defer srv.pool.Put(client)
+	session := lib.NewSession(srv.getConfig())
+	pool := srv.getPool()
+	client := pool.Get()
+	defer pool.Put(client)
 
 	currentDB := 0
+	tx := &mirror.Tx{}
+	// The cache is bypassed in the transactions, their writes are
+	// invalidated with the EXEC
+	inTx := false
+	var txDrops []func()
+
+	// Pending async writes and sync responses of this connection, for
+	// consistent mode. The responses are also tracked to write the cache
+	// hits after them
+	var pending, answers *lib.PendingKeys
+	if srv.getConfig().Consistent {
+		pending = lib.NewPendingKeys()
+		answers = lib.NewPendingKeys()
+	}
 
 	for {
 		r := reader.Read()
+		config := srv.getConfig()
 		if r.IsType(redis.IOErr) {
 			if redis.IsTimeout(r) {
 				// Paranoid, don't close it just log it
-				log.Println("Local client listen timeout at", srv.config.Listen)
+				log.Println("Local client listen timeout at", config.Listen)
 				continue
 			}
 			// Connection was closed
 			return
 		}
 
-		req := lib.NewRequest(r, &srv.config)
+		req := lib.NewRequest(r, config)
 		if req == nil {
 			respBadCommand.WriteTo(netCon)
 			continue
 		}
 
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			resp.WriteTo(netCon)
+			continue
+		}
+		if req.Command == relayerCommand {
+			srv.relayerCmd(req.Items).WriteTo(netCon)
+			continue
+		}
+		if err := rediscmd.CheckArity(req.Command, len(req.Items)); err != nil {
+			redis.NewResp(err).WriteTo(netCon)
+			continue
+		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
+
 		if req.Database != lib.UnknownDB && req.Database != currentDB {
 			currentDB = req.Database
 		}
 		req.Database = currentDB
+		srv.getMirror().Send(tx, req.Command, req.Database, req.Resp)
+
+		var conn io.Writer = netCon
+		if ch := srv.getCache(); ch != nil {
+			if answers == nil {
+				answers = lib.NewPendingKeys()
+			}
+			switch {
+			case req.Command == multiCommand:
+				inTx = true
+			case inTx && req.Command == execCommand:
+				ch.invalidateOn(req, txDrops...)
+				inTx, txDrops = false, nil
+			case inTx && req.Command == discardCommand:
+				inTx, txDrops = false, nil
+			case inTx:
+				if drop := ch.dropper(req); drop != nil {
+					txDrops = append(txDrops, drop)
+				}
+			default:
+				var value []byte
+				if conn, value = ch.get(req, netCon); value != nil {
+					if !answers.Wait(nil, true, config.ResponseTimeout()) {
+						redis.NewResp(errPending).WriteTo(netCon)
+						continue
+					}
+					netCon.Write(value)
+					continue
+				}
+				ch.invalidate(req)
+			}
+		}
 
 		// Smart mode, answer immediately and forget
-		if srv.mode == lib.ModeSmart {
+		if config.Type() == lib.ModeSmart {
 			// Commands that was defined as async in the configuration file
 			if async, ok := srv.asynCommands.Load().(map[string]*redis.Resp); ok {
 				if fastResponse, ok := async[req.Command]; ok {
+					if pending != nil && !answers.Wait(nil, true, config.ResponseTimeout()) {
+						// Don't answer before the previous sync commands
+						redis.NewResp(errPending).WriteTo(netCon)
+						continue
+					}
 					fastResponse.WriteTo(netCon)
-					client.send(req)
+					atomic.AddInt64(&srv.stats.Async, 1)
+					if pending != nil {
+						req.Track(pending)
+					}
+					srv.sendAsync(client, req)
 					continue
 				}
 			}
 		}
 
 		// Synchronized mode
-		req.Conn = netCon
+		if pending != nil {
+			keys, all := req.Keys()
+			if !pending.Wait(keys, all, config.ResponseTimeout()) {
+				redis.NewResp(errPending).WriteTo(netCon)
+				continue
+			}
+		}
+		if answers != nil {
+			req.Track(answers)
+		}
+		req.Conn = conn
 
-		e := client.send(req)
+		e := client.Send(req)
 		if e != nil {
+			req.Done()
 			redis.NewResp(e).WriteTo(netCon)
 			continue
 		}
 	}
 }
 
+// sendAsync sends a command already answered to the client, if there is a
+// spool it's stored there when there are previous commands pending or
+// the client can't accept it
+func (srv *Server) sendAsync(client *Client, req *lib.Request) {
+	if srv.spool == nil {
+		if err := client.Send(req); err != nil {
+			srv.journal.add(req, err)
+			req.Done()
+		}
+		return
+	}
+
+	if !srv.spool.pending() && client.Send(req) == nil {
+		return
+	}
+
+	if err := srv.spool.append(req); err != nil {
+		atomic.AddInt64(&srv.stats.Errors, 1)
+		log.Println("Spool ERROR:", srv.getConfig().Listen, err)
+		srv.journal.add(req, err)
+		req.Done()
+	}
+}
+
 func sendRequest(c chan *lib.Request, r *lib.Request) (ok bool) {
 	defer func() {
 		e := recover() // To avoid panic due to closed channels
@@ -0,0 +1,1164 @@
+package redis2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+	"github.com/gallir/smart-relayer/redis/redistest"
+)
+
+func startRelayer(t *testing.T, c lib.RelayerConfig) (*Server, net.Conn) {
+	srv, err := New(c, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, conn
+}
+
+func TestConsistentReads(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetDelay("SET", 20*time.Millisecond)
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Consistent:         true,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		redis.NewResp([]interface{}{"SET", fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)}).WriteTo(conn)
+		redis.NewResp([]interface{}{"GET", fmt.Sprintf("k%d", i)}).WriteTo(conn)
+	}
+
+	reader := redis.NewRespReader(conn)
+	for i := 0; i < n; i++ {
+		if s, _ := reader.Read().Str(); s != "OK" {
+			t.Fatalf("SET k%d: expected OK, got %q", i, s)
+		}
+		if s, _ := reader.Read().Str(); s != fmt.Sprintf("v%d", i) {
+			t.Fatalf("GET k%d: expected v%d, got %q", i, i, s)
+		}
+	}
+}
+
+func TestConsistentReadsSpooled(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetDelay("SET", 20*time.Millisecond)
+
+	// Commands pending in the spool, the next writes go after them while
+	// the reads are sent directly
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var records bytes.Buffer
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&records, "*3\r\n:0\r\n:%d\r\n", time.Now().Unix())
+		redis.NewResp([]interface{}{"SET", "old", fmt.Sprint(i)}).WriteTo(&records)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1, spoolSuffix)), records.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Consistent:         true,
+		Spool:              dir,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "k", "v"}).WriteTo(conn)
+	redis.NewResp([]interface{}{"GET", "k"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+	if s, _ := reader.Read().Str(); s != "v" {
+		t.Fatalf("GET: expected the spooled write, got %q", s)
+	}
+	if v, _ := rs.Get(0, "old"); v != "9" {
+		t.Errorf("the spool wasn't replayed first, old is %q", v)
+	}
+}
+
+func TestAuthOnReconnect(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.SetAuth("", "secret")
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Password:           "secret",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+
+	// QUIT closes the upstream connection, the first command after it can
+	// fail but the next connection must be authenticated again
+	redis.NewResp([]interface{}{"QUIT"}).WriteTo(conn)
+	reader.Read()
+
+	var r *redis.Resp
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		redis.NewResp([]interface{}{"SET", "a", "2"}).WriteTo(conn)
+		if r = reader.Read(); r.Err == nil {
+			break
+		}
+	}
+	if s, _ := r.Str(); s != "OK" {
+		t.Fatalf("SET after reconnect: expected OK, got %s", r)
+	}
+	if v, _ := rs.Get(0, "a"); v != "2" {
+		t.Fatalf("expected 2, got %q", v)
+	}
+}
+
+func TestLocalAuth(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:      "redis",
+		Mode:          "sync",
+		Listen:        "tcp://127.0.0.1:0",
+		URL:           rs.URL(),
+		LocalPassword: "secret",
+		DenyCommands:  "FLUSHDB",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	expect := func(prefix string, args ...interface{}) {
+		redis.NewResp(args).WriteTo(conn)
+		r := reader.Read()
+		s, _ := r.Str()
+		if r.Err != nil {
+			s = r.Err.Error()
+		}
+		if !strings.HasPrefix(s, prefix) {
+			t.Fatalf("%v: expected %s, got %q", args, prefix, s)
+		}
+	}
+
+	expect("NOAUTH", "SET", "a", "1")
+	expect("OK", "AUTH", "secret")
+	expect("OK", "SET", "a", "1")
+	expect("NOPERM", "FLUSHDB")
+	if rs.Count("FLUSHDB") != 0 {
+		t.Fatal("FLUSHDB reached the server")
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	first, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	sentinel, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sentinel.Close()
+	sentinel.SetMaster("mymaster", first.Addr())
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		Sentinels:          sentinel.URL(),
+		MasterName:         "mymaster",
+		MaxIdleConnections: 2,
+	})
+	defer srv.Exit()
+
+	redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+	if s, _ := redis.NewRespReader(conn).Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+	conn.Close()
+	if v, _ := first.Get(0, "a"); v != "1" {
+		t.Fatalf("expected 1 in the first master, got %q", v)
+	}
+
+	// Wait for the subscription before the failover
+	for i := 0; sentinel.Count("SUBSCRIBE") == 0; i++ {
+		if i > 100 {
+			t.Fatal("the relayer didn't subscribe to the sentinel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sentinel.SwitchMaster("mymaster", second.Addr())
+
+	for i := 0; ; i++ {
+		url := srv.getConfig().URL
+		if url == second.URL() {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("the relayer didn't switch to the new master, URL %s", url)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err = net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis.NewResp([]interface{}{"SET", "a", "2"}).WriteTo(conn)
+	if s, _ := redis.NewRespReader(conn).Read().Str(); s != "OK" {
+		t.Fatalf("SET after failover: expected OK, got %q", s)
+	}
+	if v, _ := second.Get(0, "a"); v != "2" {
+		t.Fatalf("expected 2 in the new master, got %q", v)
+	}
+}
+
+func TestArityError(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "a"}).WriteTo(conn)
+	r := reader.Read()
+	if r.Err == nil || r.Err.Error() != "ERR wrong number of arguments for 'set' command" {
+		t.Fatalf("expected an arity error, got %s", r)
+	}
+	if rs.Count("SET") != 0 {
+		t.Error("the wrong command was sent to the server")
+	}
+}
+
+func TestCache(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.Set(0, "config:a", "1")
+	rs.Set(0, "other", "x")
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		CachePatterns:      "config:*",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	// Wait for the tracking
+	for i := 0; rs.Count("SUBSCRIBE") == 0 || rs.Count("CLIENT") < 2; i++ {
+		if i > 100 {
+			t.Fatal("the client tracking wasn't enabled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	reader := redis.NewRespReader(conn)
+	get := func(key, expected string) {
+		t.Helper()
+		redis.NewResp([]interface{}{"GET", key}).WriteTo(conn)
+		if s, _ := reader.Read().Str(); s != expected {
+			t.Fatalf("GET %s: expected %q, got %q", key, expected, s)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		get("config:a", "1")
+		get("other", "x")
+	}
+	if n := rs.Count("GET"); n != 4 {
+		t.Errorf("expected 4 GETs in the server, got %d", n)
+	}
+	if n := srv.getCache().hits; n != 2 {
+		t.Errorf("expected 2 hits, got %d", n)
+	}
+
+	// Async write through the relayer
+	redis.NewResp([]interface{}{"SET", "config:a", "2"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+	get("config:a", "2")
+
+	// Write from another client, invalidated by the server
+	rs.Set(0, "config:a", "3")
+	for i := 0; ; i++ {
+		redis.NewResp([]interface{}{"GET", "config:a"}).WriteTo(conn)
+		if s, _ := reader.Read().Str(); s == "3" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("the key wasn't invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A pipelined hit is answered after the previous responses
+	get("config:a", "3")
+	hits := atomic.LoadInt64(&srv.getCache().hits)
+	rs.SetDelay("GET", 50*time.Millisecond)
+	redis.NewResp([]interface{}{"GET", "other"}).WriteTo(conn)
+	redis.NewResp([]interface{}{"GET", "config:a"}).WriteTo(conn)
+	for _, expected := range []string{"x", "3"} {
+		if s, _ := reader.Read().Str(); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+	if n := atomic.LoadInt64(&srv.getCache().hits); n != hits+1 {
+		t.Errorf("the pipelined GET wasn't a hit")
+	}
+
+	// The GET of a cached key inside a transaction is queued by the server
+	hits = atomic.LoadInt64(&srv.getCache().hits)
+	for _, cmd := range []string{"MULTI", "GET", "EXEC"} {
+		args := []interface{}{cmd}
+		if cmd == "GET" {
+			args = append(args, "config:a")
+		}
+		redis.NewResp(args).WriteTo(conn)
+	}
+	for _, expected := range []string{"OK", "QUEUED"} {
+		if s, _ := reader.Read().Str(); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+	if l, err := reader.Read().List(); err != nil || len(l) != 1 || l[0] != "3" {
+		t.Fatalf("EXEC: expected the value of the GET, got %v %v", l, err)
+	}
+	if n := atomic.LoadInt64(&srv.getCache().hits); n != hits {
+		t.Errorf("the GET of the transaction was answered by the cache")
+	}
+
+	// The writes of the transaction are invalidated with the EXEC
+	redis.NewResp([]interface{}{"MULTI"}).WriteTo(conn)
+	redis.NewResp([]interface{}{"DEL", "config:a"}).WriteTo(conn)
+	redis.NewResp([]interface{}{"EXEC"}).WriteTo(conn)
+	for i := 0; i < 3; i++ {
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("transaction: %s", r.Err)
+		}
+	}
+	get("config:a", "")
+}
+
+func TestCoalesce(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Coalesce:           100,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	cmds := [][]interface{}{}
+	for i := 0; i < 10; i++ {
+		cmds = append(cmds, []interface{}{"SET", "k", fmt.Sprintf("v%d", i)})
+	}
+	cmds = append(cmds,
+		[]interface{}{"SET", "a", "1"},
+		[]interface{}{"DEL", "a"}, // Not async, it's sent after the previous ones
+		[]interface{}{"SET", "a", "2"},
+		[]interface{}{"SET", "a", "3"},
+		[]interface{}{"GET", "k"},
+		[]interface{}{"GET", "a"},
+	)
+	for _, c := range cmds {
+		redis.NewResp(c).WriteTo(conn)
+	}
+
+	reader := redis.NewRespReader(conn)
+	var last []string
+	for range cmds {
+		r := reader.Read()
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		s, _ := r.Str()
+		last = append(last, s)
+	}
+	if got := strings.Join(last[len(last)-2:], " "); got != "v9 3" {
+		t.Errorf("expected v9 3, got %s", got)
+	}
+	// k once, a before the DEL and a once after it
+	if n := rs.Count("SET"); n != 3 {
+		t.Errorf("expected 3 SETs in the server, got %d", n)
+	}
+}
+
+func TestPipelineLinger(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		Pipeline:           100,
+		PipelineLinger:     200000,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+	reader.Read()
+	time.Sleep(50 * time.Millisecond)
+	if n := rs.Count("SET"); n != 0 {
+		t.Errorf("the SET was flushed before the linger time")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := rs.Count("SET"); n != 1 {
+		t.Errorf("the SET wasn't flushed after the linger time")
+	}
+
+	// The sync commands are flushed immediately
+	start := time.Now()
+	redis.NewResp([]interface{}{"SET", "b", "2"}).WriteTo(conn)
+	redis.NewResp([]interface{}{"GET", "b"}).WriteTo(conn)
+	reader.Read()
+	if s, _ := reader.Read().Str(); s != "2" {
+		t.Errorf("expected 2, got %q", s)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("the GET waited the linger time")
+	}
+}
+
+func TestPipelineLingerExit(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	clt := NewClient(&lib.RelayerConfig{
+		URL:            rs.URL(),
+		Pipeline:       100,
+		PipelineLinger: 1000000,
+	}, &lib.Counters{}, nil, nil, nil, nil)
+
+	// The client exits in the linger window, the write is sent and answered
+	done := make(chan error, 1)
+	req := lib.NewRequest(redis.NewResp([]interface{}{"SET", "a", "1"}), nil)
+	req.Database = 0
+	req.OnDone = func() { done <- req.Err }
+	if err := clt.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	clt.Exit()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("the write failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the write wasn't answered")
+	}
+	if v, _ := rs.Get(0, "a"); v != "1" {
+		t.Errorf("the write wasn't flushed, got %q", v)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rs.Close()
+
+	policies := []struct {
+		name   string
+		count  int
+		bytes  int
+		linger int
+	}{
+		{"none", 0, 0, 0},
+		{"count", 100, 0, 0},
+		{"bytes", 0, 16384, 0},
+		{"linger", 100, 0, 200},
+	}
+	// A burst of async writes followed by a read that waits for them
+	const burst = 100
+	for _, p := range policies {
+		b.Run(p.name, func(b *testing.B) {
+			srv, err := New(lib.RelayerConfig{
+				Protocol:           "redis",
+				Mode:               "smart",
+				Listen:             "tcp://127.0.0.1:0",
+				URL:                rs.URL(),
+				MaxIdleConnections: 1,
+				Pipeline:           p.count,
+				PipelineBytes:      p.bytes,
+				PipelineLinger:     p.linger,
+			}, make(chan bool, 1))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := srv.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer srv.Exit()
+			conn, err := net.Dial("tcp", srv.listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			set := redis.NewResp([]interface{}{"SET", "key", strings.Repeat("x", 100)})
+			get := redis.NewResp([]interface{}{"GET", "key"})
+			reader := redis.NewRespReader(conn)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					set.WriteTo(conn)
+				}
+				get.WriteTo(conn)
+				for j := 0; j <= burst; j++ {
+					if r := reader.Read(); r.Err != nil {
+						b.Fatal(r.Err)
+					}
+				}
+			}
+			b.StopTimer()
+
+			// The time a single async write waits before it reaches the server
+			const writes = 20
+			var delay time.Duration
+			for i := 0; i < writes; i++ {
+				n := rs.Count("SET")
+				start := time.Now()
+				set.WriteTo(conn)
+				reader.Read()
+				for rs.Count("SET") == n {
+					time.Sleep(10 * time.Microsecond)
+				}
+				delay += time.Since(start)
+			}
+			b.ReportMetric(float64(delay.Microseconds())/writes, "µs/write")
+		})
+	}
+}
+
+func TestRelayerErrors(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	c := lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		AsynCommands:       "LPUSH", // Unknown in the test server
+	}
+	srv, conn := startRelayer(t, c)
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	for i := 0; i < 3; i++ {
+		redis.NewResp([]interface{}{"LPUSH", "list", fmt.Sprintf("v%d", i)}).WriteTo(conn)
+		if s, _ := reader.Read().Str(); s != "OK" {
+			t.Fatalf("LPUSH: expected OK, got %q", s)
+		}
+	}
+	// A sync command to wait for the async ones
+	redis.NewResp([]interface{}{"PING"}).WriteTo(conn)
+	reader.Read()
+
+	redis.NewResp([]interface{}{"RELAYER", "ERRORS", "2"}).WriteTo(conn)
+	l, err := reader.Read().Array()
+	if err != nil || len(l) != 2 {
+		t.Fatalf("expected 2 errors, got %v %v", l, err)
+	}
+	e, _ := l[0].Array()
+	if len(e) != 4 {
+		t.Fatalf("bad entry %v", e)
+	}
+	if id, _ := e[0].Int(); id != 3 {
+		t.Errorf("expected the newest error first, got id %d", id)
+	}
+	if s, _ := e[2].Str(); s != "LPUSH list v2" {
+		t.Errorf("unexpected command %q", s)
+	}
+	if s, _ := e[3].Str(); s != "ERR unknown command" {
+		t.Errorf("unexpected error %q", s)
+	}
+
+	// A smaller journal keeps the newest errors
+	c.ErrorsJournal = 2
+	if err := srv.Reload(&c); err != nil {
+		t.Fatal(err)
+	}
+	redis.NewResp([]interface{}{"RELAYER", "ERRORS"}).WriteTo(conn)
+	l, _ = reader.Read().Array()
+	if len(l) != 2 {
+		t.Fatalf("expected 2 errors after the resize, got %d", len(l))
+	}
+	e, _ = l[1].Array()
+	if id, _ := e[0].Int(); id != 2 {
+		t.Errorf("expected the error 2 as the oldest, got %d", id)
+	}
+
+	redis.NewResp([]interface{}{"RELAYER", "ERRORS", "RESET"}).WriteTo(conn)
+	if s, _ := reader.Read().Str(); s != "OK" {
+		t.Fatalf("RESET: expected OK, got %q", s)
+	}
+	redis.NewResp([]interface{}{"RELAYER", "ERRORS"}).WriteTo(conn)
+	if l, _ := reader.Read().Array(); len(l) != 0 {
+		t.Errorf("expected no errors after reset, got %d", len(l))
+	}
+}
+
+func TestMirror(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	ms, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	ms.SetDelay("SET", 200*time.Millisecond) // A slow mirror doesn't delay the clients
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		MirrorURL:          ms.URL(),
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	reader := redis.NewRespReader(conn)
+	start := time.Now()
+	for _, c := range [][]interface{}{
+		{"SET", "a", "1"},
+		{"SELECT", "2"},
+		{"SET", "b", "2"},
+		{"GET", "b"},
+	} {
+		redis.NewResp(c).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("%v: %s", c, r.Err)
+		}
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Error("the clients waited for the mirror")
+	}
+
+	for i := 0; ; i++ {
+		_, okA := ms.Get(0, "a")
+		_, okB := ms.Get(2, "b")
+		if okA && okB {
+			break
+		}
+		if i > 100 {
+			t.Fatal("the writes weren't mirrored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ms.Count("GET"); n != 0 {
+		t.Errorf("the reads were mirrored")
+	}
+	if s := srv.Stats(); s.Gauges["mirrorCommands"] != 2 || s.Gauges["mirrorErrors"] != 0 {
+		t.Errorf("unexpected mirror stats %v", s.Gauges)
+	}
+}
+
+func TestMirrorOrder(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	ms, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		MirrorURL:          ms.URL(),
+	})
+	defer srv.Exit()
+	defer conn.Close()
+	reader := redis.NewRespReader(conn)
+
+	const n = 200
+	for i := 1; i <= n; i++ {
+		redis.NewResp([]interface{}{"SET", "k", fmt.Sprint(i)}).WriteTo(conn)
+	}
+	for i := 1; i <= n; i++ {
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("SET: %s", r.Err)
+		}
+	}
+
+	// A transaction is mirrored as a whole, a discarded one isn't
+	for _, c := range [][]interface{}{
+		{"MULTI"}, {"SET", "t", "1"}, {"EXEC"},
+		{"MULTI"}, {"SET", "d", "1"}, {"DISCARD"},
+	} {
+		redis.NewResp(c).WriteTo(conn)
+		if r := reader.Read(); r.Err != nil {
+			t.Fatalf("%v: %s", c, r.Err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		v, _ := ms.Get(0, "k")
+		_, okT := ms.Get(0, "t")
+		if v == fmt.Sprint(n) && okT {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected k=%d and t in the mirror, got k=%s", n, v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := ms.Get(0, "d"); ok {
+		t.Error("the discarded transaction was mirrored")
+	}
+	if c := ms.Count("MULTI"); c != 1 {
+		t.Errorf("expected 1 MULTI in the mirror, got %d", c)
+	}
+}
+
+func TestMirrorReload(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	ms, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	c := lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 4,
+		MirrorURL:          ms.URL(),
+	}
+	srv, conn := startRelayer(t, c)
+	defer srv.Exit()
+	conn.Close()
+
+	// The mirror changes while the clients send commands
+	done := make(chan bool)
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", srv.listener.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			reader := redis.NewRespReader(conn)
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				redis.NewResp([]interface{}{"SET", "k", "v"}).WriteTo(conn)
+				if r := reader.Read(); r.Err != nil {
+					errs <- r.Err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			c.MirrorURL = ""
+		} else {
+			c.MirrorURL = ms.URL()
+		}
+		if err := srv.Reload(&c); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	defer func(d time.Duration) { failoverProbe = d }(failoverProbe)
+	failoverProbe = 20 * time.Millisecond
+
+	primary, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                primary.URL() + " " + secondary.URL(),
+		FailoverFailures:   2,
+		FailbackSecs:       1,
+		MaxIdleConnections: 2,
+	})
+	defer srv.Exit()
+	conn.Close()
+
+	waitUpstream := func(url string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			current := srv.getConfig().URL
+			if current == url {
+				return
+			}
+			if i > 300 {
+				t.Fatalf("the relayer didn't switch to %s, URL %s", url, current)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	set := func(value string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		redis.NewResp([]interface{}{"SET", "a", value}).WriteTo(conn)
+		if s, _ := redis.NewRespReader(conn).Read().Str(); s != "OK" {
+			t.Fatalf("SET: expected OK, got %q", s)
+		}
+	}
+
+	waitUpstream(primary.URL())
+	set("1")
+	if v, _ := primary.Get(0, "a"); v != "1" {
+		t.Fatalf("expected 1 in the primary, got %q", v)
+	}
+
+	addr := primary.Addr()
+	primary.Close()
+	waitUpstream(secondary.URL())
+	set("2")
+	if v, _ := secondary.Get(0, "a"); v != "2" {
+		t.Fatalf("expected 2 in the secondary, got %q", v)
+	}
+
+	// The primary must be healthy for FailbackSecs before failing back
+	primary, err = redistest.NewServerAt(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	start := time.Now()
+	waitUpstream(primary.URL())
+	if time.Since(start) < time.Second {
+		t.Error("the relayer failed back before FailbackSecs")
+	}
+	set("3")
+	if v, _ := primary.Get(0, "a"); v != "3" {
+		t.Fatalf("expected 3 in the primary after failback, got %q", v)
+	}
+	if s := srv.Stats(); s.Gauges["failovers"] != 2 {
+		t.Errorf("expected 2 upstream changes, got %v", s.Gauges)
+	}
+}
+
+func TestUpstreamFailoverByClients(t *testing.T) {
+	// Only the failed connections of the clients can start the failover
+	defer func(d time.Duration) { failoverProbe = d }(failoverProbe)
+	failoverProbe = time.Hour
+
+	primary, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                primary.URL() + " " + secondary.URL(),
+		FailoverFailures:   2,
+		MaxIdleConnections: 2,
+	})
+	defer srv.Exit()
+	conn.Close()
+	primary.Close()
+
+	// Every connection gets a new client, the failed ones aren't reused
+	for i := 0; srv.getConfig().URL != secondary.URL(); i++ {
+		if i > 100 {
+			t.Fatalf("the relayer didn't switch to the secondary, URL %s", srv.getConfig().URL)
+		}
+		conn, err := net.Dial("tcp", srv.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+		redis.NewRespReader(conn).Read()
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err = net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis.NewResp([]interface{}{"SET", "a", "2"}).WriteTo(conn)
+	if s, _ := redis.NewRespReader(conn).Read().Str(); s != "OK" {
+		t.Fatalf("SET: expected OK, got %q", s)
+	}
+	if v, _ := secondary.Get(0, "a"); v != "2" {
+		t.Fatalf("expected 2 in the secondary, got %q", v)
+	}
+}
+
+func TestBreakerOpen(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "sync",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                rs.URL(),
+		MaxIdleConnections: 2,
+		BreakerErrors:      50,
+		BreakerMinCalls:    1,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+	rs.Close()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SET", "a", "1"}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil {
+		t.Fatalf("SET: expected an error, got %s", r)
+	}
+	redis.NewResp([]interface{}{"SET", "a", "2"}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil || r.Err.Error() != lib.ErrBreakerOpen.Error() {
+		t.Fatalf("SET: expected the error of the breaker, got %v", r.Err)
+	}
+	if s := srv.Stats(); s.Gauges["breakerState"] != int64(lib.BreakerOpen) || s.Gauges["breakerOpens"] != 1 {
+		t.Errorf("unexpected breaker stats %v", s.Gauges)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The upstream is down, the writes are stored in the spool
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := rs.Addr()
+	rs.Close()
+
+	c := lib.RelayerConfig{
+		Protocol:           "redis",
+		Mode:               "smart",
+		Listen:             "tcp://127.0.0.1:0",
+		URL:                "tcp://" + addr,
+		MaxIdleConnections: 2,
+		Spool:              dir,
+	}
+	srv, conn := startRelayer(t, c)
+	reader := redis.NewRespReader(conn)
+	const n = 100
+	for i := 1; i <= n; i++ {
+		for _, k := range []string{"k", fmt.Sprintf("k%d", i)} {
+			redis.NewResp([]interface{}{"SET", k, fmt.Sprint(i)}).WriteTo(conn)
+			if r := reader.Read(); r.Err != nil {
+				t.Fatalf("SET %s: %s", k, r.Err)
+			}
+		}
+	}
+	waitSpool := func(srv *Server, records int64) {
+		for i := 0; srv.Stats().Gauges["spoolRecords"] != records; i++ {
+			if i > 500 {
+				t.Fatalf("expected %d records in the spool, got %d", records, srv.Stats().Gauges["spoolRecords"])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitSpool(srv, 2*n)
+	conn.Close()
+	srv.Exit()
+
+	// The relayer is restarted and the upstream fails again in the middle
+	// of the replay, the commands not answered are kept
+	rs1, err := redistest.NewServerAt(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs1.SetDelay("SET", time.Millisecond)
+	srv, conn = startRelayer(t, c)
+	defer srv.Exit()
+	conn.Close()
+	for i := 0; rs1.Count("SET") < n/5; i++ {
+		if i > 500 {
+			t.Fatal("the spool wasn't replayed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rs1.Close()
+
+	rs2, err := redistest.NewServerAt(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs2.Close()
+	waitSpool(srv, 0)
+
+	if v, _ := rs2.Get(0, "k"); v != fmt.Sprint(n) {
+		t.Errorf("expected the last value %d, got %q", n, v)
+	}
+	for i := 1; i <= n; i++ {
+		k := fmt.Sprintf("k%d", i)
+		_, ok1 := rs1.Get(0, k)
+		_, ok2 := rs2.Get(0, k)
+		if !ok1 && !ok2 {
+			t.Errorf("%s was lost", k)
+		}
+	}
+}
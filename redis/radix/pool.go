@@ -3,28 +3,43 @@ package redis2
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gallir/smart-relayer/lib"
 )
 
-type CreateFunction func(*lib.RelayerConfig) *Client
+type CreateFunction func(*lib.RelayerConfig, *lib.Counters, *spool, *journal, *lib.Breaker, func(string)) *Client
 
 // Pool keep a list of clients' elements
 type Pool struct {
 	sync.Mutex
-	config       lib.RelayerConfig
+	config       atomic.Value // *lib.RelayerConfig
 	free         chan *Client
 	maxIdle      int
 	minIdle      int
 	maxConnected time.Duration
 	monitorCh    chan bool
+	closed       bool
+	stats        *lib.Counters
+	spool        *spool
+	journal      *journal
+	breaker      *lib.Breaker
+	failed       func(url string)
 }
 
-// New returns a new pool manager
-func NewPool(cfg *lib.RelayerConfig) (p *Pool) {
+// New returns a new pool manager, the clients update the given counters,
+// store in the spool the async commands they fail to send, record in
+// the journal the ones that fail, notify the results to the breaker and
+// the URLs they fail to connect to connectFailed
+func NewPool(cfg *lib.RelayerConfig, stats *lib.Counters, spool *spool, journal *journal, breaker *lib.Breaker, connectFailed func(url string)) (p *Pool) {
 	p = &Pool{
 		monitorCh: make(chan bool, 1),
+		stats:     stats,
+		spool:     spool,
+		journal:   journal,
+		breaker:   breaker,
+		failed:    connectFailed,
 	}
 	p.Reload(cfg)
 	go p.monitor()
@@ -35,6 +50,8 @@ func (p *Pool) Reload(cfg *lib.RelayerConfig) {
 	p.Lock()
 	defer p.Unlock()
 
+	cc := *cfg
+	cfg = &cc
 	p.maxConnected = time.Duration(cfg.MaxConnectedSecs) * time.Second
 	p.minIdle = cfg.MinIdleConnections
 	maxIdle := cfg.MaxIdleConnections
@@ -67,33 +84,64 @@ func (p *Pool) Reload(cfg *lib.RelayerConfig) {
 	}
 
 	p.maxIdle = maxIdle
-	p.config = *cfg
+	p.config.Store(cfg)
+}
+
+func (p *Pool) getConfig() *lib.RelayerConfig {
+	return p.config.Load().(*lib.RelayerConfig)
 }
 
 func (p *Pool) monitor() {
 	for _ = range p.monitorCh {
-		if len(p.free) < p.minIdle {
-			p.free <- NewClient(&p.config)
+		p.Lock()
+		free, minIdle := p.free, p.minIdle
+		p.Unlock()
+		if len(free) < minIdle {
+			free <- NewClient(p.getConfig(), p.stats, p.spool, p.journal, p.breaker, p.failed)
 		}
 	}
 }
 
+// checkIdle wakes up the monitor to create the min idle clients
+func (p *Pool) checkIdle() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return
+	}
+	select {
+	case p.monitorCh <- true:
+	default:
+	}
+}
+
 func (p *Pool) Reset() {
 	p.Lock()
 	defer p.Unlock()
 
+	p.closed = true
 	close(p.monitorCh)
-	for c := range p.free {
-		c.Exit()
+	for {
+		select {
+		case c := <-p.free:
+			c.Exit()
+		default:
+			return
+		}
 	}
 }
 
 // Get return a client from the pool or creates a new one
 func (p *Pool) Get() (c *Client) {
+	p.Lock()
+	free := p.free
+	p.Unlock()
+
 LOOP:
 	for c == nil {
 		select {
-		case item := <-p.free:
+		case item := <-free:
 			if !item.IsValid() {
 				item.Exit()
 				lib.Debugf("Error in client, ignoring it")
@@ -107,15 +155,11 @@ LOOP:
 
 	if c == nil {
 		lib.Debugf("Pool: created new client in get")
-		c = NewClient(&p.config)
+		c = NewClient(p.getConfig(), p.stats, p.spool, p.journal, p.breaker, p.failed)
 	}
 
 	// Check min idle connections
-	select {
-	case p.monitorCh <- true:
-	default:
-	}
-
+	p.checkIdle()
 	return
 }
 
@@ -131,26 +175,33 @@ func (p *Pool) Put(c *Client) {
 		return
 	}
 
-	if p.maxConnected > 0 && time.Since(c.connectedAt) > p.maxConnected {
+	p.Lock()
+	free, maxIdle, maxConnected, closed := p.free, p.maxIdle, p.maxConnected, p.closed
+	p.Unlock()
+
+	// The server replaced the pool
+	if closed {
+		c.Exit()
+		return
+	}
+
+	if maxConnected > 0 && time.Since(c.connectedAt) > maxConnected {
 		lib.Debugf("Pool: exceeded connected duration %s", time.Since(c.connectedAt))
 		c.Exit()
 		// Check min idle connections
-		select {
-		case p.monitorCh <- true:
-		default:
-		}
+		p.checkIdle()
 		return
 	}
 
 	// Update the config before send it back to the pool
-	if c.config != &p.config {
-		c.config = &p.config
+	if cfg := p.getConfig(); c.getConfig() != cfg {
+		c.Reload(cfg)
 	}
 
 	select {
-	case p.free <- c:
+	case free <- c:
 	default:
-		lib.Debugf("Pool: exceeded limit %d/%d", len(p.free), p.maxIdle)
+		lib.Debugf("Pool: exceeded limit %d/%d", len(free), maxIdle)
 		c.Exit()
 	}
 }
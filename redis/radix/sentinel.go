@@ -0,0 +1,209 @@
+package redis2
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The sentinel gets the address of the master from the Redis Sentinels
+// and follows the +switch-master events, the pool is created again with
+// the new master after every failover.
+
+const (
+	switchMasterChannel = "+switch-master"
+	sentinelRetry       = 1 * time.Second
+)
+
+var (
+	errNoMaster = errors.New("no sentinel knows the master")
+
+	sentinelSwitches = lib.NewCounterVec("sentinel_switch_total", "Master changes notified by the sentinels", "relayer")
+)
+
+type sentinel struct {
+	sync.Mutex
+	srv     *Server
+	listen  string
+	addrs   []string
+	name    string
+	master  string // host:port of the current master
+	conn    net.Conn
+	exitCh  chan bool
+	exiting bool
+}
+
+func newSentinel(srv *Server, c *lib.RelayerConfig) *sentinel {
+	s := &sentinel{
+		srv:    srv,
+		listen: c.Listen,
+		name:   c.MasterName,
+		exitCh: make(chan bool),
+	}
+	for _, u := range strings.Fields(c.Sentinels) {
+		if addr, err := lib.Host(u); err == nil && addr != "" {
+			s.addrs = append(s.addrs, addr)
+		}
+	}
+	return s
+}
+
+// sameConfig returns true if the sentinels and the master name didn't change
+func (s *sentinel) sameConfig(c *lib.RelayerConfig) bool {
+	n := newSentinel(nil, c)
+	return n.name == s.name && strings.Join(n.addrs, " ") == strings.Join(s.addrs, " ")
+}
+
+// masterURL returns the URL of the current master
+func (s *sentinel) masterURL() string {
+	s.Lock()
+	defer s.Unlock()
+	return "tcp://" + s.master
+}
+
+// resolve asks the sentinels for the address of the master
+func (s *sentinel) resolve() error {
+	for _, addr := range s.addrs {
+		master, err := s.query(addr)
+		if err != nil {
+			log.Printf("Sentinel ERROR: %s %s", addr, err)
+			continue
+		}
+		s.Lock()
+		s.master = master
+		s.Unlock()
+		return nil
+	}
+	return errNoMaster
+}
+
+func (s *sentinel) query(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, connectTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	redis.NewResp([]interface{}{"SENTINEL", "get-master-addr-by-name", s.name}).WriteTo(conn)
+	r := redis.NewRespReader(conn).Read()
+	if r.Err != nil {
+		return "", r.Err
+	}
+	if r.IsType(redis.Nil) {
+		return "", errNoMaster
+	}
+	l, err := r.List()
+	if err != nil || len(l) != 2 {
+		return "", errNoMaster
+	}
+	return net.JoinHostPort(l[0], l[1]), nil
+}
+
+// watch subscribes to the master changes, it tries all the sentinels in
+// turn until one accepts the subscription
+func (s *sentinel) watch() {
+	for {
+		for _, addr := range s.addrs {
+			err := s.subscribe(addr)
+			if s.isExiting() {
+				return
+			}
+			log.Printf("Sentinel ERROR: subscription to %s finished: %s", addr, err)
+
+			select {
+			case <-s.exitCh:
+				return
+			case <-time.After(sentinelRetry):
+			}
+		}
+	}
+}
+
+func (s *sentinel) subscribe(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, connectTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.Lock()
+	if s.exiting {
+		s.Unlock()
+		return nil
+	}
+	s.conn = conn
+	s.Unlock()
+
+	reader := redis.NewRespReader(conn)
+	redis.NewResp([]interface{}{"SUBSCRIBE", switchMasterChannel}).WriteTo(conn)
+	if r := reader.Read(); r.Err != nil {
+		return r.Err
+	}
+	lib.Debugf("Sentinel: subscribed to %s", addr)
+
+	// The master could have changed while we weren't subscribed
+	if master, err := s.query(addr); err == nil {
+		s.switchTo(master)
+	}
+
+	for {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			return r.Err
+		}
+
+		l, err := r.List()
+		if err != nil || len(l) != 3 || l[0] != "message" || l[1] != switchMasterChannel {
+			continue
+		}
+
+		// <master name> <old ip> <old port> <new ip> <new port>
+		f := strings.Fields(l[2])
+		if len(f) != 5 || f[0] != s.name {
+			continue
+		}
+		s.switchTo(net.JoinHostPort(f[3], f[4]))
+	}
+}
+
+// switchTo changes the master and reloads the server if it's different
+func (s *sentinel) switchTo(master string) {
+	s.Lock()
+	if master == s.master || s.exiting {
+		s.Unlock()
+		return
+	}
+	log.Printf("Sentinel: master %s changed from %s to %s", s.name, s.master, master)
+	s.master = master
+	s.Unlock()
+
+	sentinelSwitches.With(s.listen).Inc()
+	s.srv.masterChanged()
+}
+
+func (s *sentinel) isExiting() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.exiting
+}
+
+func (s *sentinel) exit() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.exiting {
+		return
+	}
+	s.exiting = true
+	close(s.exitCh)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
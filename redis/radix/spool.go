@@ -0,0 +1,501 @@
+package redis2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The spool stores in disk the async commands that couldn't be sent to
+// Redis. The commands are stored as RESP arrays [db, unix time, command]
+// in segment files that are replayed in order, the oldest first, and
+// deleted once all their commands were answered by Redis. If some of them
+// fail the replay starts again from the first one that failed. If the
+// relayer is restarted the segments are replayed from the beginning, so
+// a few commands could be sent twice.
+//
+// In consistent mode the pending writes of the connections are kept in
+// memory by position, they are marked as done once the replayed command
+// is answered by Redis.
+
+const (
+	spoolSuffix      = ".spool"
+	spoolSegmentSize = 16 * 1024 * 1024
+	spoolCheckPeriod = 1 * time.Second
+	spoolRetryWait   = 10 * time.Millisecond
+)
+
+var (
+	errSpoolFull   = errors.New("spool is full")
+	errSpoolClosed = errors.New("spool is closed")
+
+	spoolBytes   = lib.NewGaugeVec("spool_bytes", "Bytes stored in the spool pending to be replayed", "relayer")
+	spoolRecords = lib.NewGaugeVec("spool_records", "Commands stored in the spool pending to be replayed", "relayer")
+	spoolDropped = lib.NewCounterVec("spool_dropped_total", "Commands discarded by the spool", "relayer", "reason")
+)
+
+type spool struct {
+	sync.Mutex
+	srv       *Server
+	dir       string
+	listen    string
+	maxSize   int64
+	maxAge    time.Duration
+	segments  []string // Segment files, the last one is where new records are appended
+	w         *os.File
+	wSize     int64
+	seq       int64
+	replayed  int // Records already replayed of the first segment
+	size      int64
+	records   int64
+	replaying int32
+	appended  int64 // Position of the next record to append
+	position  int64 // Position of the next record to replay
+	waiters   map[int64]spoolWaiter
+	wakeCh    chan bool
+	doneCh    chan bool
+	closed    bool
+}
+
+type spoolWaiter struct {
+	pending *lib.PendingKeys
+	keys    []string
+	all     bool
+}
+
+func (w spoolWaiter) done() {
+	if w.pending != nil {
+		w.pending.Done(w.keys, w.all)
+	}
+}
+
+func newSpool(srv *Server, c *lib.RelayerConfig) (*spool, error) {
+	if err := os.MkdirAll(c.Spool, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		srv:     srv,
+		dir:     c.Spool,
+		listen:  c.Listen,
+		maxSize: int64(c.SpoolMaxSize) * 1024 * 1024,
+		maxAge:  time.Duration(c.SpoolMaxAge) * time.Second,
+		waiters: make(map[int64]spoolWaiter),
+		wakeCh:  make(chan bool, 1),
+		doneCh:  make(chan bool),
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		s.size += info.Size()
+		s.records += countRecords(f)
+		s.segments = append(s.segments, f)
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(f), spoolSuffix), 10, 64); err == nil && seq > s.seq {
+			s.seq = seq
+		}
+	}
+	s.appended = s.records
+	if s.records > 0 {
+		log.Printf("Spool %s: %d commands pending in %s", s.listen, s.records, s.dir)
+	}
+
+	spoolBytes.SetFunc(func() float64 { return float64(atomic.LoadInt64(&s.size)) }, s.listen)
+	spoolRecords.SetFunc(func() float64 { return float64(atomic.LoadInt64(&s.records)) }, s.listen)
+
+	go s.run()
+	return s, nil
+}
+
+// pending returns true if there are commands waiting to be replayed,
+// the new commands must be appended to keep the order
+func (s *spool) pending() bool {
+	return atomic.LoadInt64(&s.records) > 0
+}
+
+// append stores the request at the end of the spool
+func (s *spool) append(req *lib.Request) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*3\r\n:%d\r\n:%d\r\n", req.Database, time.Now().Unix())
+	if _, err := req.Resp.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return errSpoolClosed
+	}
+
+	if s.maxSize > 0 && s.size+int64(buf.Len()) > s.maxSize {
+		spoolDropped.With(s.listen, "full").Inc()
+		return errSpoolFull
+	}
+
+	if s.w == nil || s.wSize >= spoolSegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.w.Write(buf.Bytes())
+	s.wSize += int64(n)
+	atomic.AddInt64(&s.size, int64(n))
+	if err != nil {
+		// Don't append more to a segment that could have a partial record
+		s.closeWriter()
+		return err
+	}
+	atomic.AddInt64(&s.records, 1)
+	if req.Pending != nil {
+		keys, all := req.Keys()
+		s.waiters[s.appended] = spoolWaiter{pending: req.Pending, keys: keys, all: all}
+		req.Pending = nil
+	}
+	s.appended++
+	s.wake()
+	return nil
+}
+
+// rotate closes the current segment and opens a new one
+func (s *spool) rotate() error {
+	s.closeWriter()
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.w = f
+	s.wSize = 0
+	s.segments = append(s.segments, name)
+	return nil
+}
+
+func (s *spool) closeWriter() {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
+
+func (s *spool) wake() {
+	select {
+	case s.wakeCh <- true:
+	default:
+	}
+}
+
+func (s *spool) run() {
+	ticker := time.NewTicker(spoolCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-s.wakeCh:
+		case <-ticker.C:
+		}
+		if s.pending() {
+			s.replay()
+		}
+	}
+}
+
+// replay sends the stored commands through a client of the pool, it
+// stops when the client fails, the next connection will try again
+func (s *spool) replay() {
+	if !atomic.CompareAndSwapInt32(&s.replaying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.replaying, 0)
+
+	pool := s.srv.getPool()
+	if pool == nil {
+		return
+	}
+
+	clt := pool.Get()
+	defer pool.Put(clt)
+
+	for s.pending() {
+		name, skip, position := s.next()
+		if name == "" {
+			return
+		}
+		if !s.replaySegment(clt, name, skip, position) {
+			return
+		}
+	}
+}
+
+// next returns the oldest segment, the records already replayed from it
+// and the position of the next one. The segment being written is closed so
+// it's not modified while it's read
+func (s *spool) next() (string, int, int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.segments) == 0 {
+		return "", 0, 0
+	}
+	if len(s.segments) == 1 {
+		s.closeWriter()
+	}
+	return s.segments[0], s.replayed, s.position
+}
+
+// spoolAcks waits for the answers of the records replayed from a segment
+type spoolAcks struct {
+	sync.WaitGroup
+	sync.Mutex
+	failed int // The first record that failed, -1 if none
+}
+
+func (a *spoolAcks) ack(i int, err error) {
+	if err != nil {
+		a.Lock()
+		if a.failed < 0 || i < a.failed {
+			a.failed = i
+		}
+		a.Unlock()
+	}
+	a.Done()
+}
+
+func (a *spoolAcks) firstFailed() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.failed
+}
+
+// replaySegment sends the records of the segment after skip and waits
+// for their answers. It returns false if some of them failed, they are
+// kept in the segment to be replayed again
+func (s *spool) replaySegment(clt *Client, name string, skip int, position int64) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Printf("Spool ERROR: %s %s", name, err)
+		s.remove(name)
+		return true
+	}
+	defer f.Close()
+
+	acks := &spoolAcks{failed: -1}
+	reader := redis.NewRespReader(f)
+	read := skip
+	for i := 0; acks.firstFailed() < 0; i++ {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			// End of file or a partial record at the end
+			break
+		}
+		if i < skip {
+			continue
+		}
+		read = i + 1
+
+		req := s.request(r)
+		if req == nil {
+			continue
+		}
+		pos, n := position+int64(i-skip), i
+		req.Spooled = true
+		req.OnDone = func() {
+			if req.Err == nil {
+				s.doneWaiter(pos)
+			}
+			acks.ack(n, req.Err)
+		}
+		acks.Add(1)
+		if err := s.send(clt, req); err != nil {
+			lib.Debugf("Spool %s: stopping replay, %s", s.listen, err)
+			acks.ack(n, err)
+			break
+		}
+	}
+
+	answered := make(chan bool)
+	go func() {
+		acks.Wait()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-s.doneCh:
+		return false
+	}
+
+	failed := acks.firstFailed()
+	if failed < 0 {
+		s.acked(name, read-skip)
+		s.remove(name)
+		return true
+	}
+	s.acked(name, failed-skip)
+	return false
+}
+
+// send queues the request in the client leaving room for the commands
+// of the local clients
+func (s *spool) send(clt *Client, req *lib.Request) error {
+	for {
+		if len(clt.requestChan) > requestBufferSize/2 {
+			time.Sleep(spoolRetryWait)
+			continue
+		}
+		err := clt.Send(req)
+		if err != errOverloaded {
+			return err
+		}
+		time.Sleep(spoolRetryWait)
+	}
+}
+
+// request decodes a record, returns nil if it's invalid or too old
+func (s *spool) request(r *redis.Resp) *lib.Request {
+	items, err := r.Array()
+	if err != nil || len(items) != 3 {
+		spoolDropped.With(s.listen, "invalid").Inc()
+		return nil
+	}
+
+	if s.maxAge > 0 {
+		ts, err := items[1].Int64()
+		if err != nil || time.Since(time.Unix(ts, 0)) > s.maxAge {
+			spoolDropped.With(s.listen, "expired").Inc()
+			return nil
+		}
+	}
+
+	db, err := items[0].Int()
+	if err != nil {
+		spoolDropped.With(s.listen, "invalid").Inc()
+		return nil
+	}
+
+	req := lib.NewRequest(items[2], nil)
+	if req == nil {
+		spoolDropped.With(s.listen, "invalid").Inc()
+		return nil
+	}
+	req.Database = db
+	return req
+}
+
+// doneWaiter marks as done the pending write of the record, if any
+func (s *spool) doneWaiter(position int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if w, ok := s.waiters[position]; ok {
+		delete(s.waiters, position)
+		w.done()
+	}
+}
+
+// acked moves the position after the next n records of the segment, all
+// of them were answered by Redis
+func (s *spool) acked(name string, n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if n <= 0 || len(s.segments) == 0 || s.segments[0] != name {
+		return
+	}
+	for i := 0; i < n; i++ {
+		if w, ok := s.waiters[s.position]; ok {
+			delete(s.waiters, s.position)
+			w.done()
+		}
+		s.position++
+	}
+	s.replayed += n
+	atomic.AddInt64(&s.records, -int64(n))
+}
+
+// remove deletes a fully replayed segment
+func (s *spool) remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if info, err := os.Stat(name); err == nil {
+		atomic.AddInt64(&s.size, -info.Size())
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Printf("Spool ERROR: removing %s %s", name, err)
+	}
+
+	if len(s.segments) > 0 && s.segments[0] == name {
+		s.segments = s.segments[1:]
+		s.replayed = 0
+	}
+
+	if len(s.segments) == 0 {
+		// Fix the counters if a partial record was discarded
+		atomic.StoreInt64(&s.records, 0)
+		atomic.StoreInt64(&s.size, 0)
+		for _, w := range s.waiters {
+			w.done()
+		}
+		s.waiters = make(map[int64]spoolWaiter)
+		s.position = s.appended
+	}
+}
+
+func (s *spool) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.closeWriter()
+	for _, w := range s.waiters {
+		w.done()
+	}
+	s.waiters = nil
+	close(s.doneCh)
+	spoolBytes.Delete(s.listen)
+	spoolRecords.Delete(s.listen)
+}
+
+func countRecords(name string) (n int64) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0
+	}
+
+	reader := redis.NewRespReader(bytes.NewReader(b))
+	for {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			return
+		}
+		n++
+	}
+}
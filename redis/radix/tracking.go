@@ -0,0 +1,213 @@
+package redis2
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// The tracker enables the client tracking of Redis 6 in broadcasting mode
+// for the prefixes of the cache patterns. The invalidation messages are
+// redirected to a second connection subscribed to __redis__:invalidate,
+// as required by RESP2. If the server doesn't support it the cached values
+// just expire after CacheTTL.
+
+const (
+	invalidateChannel = "__redis__:invalidate"
+	trackingRetry     = 1 * time.Second
+)
+
+var (
+	errNoTracking = errors.New("client tracking not supported")
+	errExiting    = errors.New("exiting")
+)
+
+type tracker struct {
+	sync.Mutex
+	cache    *cache
+	config   lib.RelayerConfig
+	prefixes []string
+	conns    []net.Conn
+	exitCh   chan bool
+	exiting  bool
+}
+
+func newTracker(ch *cache, c *lib.RelayerConfig) *tracker {
+	return &tracker{
+		cache:    ch,
+		config:   *c,
+		prefixes: trackingPrefixes(ch.patterns),
+		exitCh:   make(chan bool),
+	}
+}
+
+// trackingPrefixes returns the fixed part of the patterns, without the
+// overlapping ones that Redis rejects. It's empty if a pattern matches
+// any key
+func trackingPrefixes(patterns []string) []string {
+	var all []string
+	for _, p := range patterns {
+		if i := strings.IndexAny(p, `*?[\`); i >= 0 {
+			p = p[:i]
+		}
+		if p == "" {
+			return nil
+		}
+		all = append(all, p)
+	}
+
+	sort.Strings(all)
+	var prefixes []string
+	for _, p := range all {
+		if n := len(prefixes); n > 0 && strings.HasPrefix(p, prefixes[n-1]) {
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// run keeps the tracking enabled, the cache is flushed every time the
+// connections are lost because invalidations could be missed
+func (t *tracker) run() {
+	for {
+		err := t.track()
+		if t.isExiting() {
+			return
+		}
+		if err == errNoTracking {
+			log.Printf("Cache: %s doesn't support client tracking, the values of %s are only invalidated by its own writes", t.config.Host(), t.config.Listen)
+			return
+		}
+		log.Printf("Cache ERROR: tracking of %s at %s: %s", t.config.Listen, t.config.Host(), err)
+		t.cache.flush()
+
+		select {
+		case <-t.exitCh:
+			return
+		case <-time.After(trackingRetry):
+		}
+	}
+}
+
+func (t *tracker) track() error {
+	t.Lock()
+	t.conns = nil
+	t.Unlock()
+
+	sub, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	ctl, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	reader := redis.NewRespReader(sub)
+	sub.SetDeadline(time.Now().Add(connectTimeout))
+	redis.NewResp([]interface{}{"CLIENT", "ID"}).WriteTo(sub)
+	r := reader.Read()
+	if r.IsType(redis.AppErr) {
+		return errNoTracking
+	}
+	id, err := r.Int64()
+	if err != nil {
+		return err
+	}
+	redis.NewResp([]interface{}{"SUBSCRIBE", invalidateChannel}).WriteTo(sub)
+	if r := reader.Read(); r.Err != nil {
+		return r.Err
+	}
+	sub.SetDeadline(time.Time{})
+
+	args := []interface{}{"CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(id, 10), "BCAST"}
+	for _, p := range t.prefixes {
+		args = append(args, "PREFIX", p)
+	}
+	ctl.SetDeadline(time.Now().Add(connectTimeout))
+	redis.NewResp(args).WriteTo(ctl)
+	if r := redis.NewRespReader(ctl).Read(); r.IsType(redis.AppErr) {
+		return errNoTracking
+	} else if r.Err != nil {
+		return r.Err
+	}
+	ctl.SetDeadline(time.Time{})
+	lib.Debugf("Cache: tracking enabled at %s", t.config.Host())
+
+	// The tracking is lost if the connection that enabled it is closed
+	go func() {
+		redis.NewRespReader(ctl).Read()
+		sub.Close()
+	}()
+
+	// Values read before the tracking was enabled could be stale
+	t.cache.flush()
+
+	for {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			return r.Err
+		}
+
+		l, err := r.Array()
+		if err != nil || len(l) != 3 {
+			continue
+		}
+		if kind, _ := l[0].Str(); kind != "message" {
+			continue
+		}
+		keys, err := l[2].List()
+		if err != nil {
+			t.cache.flush() // A null is sent after FLUSHALL and FLUSHDB
+			continue
+		}
+		t.cache.invalidateKeys(keys)
+	}
+}
+
+func (t *tracker) dial() (net.Conn, error) {
+	conn, err := lib.DialRedis(&t.config, t.config.Scheme(), t.config.Host(), connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.exiting {
+		conn.Close()
+		return nil, errExiting
+	}
+	t.conns = append(t.conns, conn)
+	return conn, nil
+}
+
+func (t *tracker) isExiting() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.exiting
+}
+
+func (t *tracker) exit() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.exiting {
+		return
+	}
+	t.exiting = true
+	close(t.exitCh)
+	for _, c := range t.conns {
+		c.Close()
+	}
+}
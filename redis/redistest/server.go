@@ -0,0 +1,560 @@
+// Package redistest implements a minimal in-memory Redis server to be used
+// in the tests of the relayers. It understands a few commands over RESP,
+// each command can be delayed to simulate a slow server. It can also act
+// as a Redis Sentinel for the masters defined with SetMaster, or as a
+// cluster of a single master with SetCluster and its replicas. The client
+// tracking of Redis 6 is supported in broadcasting mode with REDIRECT.
+package redistest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/smart-relayer/redis/radix.improved/cluster"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+var (
+	errUnknown = errors.New("ERR unknown command")
+	errArgs    = errors.New("ERR wrong number of arguments")
+	errNoAuth  = errors.New("NOAUTH Authentication required.")
+	errBadPass = errors.New("WRONGPASS invalid username-password pair")
+	errCross   = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+	respOK     = redis.NewRespSimple("OK")
+	respPong   = redis.NewRespSimple("PONG")
+	respQueued = redis.NewRespSimple("QUEUED")
+)
+
+// Server is a Redis server listening in a random local port
+type Server struct {
+	sync.Mutex
+	listener net.Listener
+	data     map[int]map[string]string
+	delays   map[string]time.Duration
+	counts   map[string]int
+	conns    map[net.Conn]bool
+	username string
+	password string
+	masters  map[string]string   // Sentinel: master name -> host:port
+	subs     map[net.Conn]string // Connections subscribed to a channel
+	cluster  bool
+	replicas []string // Addresses of the replicas in CLUSTER SLOTS
+	master   string   // The server is a cluster replica of this master
+	lastID   int64
+	clients  map[int64]net.Conn
+	tracking map[net.Conn]*tracking // CLIENT TRACKING of each connection
+}
+
+type connState struct {
+	id       int64
+	conn     net.Conn
+	db       int
+	authOK   bool
+	readonly bool
+	multi    [][]string // Commands queued after MULTI, nil if there is no transaction
+}
+
+type tracking struct {
+	redirect int64
+	prefixes []string
+}
+
+const invalidateChannel = "__redis__:invalidate"
+
+// NewServer starts a new server listening in 127.0.0.1
+func NewServer() (*Server, error) {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt starts a new server listening in addr, e.g. to restart a
+// closed server in the same address
+func NewServerAt(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: l,
+		data:     make(map[int]map[string]string),
+		delays:   make(map[string]time.Duration),
+		counts:   make(map[string]int),
+		conns:    make(map[net.Conn]bool),
+		masters:  make(map[string]string),
+		subs:     make(map[net.Conn]string),
+		clients:  make(map[int64]net.Conn),
+		tracking: make(map[net.Conn]*tracking),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port of the server
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// URL returns the address in the format used in the configuration
+func (s *Server) URL() string {
+	return "tcp://" + s.Addr()
+}
+
+// Close stops the server and closes all the connections
+func (s *Server) Close() {
+	s.listener.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// SetDelay makes the server to wait d before executing cmd
+func (s *Server) SetDelay(cmd string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.delays[strings.ToUpper(cmd)] = d
+}
+
+// SetAuth requires the clients to authenticate with AUTH, the username
+// of the password only form is "default"
+func (s *Server) SetAuth(username, password string) {
+	s.Lock()
+	defer s.Unlock()
+	if username == "" {
+		username = "default"
+	}
+	s.username = username
+	s.password = password
+}
+
+// SetCluster makes the server to answer CLUSTER SLOTS with all the slots
+// assigned to itself and the given replicas, and to reject the multi-key
+// commands with keys in different slots
+func (s *Server) SetCluster(replicas ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.cluster = true
+	s.replicas = replicas
+}
+
+// SetReplica makes the server a cluster replica of master, the reads are
+// redirected to the master with MOVED unless READONLY was sent
+func (s *Server) SetReplica(master string) {
+	s.Lock()
+	defer s.Unlock()
+	s.master = master
+}
+
+// SetMaster defines the address of a master for the SENTINEL
+// get-master-addr-by-name command
+func (s *Server) SetMaster(name, addr string) {
+	s.Lock()
+	defer s.Unlock()
+	s.masters[name] = addr
+}
+
+// SwitchMaster changes the address of the master and publishes the
+// +switch-master event to the subscribed connections
+func (s *Server) SwitchMaster(name, addr string) {
+	s.Lock()
+	defer s.Unlock()
+
+	old := s.masters[name]
+	s.masters[name] = addr
+	oldHost, oldPort, _ := net.SplitHostPort(old)
+	newHost, newPort, _ := net.SplitHostPort(addr)
+	msg := redis.NewResp([]interface{}{"message", "+switch-master",
+		strings.Join([]string{name, oldHost, oldPort, newHost, newPort}, " ")})
+	for c, channel := range s.subs {
+		if channel == "+switch-master" {
+			msg.WriteTo(c)
+		}
+	}
+}
+
+// Count returns the number of times cmd was received
+func (s *Server) Count(cmd string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.counts[strings.ToUpper(cmd)]
+}
+
+// Set stores a value in the database db, as if it were written by
+// another client
+func (s *Server) Set(db int, key, value string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.data[db] == nil {
+		s.data[db] = make(map[string]string)
+	}
+	s.data[db][key] = value
+	s.invalidate(key)
+}
+
+// Get returns the value of a key in the database db
+func (s *Server) Get(db int, key string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.data[db][key]
+	return v, ok
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.conns[c] = true
+		s.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	s.Lock()
+	s.lastID++
+	state := &connState{id: s.lastID, conn: c}
+	s.clients[state.id] = c
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.conns, c)
+		delete(s.subs, c)
+		delete(s.clients, state.id)
+		delete(s.tracking, c)
+		s.Unlock()
+		c.Close()
+	}()
+
+	reader := redis.NewRespReader(c)
+	for {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			return
+		}
+
+		args, err := r.List()
+		if err != nil || len(args) == 0 {
+			redis.NewResp(errUnknown).WriteTo(c)
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		s.Lock()
+		s.counts[cmd]++
+		delay := s.delays[cmd]
+		s.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		if cmd == "QUIT" {
+			respOK.WriteTo(c)
+			return
+		}
+		if cmd == "SUBSCRIBE" && len(args) == 2 {
+			// Only one channel, the published messages are written by SwitchMaster
+			s.Lock()
+			s.subs[c] = args[1]
+			redis.NewResp([]interface{}{"subscribe", args[1], 1}).WriteTo(c)
+			s.Unlock()
+			continue
+		}
+		switch {
+		case cmd == "MULTI":
+			state.multi = [][]string{}
+			respOK.WriteTo(c)
+		case cmd == "DISCARD":
+			state.multi = nil
+			respOK.WriteTo(c)
+		case cmd == "EXEC":
+			replies := make([]interface{}, 0, len(state.multi))
+			for _, q := range state.multi {
+				replies = append(replies, s.exec(state, strings.ToUpper(q[0]), q[1:]))
+			}
+			state.multi = nil
+			redis.NewResp(replies).WriteTo(c)
+		case state.multi != nil:
+			state.multi = append(state.multi, args)
+			respQueued.WriteTo(c)
+		default:
+			s.exec(state, cmd, args[1:]).WriteTo(c)
+		}
+	}
+}
+
+func (s *Server) exec(state *connState, cmd string, args []string) *redis.Resp {
+	s.Lock()
+	defer s.Unlock()
+
+	db := s.data[state.db]
+	if db == nil {
+		db = make(map[string]string)
+		s.data[state.db] = db
+	}
+
+	if cmd == "AUTH" {
+		user, pass := "default", ""
+		switch len(args) {
+		case 1:
+			pass = args[0]
+		case 2:
+			user, pass = args[0], args[1]
+		default:
+			return redis.NewResp(errArgs)
+		}
+		if user != s.username || pass != s.password {
+			return redis.NewResp(errBadPass)
+		}
+		state.authOK = true
+		return respOK
+	}
+	if s.password != "" && !state.authOK {
+		return redis.NewResp(errNoAuth)
+	}
+
+	if s.cluster && crossSlot(cmd, args) {
+		return redis.NewResp(errCross)
+	}
+	if cmd == "READONLY" {
+		state.readonly = true
+		return respOK
+	}
+	if s.master != "" && !state.readonly && len(args) > 0 {
+		return redis.NewResp(fmt.Errorf("MOVED %d %s", cluster.Slot(args[0]), s.master))
+	}
+
+	switch cmd {
+	case "CLUSTER":
+		if len(args) != 1 || !s.cluster {
+			return redis.NewResp(errUnknown)
+		}
+		if strings.ToUpper(args[0]) == "INFO" {
+			return redis.NewResp("cluster_state:ok\r\ncluster_slots_assigned:16384\r\n")
+		}
+		if strings.ToUpper(args[0]) != "SLOTS" {
+			return redis.NewResp(errUnknown)
+		}
+		host, port, _ := net.SplitHostPort(s.Addr())
+		p, _ := strconv.Atoi(port)
+		nodes := []interface{}{0, cluster.NumSlots - 1, []interface{}{host, p}}
+		for _, r := range s.replicas {
+			host, port, _ := net.SplitHostPort(r)
+			p, _ := strconv.Atoi(port)
+			nodes = append(nodes, []interface{}{host, p})
+		}
+		return redis.NewResp([]interface{}{nodes})
+	case "PING":
+		return respPong
+	case "ECHO":
+		if len(args) != 1 {
+			return redis.NewResp(errArgs)
+		}
+		return redis.NewResp(args[0])
+	case "SELECT":
+		if len(args) != 1 {
+			return redis.NewResp(errArgs)
+		}
+		n := 0
+		if _, err := fmt.Sscanf(args[0], "%d", &n); err != nil {
+			return redis.NewResp(errors.New("ERR invalid DB index"))
+		}
+		state.db = n
+		return respOK
+	case "GET":
+		if len(args) != 1 {
+			return redis.NewResp(errArgs)
+		}
+		if v, ok := db[args[0]]; ok {
+			return redis.NewResp(v)
+		}
+		return redis.NewResp(nil)
+	case "SET", "SETEX", "PSETEX":
+		if cmd != "SET" && len(args) == 3 {
+			args = []string{args[0], args[2]} // The expiration is ignored
+		}
+		if len(args) < 2 {
+			return redis.NewResp(errArgs)
+		}
+		db[args[0]] = args[1]
+		s.invalidate(args[0])
+		return respOK
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, k := range args {
+			if v, ok := db[k]; ok {
+				values[i] = v
+			}
+		}
+		return redis.NewResp(values)
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return redis.NewResp(errArgs)
+		}
+		for i := 0; i < len(args); i += 2 {
+			db[args[i]] = args[i+1]
+			s.invalidate(args[i])
+		}
+		return respOK
+	case "DEL", "EXISTS":
+		n := 0
+		for _, k := range args {
+			if _, ok := db[k]; ok {
+				n++
+				if cmd == "DEL" {
+					delete(db, k)
+					s.invalidate(k)
+				}
+			}
+		}
+		return redis.NewResp(n)
+	case "SENTINEL":
+		if len(args) != 2 || strings.ToLower(args[0]) != "get-master-addr-by-name" {
+			return redis.NewResp(errArgs)
+		}
+		addr, ok := s.masters[args[1]]
+		if !ok {
+			return redis.NewResp(nil)
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return redis.NewResp([]string{host, port})
+	case "KEYS":
+		if len(args) != 1 {
+			return redis.NewResp(errArgs)
+		}
+		keys := make([]string, 0)
+		for k := range db {
+			if ok, _ := path.Match(args[0], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		return redis.NewResp(keys)
+	case "COMMAND":
+		return redis.NewResp(commandInfo)
+	case "CLIENT":
+		return s.client(state, args)
+	case "FLUSHDB":
+		s.data[state.db] = make(map[string]string)
+		s.invalidate()
+		return respOK
+	}
+	return redis.NewResp(errUnknown)
+}
+
+// client implements CLIENT ID and CLIENT TRACKING, the tracking is always
+// in broadcasting mode
+func (s *Server) client(state *connState, args []string) *redis.Resp {
+	if len(args) == 0 {
+		return redis.NewResp(errArgs)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		return redis.NewResp(state.id)
+	case "TRACKING":
+		if len(args) < 2 {
+			return redis.NewResp(errArgs)
+		}
+		if strings.ToUpper(args[1]) == "OFF" {
+			delete(s.tracking, state.conn)
+			return respOK
+		}
+		t := &tracking{}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "REDIRECT":
+				if i++; i < len(args) {
+					t.redirect, _ = strconv.ParseInt(args[i], 10, 64)
+				}
+			case "PREFIX":
+				if i++; i < len(args) {
+					t.prefixes = append(t.prefixes, args[i])
+				}
+			}
+		}
+		if _, ok := s.clients[t.redirect]; !ok {
+			return redis.NewResp(errors.New("ERR The client ID you want redirect to does not exist"))
+		}
+		s.tracking[state.conn] = t
+		return respOK
+	}
+	return redis.NewResp(errUnknown)
+}
+
+// invalidate sends the invalidation message of the keys to the tracking
+// redirections, all the keys if none is given
+func (s *Server) invalidate(keys ...string) {
+	for _, t := range s.tracking {
+		c := s.clients[t.redirect]
+		if c == nil || s.subs[c] != invalidateChannel {
+			continue
+		}
+		if len(keys) == 0 {
+			redis.NewResp([]interface{}{"message", invalidateChannel, nil}).WriteTo(c)
+			continue
+		}
+		var matched []string
+		for _, k := range keys {
+			if t.matches(k) {
+				matched = append(matched, k)
+			}
+		}
+		if len(matched) > 0 {
+			redis.NewResp([]interface{}{"message", invalidateChannel, matched}).WriteTo(c)
+		}
+	}
+}
+
+func (t *tracking) matches(key string) bool {
+	if len(t.prefixes) == 0 {
+		return true
+	}
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// The reply of COMMAND for the implemented commands with keys
+var commandInfo = []interface{}{
+	[]interface{}{"get", 2, []interface{}{"readonly", "fast"}, 1, 1, 1},
+	[]interface{}{"set", -3, []interface{}{"write", "denyoom"}, 1, 1, 1},
+	[]interface{}{"setex", 4, []interface{}{"write", "denyoom"}, 1, 1, 1},
+	[]interface{}{"psetex", 4, []interface{}{"write", "denyoom"}, 1, 1, 1},
+	[]interface{}{"mget", -2, []interface{}{"readonly", "fast"}, 1, -1, 1},
+	[]interface{}{"mset", -3, []interface{}{"write", "denyoom"}, 1, -1, 2},
+	[]interface{}{"del", -2, []interface{}{"write"}, 1, -1, 1},
+	[]interface{}{"exists", -2, []interface{}{"readonly", "fast"}, 1, -1, 1},
+}
+
+// crossSlot returns true if the keys of a multi-key command are in
+// different slots
+func crossSlot(cmd string, args []string) bool {
+	step := 1
+	switch cmd {
+	case "MSET":
+		step = 2
+	case "MGET", "DEL", "EXISTS":
+	default:
+		return false
+	}
+
+	for i := step; i < len(args); i += step {
+		if cluster.Slot(args[i]) != cluster.Slot(args[0]) {
+			return true
+		}
+	}
+	return false
+}
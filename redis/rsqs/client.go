@@ -22,6 +22,8 @@ const (
 
 var (
 	clientCount int64 = 0
+
+	errBatchFailed = errors.New("SQS rejected messages of the batch")
 )
 
 // Client is the thread that connect to the remote redis server
@@ -162,6 +164,8 @@ func (clt *Client) putRecordBatch() {
 	}
 
 	if err := s.Validate(); err != nil {
+		atomic.AddInt64(&clt.srv.stats.Errors, 1)
+		batchFailures.With(clt.srv.config.Listen).Inc()
 		log.Printf("SQS Validate ERROR: %s", err)
 		return
 	}
@@ -169,19 +173,27 @@ func (clt *Client) putRecordBatch() {
 	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
 	defer cancel()
 
+	start := time.Now()
 	req, output := clt.srv.awsSvc.SendMessageBatchRequest(s)
 	req.SetContext(ctx)
 	if err := req.Send(); err != nil {
+		clt.srv.breaker.Record(start, err)
+		atomic.AddInt64(&clt.srv.stats.Errors, 1)
+		batchFailures.With(clt.srv.config.Listen).Inc()
 		log.Printf("SQS Send ERROR: %s", err)
 		return
 	}
 
 	if len(output.Failed) > 0 {
+		clt.srv.breaker.Record(start, errBatchFailed)
+		atomic.AddInt64(&clt.srv.stats.Errors, 1)
+		batchFailures.With(clt.srv.config.Listen).Inc()
 		log.Printf("SQS client %d ERROR: sent batch with %d records, %d bytes, %d failed: %s - %s",
 			clt.ID, len(clt.batch), clt.batchSize, len(output.Failed), *output.Failed[0].Code, *output.Failed[0].Message)
 		return
 	}
 
+	clt.srv.breaker.Record(start, nil)
 	lib.Debugf("SQS client %d: sent batch with %d records, %d bytes", clt.ID, len(clt.batch), clt.batchSize)
 }
 
@@ -6,6 +6,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -19,10 +20,7 @@ type Server struct {
 	config   lib.RelayerConfig
 	done     chan bool
 	exiting  bool
-	reseting bool
-	failing  bool
 	listener net.Listener
-	tries    int
 	mode     int
 
 	clients        []*Client
@@ -30,9 +28,9 @@ type Server struct {
 	syncRecordCh   chan *syncRecord
 	awsSvc         *sqs.SQS
 	lastConnection time.Time
-	lastError      time.Time
-	errors         int64
 	fifo           bool
+	stats          lib.Counters
+	breaker        *lib.Breaker
 }
 
 type syncRecord struct {
@@ -41,13 +39,10 @@ type syncRecord struct {
 }
 
 const (
-	maxConnections      = 1
-	requestBufferSize   = 10 * 2
-	maxConnectionsTries = 3
-	connectionRetry     = 5 * time.Second
-	errorsFrame         = 10 * time.Second
-	maxErrors           = 10 // Limit of errors to restart the connection
-	connectTimeout      = 5 * time.Second
+	maxConnections    = 1
+	requestBufferSize = 10 * 2
+	connectionRetry   = 5 * time.Second
+	connectTimeout    = 5 * time.Second
 )
 
 var (
@@ -59,6 +54,8 @@ var (
 	respBadCommand = redis.NewResp(errBadCmd)
 	respKO         = redis.NewResp(errKO)
 	commands       map[string]*redis.Resp
+
+	batchFailures = lib.NewCounterVec("sqs_batch_failures_total", "Batches of messages that failed or were partially rejected by SQS", "relayer")
 )
 
 func init() {
@@ -75,9 +72,9 @@ func init() {
 func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
 	srv := &Server{
 		done:         done,
-		errors:       0,
 		recordsCh:    make(chan *lib.InterRecord, requestBufferSize),
 		syncRecordCh: make(chan *syncRecord, requestBufferSize),
+		breaker:      lib.NewBreaker(&c),
 	}
 
 	srv.Reload(&c)
@@ -91,6 +88,7 @@ func (srv *Server) Reload(c *lib.RelayerConfig) (err error) {
 	defer srv.Unlock()
 
 	srv.config = *c
+	srv.breaker.Reload(c)
 
 	if srv.config.MaxConnections <= 0 {
 		srv.config.MaxConnections = maxConnections
@@ -152,6 +150,18 @@ func (srv *Server) Start() (e error) {
 	return
 }
 
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	s.Queued = int64(len(srv.recordsCh) + len(srv.syncRecordCh))
+	s.Gauge("clients", int64(len(srv.clients)))
+	srv.breaker.AddStats(s)
+	return s
+}
+
 // Exit closes the listener and send done to main
 func (srv *Server) Exit() {
 	srv.exiting = true
@@ -169,6 +179,8 @@ func (srv *Server) Exit() {
 		log.Printf("SQS: messages lost %d", len(srv.recordsCh))
 	}
 
+	srv.breaker.Close()
+
 	// finishing the server
 	srv.done <- true
 }
@@ -177,7 +189,7 @@ func (srv *Server) canSend() bool {
 	srv.Lock()
 	defer srv.Unlock()
 
-	if srv.exiting || srv.failing {
+	if srv.exiting || len(srv.clients) == 0 {
 		return false
 	}
 
@@ -188,7 +200,10 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 
 	defer netCon.Close()
 
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
 	reader := redis.NewRespReader(netCon)
+	session := lib.NewSession(&srv.config)
 
 	syncConn := &syncRecord{
 		syncCh: make(chan bool),
@@ -212,6 +227,7 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 		}
 
 		if !srv.canSend() {
+			atomic.AddInt64(&srv.stats.Errors, 1)
 			respKO.WriteTo(netCon)
 			return
 		}
@@ -222,11 +238,24 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 			continue
 		}
 
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			resp.WriteTo(netCon)
+			continue
+		}
+
 		fastResponse, ok := commands[req.Command]
 		if !ok {
 			respBadCommand.WriteTo(netCon)
 			continue
 		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
+
+		if req.Command != "PING" {
+			if err := srv.breaker.Allow(); err != nil {
+				redis.NewResp(err).WriteTo(netCon)
+				continue
+			}
+		}
 
 		switch req.Command {
 		case "PING":
@@ -271,6 +300,7 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 
 		// Smart mode, answer immediately and forget
 		if srv.mode == lib.ModeSmart {
+			atomic.AddInt64(&srv.stats.Async, 1)
 			srv.recordsCh <- syncConn.r
 			fastResponse.WriteTo(netCon)
 			continue
@@ -280,6 +310,7 @@ func (srv *Server) handleConnection(netCon net.Conn) {
 
 		b := <-syncConn.syncCh
 		if b == false {
+			atomic.AddInt64(&srv.stats.Errors, 1)
 			respKO.WriteTo(netCon)
 		} else {
 			fastResponse.WriteTo(netCon)
@@ -12,46 +12,23 @@ import (
 	"github.com/gallir/smart-relayer/lib"
 )
 
-func (srv *Server) failure() {
-	srv.Lock()
-	defer srv.Unlock()
-
-	if srv.reseting || srv.exiting {
-		return
-	}
-
-	if time.Now().Sub(srv.lastError) > errorsFrame {
-		srv.errors = 0
-	}
-
-	srv.errors++
-	srv.lastError = time.Now()
-	log.Printf("SQS: %d errors detected", srv.errors)
-
-	if srv.errors > maxErrors {
-		go srv.retry()
-	}
-}
-
+// retry connects to SQS until it works, the results are notified to the
+// breaker of the relayer
 func (srv *Server) retry() {
-	srv.Lock()
-	defer srv.Unlock()
-
-	if srv.clientsReset() == nil {
-		return
-	}
-
-	srv.tries++
-	log.Printf("SQS ERROR: %d attempts to connect to SQS: %s", srv.tries, srv.config.URL)
-
-	if srv.tries >= maxConnectionsTries {
-		srv.failing = true
-		time.Sleep(connectionRetry * 2)
-	} else {
+	for {
+		start := time.Now()
+		srv.Lock()
+		err := srv.clientsReset()
+		url := srv.config.URL
+		srv.Unlock()
+
+		srv.breaker.Record(start, err)
+		if err == nil {
+			return
+		}
+		log.Printf("SQS ERROR: failed to connect to SQS: %s", url)
 		time.Sleep(connectionRetry)
 	}
-
-	go srv.retry()
 }
 
 func (srv *Server) clientsReset() (err error) {
@@ -60,9 +37,6 @@ func (srv *Server) clientsReset() (err error) {
 		return nil
 	}
 
-	srv.reseting = true
-	defer func() { srv.reseting = false }()
-
 	lib.Debugf("SQS Reload config to the stream %s listen %s", srv.config.URL, srv.config.Listen)
 
 	var sess *session.Session
@@ -75,9 +49,6 @@ func (srv *Server) clientsReset() (err error) {
 
 	if err != nil {
 		log.Printf("SQS ERROR: session: %s", err)
-
-		srv.errors++
-		srv.lastError = time.Now()
 		return err
 	}
 
@@ -98,8 +69,6 @@ func (srv *Server) clientsReset() (err error) {
 	lib.Debugf("SQS Connected to %s", srv.config.URL)
 
 	srv.lastConnection = time.Now()
-	srv.errors = 0
-	srv.failing = false
 
 	currClients := len(srv.clients)
 
@@ -0,0 +1,539 @@
+// Package sharded implements a relayer that distributes the commands among
+// several standalone Redis servers, like twemproxy. The keys are assigned
+// to the servers with a ketama consistent hashing ring, the URLs are
+// separated by spaces and can have a weight, 1 by default, e.g.
+//
+//	url = "tcp://10.0.0.1:6379?weight=2 tcp://10.0.0.2:6379"
+//
+// A command can use several keys only if they are in the same server,
+// hashtags ("hashTag" option) allow to store related keys together.
+// With ejectFailures > 0 the servers are checked every second with a PING and
+// removed from the ring for ejectSecs after that number of consecutive failures,
+// their keys are assigned to the other servers meanwhile.
+package sharded
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	rediscmd "github.com/gallir/smart-relayer/redis/commands"
+	"github.com/gallir/smart-relayer/redis/radix"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// Server is the thread that listen for clients' connections
+type Server struct {
+	sync.Mutex
+	config       lib.RelayerConfig
+	mode         int
+	done         chan bool
+	exiting      bool
+	listener     net.Listener
+	nodes        []*node
+	ring         atomic.Value // *ring
+	asynCommands atomic.Value
+	stats        lib.Counters
+	dropped      int64 // Async commands that failed, they are lost
+	probeCh      chan bool
+}
+
+const (
+	requestBufferSize = 1024
+	closeTimeout      = 1 * time.Second
+	probePeriod       = 1 * time.Second
+	probeTimeout      = 2 * time.Second
+	selectCommand     = "SELECT"
+	pingCommand       = "PING"
+	quitCommand       = "QUIT"
+)
+
+var (
+	errBadCmd      = errors.New("ERR bad command")
+	errNoKey       = errors.New("ERR command without keys not supported by the sharded relayer")
+	errCrossNode   = errors.New("ERR keys in request don't hash to the same node")
+	errNoNodes     = errors.New("ERR no available nodes")
+	errBadWeight   = errors.New("bad weight in URL, it must be a number greater than 0")
+	respOK         = redis.NewRespSimple("OK")
+	respPong       = redis.NewRespSimple("PONG")
+	respTrue       = redis.NewResp(1)
+	respBadCommand = redis.NewResp(errBadCmd)
+	respNoKey      = redis.NewResp(errNoKey)
+	respCrossNode  = redis.NewResp(errCrossNode)
+	respNoNodes    = redis.NewResp(errNoNodes)
+	commands       map[string]*redis.Resp
+
+	ejectedGauge  = lib.NewGaugeVec("sharded_node_ejected", "1 if the node is ejected from the ring", "relayer", "node")
+	droppedWrites = lib.NewCounterVec("sharded_dropped_total", "Async commands that failed in a node", "relayer", "node")
+)
+
+func init() {
+	// These are the commands that can be sent in "background" when in smart mode
+	// The values are the immediate responses to the clients
+	commands = map[string]*redis.Resp{
+		"SET":       respOK,
+		"SETEX":     respOK,
+		"PSETEX":    respOK,
+		"MSET":      respOK,
+		"HMSET":     respOK,
+		"HSET":      respTrue,
+		"SADD":      respTrue,
+		"ZADD":      respTrue,
+		"EXPIRE":    respTrue,
+		"EXPIREAT":  respTrue,
+		"PEXPIRE":   respTrue,
+		"PEXPIREAT": respTrue,
+	}
+}
+
+// New creates a new sharded Redis local server
+func New(c lib.RelayerConfig, done chan bool) (*Server, error) {
+	srv := &Server{
+		done:    done,
+		probeCh: make(chan bool),
+	}
+	if err := srv.Reload(&c); err != nil {
+		return nil, err
+	}
+	if c.LoadCommands {
+		if err := lib.LoadCommands(&srv.config); err != nil {
+			log.Printf("Error loading the commands from %s: %s", srv.config.Host(), err)
+		}
+	}
+	go srv.prober()
+	return srv, nil
+}
+
+// Start accepts incoming connections on the Listener
+func (srv *Server) Start() (e error) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	srv.listener, e = lib.NewListener(srv.config)
+	if e != nil {
+		return e
+	}
+
+	// Serve clients
+	go func(l net.Listener) {
+		defer l.Close()
+		for {
+			netConn, e := l.Accept()
+			if e != nil {
+				if netErr, ok := e.(net.Error); ok && netErr.Timeout() {
+					// Paranoid, ignore timeout errors
+					log.Println("Timeout at local listener", srv.config.ListenHost(), e)
+					continue
+				}
+				if srv.exiting {
+					log.Println("Exiting local listener", srv.config.ListenHost())
+					return
+				}
+				log.Fatalln("Emergency error in local listener", srv.config.ListenHost(), e)
+				return
+			}
+			go srv.handleConnection(netConn)
+		}
+	}(srv.listener)
+
+	return nil
+}
+
+// Reload the configuration, the pools are created again if the nodes changed
+func (srv *Server) Reload(c *lib.RelayerConfig) error {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.nodes == nil || srv.config.ConnectionChanged(c) {
+		nodes := make([]*node, 0, len(c.URLs()))
+		for _, u := range c.URLs() {
+			n, err := newNode(*c, u, &srv.stats)
+			if err != nil {
+				for _, n := range nodes {
+					n.pool.Reset()
+				}
+				return err
+			}
+			nodes = append(nodes, n)
+		}
+		if len(nodes) == 0 {
+			return errNoNodes
+		}
+
+		for _, n := range srv.nodes {
+			log.Printf("Reset sharded node %s at port %s", n.name, srv.config.Listen)
+			ejectedGauge.Delete(srv.config.Listen, n.name)
+			n.pool.Reset()
+		}
+		srv.nodes = nodes
+		for _, n := range nodes {
+			n := n
+			ejectedGauge.SetFunc(func() float64 {
+				if n.ejected() {
+					return 1
+				}
+				return 0
+			}, c.Listen, n.name)
+		}
+	} else {
+		log.Printf("Reload sharded config at port %s", c.Listen)
+		for _, n := range srv.nodes {
+			n.reload(*c)
+		}
+	}
+
+	srv.config = *c
+	srv.mode = c.Type()
+	srv.buildRing()
+
+	async := make(map[string]*redis.Resp)
+	for r, s := range commands {
+		async[r] = s
+	}
+	for _, s := range strings.Fields(srv.config.AsynCommands) {
+		name := strings.ToUpper(s)
+		if !rediscmd.CanBeAsync(name) {
+			log.Printf("Command %s can't be async at port %s, ignored", name, srv.config.Listen)
+			continue
+		}
+		async[name] = respOK
+	}
+	srv.asynCommands.Store(async)
+	return nil
+}
+
+// buildRing creates the ring with the nodes not ejected, called with the lock
+func (srv *Server) buildRing() {
+	active := make([]*node, 0, len(srv.nodes))
+	for _, n := range srv.nodes {
+		if !n.ejected() {
+			active = append(active, n)
+		}
+	}
+	srv.ring.Store(newRing(active, srv.config.HashTag))
+}
+
+// prober checks the nodes periodically if the ejection is enabled
+func (srv *Server) prober() {
+	ticker := time.NewTicker(probePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-srv.probeCh:
+			return
+		case <-ticker.C:
+		}
+
+		srv.Lock()
+		nodes := srv.nodes
+		limit := srv.config.EjectFailures
+		period := time.Duration(srv.config.EjectSecs) * time.Second
+		srv.Unlock()
+
+		if limit <= 0 {
+			continue
+		}
+
+		changed := false
+		for _, n := range nodes {
+			if n.ejected() {
+				continue
+			}
+			if n.probe(probeTimeout) == nil {
+				n.succeeded()
+			} else if n.failed(limit, period) {
+				changed = true
+			}
+		}
+
+		// Ejected nodes come back once their period finished
+		srv.Lock()
+		ring := srv.ring.Load().(*ring)
+		active := 0
+		for _, n := range srv.nodes {
+			if !n.ejected() {
+				active++
+			}
+		}
+		if changed || active != ring.count {
+			srv.buildRing()
+		}
+		srv.Unlock()
+	}
+}
+
+// Stats returns the counters and the current state of the relayer
+func (srv *Server) Stats() *lib.Stats {
+	srv.Lock()
+	defer srv.Unlock()
+
+	s := srv.stats.Stats(&srv.config)
+	ejected := int64(0)
+	for _, n := range srv.nodes {
+		if n.ejected() {
+			ejected++
+		}
+	}
+	s.Gauge("nodes", int64(len(srv.nodes)))
+	s.Gauge("ejected", ejected)
+	s.Gauge("dropped", atomic.LoadInt64(&srv.dropped))
+	return s
+}
+
+// result counts the connection failures of the requests to the node, as
+// the prober does, it's ejected after EjectFailures consecutive ones
+func (srv *Server) result(n *node, err error) {
+	if err == nil {
+		n.succeeded()
+		return
+	}
+
+	srv.Lock()
+	defer srv.Unlock()
+	if n.failed(srv.config.EjectFailures, time.Duration(srv.config.EjectSecs)*time.Second) {
+		srv.buildRing()
+	}
+}
+
+// drop counts an async command that couldn't be sent to the node
+func (srv *Server) drop(n *node, err error) {
+	atomic.AddInt64(&srv.dropped, 1)
+	droppedWrites.With(srv.config.Listen, n.name).Inc()
+	lib.Debugf("Sharded: async command dropped in %s: %s", n.name, err)
+	srv.result(n, err)
+}
+
+// Exit closes the listener and send done to main
+func (srv *Server) Exit() {
+	srv.exiting = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	close(srv.probeCh)
+
+	srv.Lock()
+	for _, n := range srv.nodes {
+		ejectedGauge.Delete(srv.config.Listen, n.name)
+	}
+	srv.Unlock()
+	srv.done <- true
+}
+
+// route returns the node for the keys of the request
+func (srv *Server) route(req *lib.Request) (*node, *redis.Resp) {
+	keys, all := req.Keys()
+	if all || len(keys) == 0 {
+		return nil, respNoKey
+	}
+
+	ring := srv.ring.Load().(*ring)
+	n := ring.get(keys[0])
+	if n == nil {
+		return nil, respNoNodes
+	}
+	for _, k := range keys[1:] {
+		if ring.get(k) != n {
+			return nil, respCrossNode
+		}
+	}
+	return n, nil
+}
+
+func (srv *Server) handleConnection(netCon net.Conn) {
+	defer netCon.Close()
+
+	atomic.AddInt64(&srv.stats.Connections, 1)
+
+	reader := redis.NewRespReader(netCon)
+	session := lib.NewSession(&srv.config)
+
+	// The responses come from different nodes, they are written in order
+	replies := newReplies(netCon)
+	defer replies.close()
+
+	clients := make(map[*node]*redis2.Client)
+	defer func() {
+		for n, c := range clients {
+			n.pool.Put(c)
+		}
+	}()
+
+	currentDB := 0
+
+	for {
+		r := reader.Read()
+		if r.IsType(redis.IOErr) {
+			if redis.IsTimeout(r) {
+				// Paranoid, don't close it just log it
+				log.Println("Local client listen timeout at", srv.config.Listen)
+				continue
+			}
+			// Connection was closed
+			return
+		}
+
+		req := lib.NewRequest(r, &srv.config)
+		if req == nil {
+			replies.add(respBadCommand)
+			continue
+		}
+
+		if resp := session.Check(req.Command, req.Items); resp != nil {
+			replies.add(resp)
+			continue
+		}
+		if err := rediscmd.CheckArity(req.Command, len(req.Items)); err != nil {
+			replies.add(redis.NewResp(err))
+			continue
+		}
+		atomic.AddInt64(&srv.stats.Commands, 1)
+
+		// SELECT and PING are answered locally, the database
+		// is changed by the clients in every node when needed
+		switch req.Command {
+		case selectCommand:
+			if req.Database == lib.UnknownDB {
+				replies.add(respBadCommand)
+				continue
+			}
+			currentDB = req.Database
+			replies.add(respOK)
+			continue
+		case pingCommand:
+			replies.add(respPong)
+			continue
+		case quitCommand:
+			replies.add(respOK)
+			return
+		}
+		req.Database = currentDB
+
+		n, errResp := srv.route(req)
+		if errResp != nil {
+			replies.add(errResp)
+			continue
+		}
+
+		client, ok := clients[n]
+		if !ok {
+			client = n.pool.Get()
+			clients[n] = client
+		}
+
+		// Smart mode, answer immediately and forget
+		if srv.mode == lib.ModeSmart {
+			if async, ok := srv.asynCommands.Load().(map[string]*redis.Resp); ok {
+				if fastResponse, ok := async[req.Command]; ok {
+					replies.add(fastResponse)
+					atomic.AddInt64(&srv.stats.Async, 1)
+					req.OnDone = func() {
+						if req.Err != nil {
+							srv.drop(n, req.Err)
+						} else {
+							n.succeeded()
+						}
+					}
+					if e := client.Send(req); e != nil {
+						req.OnDone = nil
+						srv.drop(n, e)
+					}
+					continue
+				}
+			}
+		}
+
+		// Synchronized mode
+		rep := replies.next()
+		req.Conn = rep
+		req.OnDone = func() {
+			srv.result(n, req.Err)
+			rep.finish()
+		}
+		if e := client.Send(req); e != nil {
+			req.OnDone = nil
+			srv.result(n, e)
+			redis.NewResp(e).WriteTo(rep)
+			rep.finish()
+		}
+	}
+}
+
+// reply stores the response of a request until it can be written
+type reply struct {
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+func (r *reply) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+func (r *reply) finish() {
+	close(r.done)
+}
+
+// replies writes the responses to the local client in the same order of the requests
+type replies struct {
+	conn     net.Conn
+	ch       chan *reply
+	exitCh   chan bool
+	finished chan bool
+}
+
+func newReplies(conn net.Conn) *replies {
+	rs := &replies{
+		conn:     conn,
+		ch:       make(chan *reply, requestBufferSize),
+		exitCh:   make(chan bool),
+		finished: make(chan bool),
+	}
+	go rs.writer()
+	return rs
+}
+
+// next returns a new reply in the queue, it will be written once finished
+func (rs *replies) next() *reply {
+	r := &reply{
+		done: make(chan struct{}),
+	}
+	rs.ch <- r
+	return r
+}
+
+// add queues an already known response
+func (rs *replies) add(resp *redis.Resp) {
+	r := rs.next()
+	resp.WriteTo(r)
+	r.finish()
+}
+
+func (rs *replies) writer() {
+	defer close(rs.finished)
+	for r := range rs.ch {
+		select {
+		case <-r.done:
+		case <-rs.exitCh:
+			return
+		}
+		if _, err := rs.conn.Write(r.buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// close waits for the pending responses, they are discarded after closeTimeout
+func (rs *replies) close() {
+	close(rs.ch)
+	select {
+	case <-rs.finished:
+	case <-time.After(closeTimeout):
+		close(rs.exitCh)
+	}
+}
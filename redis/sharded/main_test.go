@@ -0,0 +1,189 @@
+package sharded
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+	"github.com/gallir/smart-relayer/redis/redistest"
+)
+
+func startServers(t *testing.T, n int) []*redistest.Server {
+	servers := make([]*redistest.Server, n)
+	for i := range servers {
+		rs, err := redistest.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = rs
+	}
+	return servers
+}
+
+func startRelayer(t *testing.T, c lib.RelayerConfig) (*Server, net.Conn) {
+	srv, err := New(c, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, conn
+}
+
+func TestShardedBadWeight(t *testing.T) {
+	rs, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	for _, w := range []string{"0", "-1", "x"} {
+		_, err := New(lib.RelayerConfig{
+			Protocol: "redis-sharded",
+			Mode:     "sync",
+			Listen:   "tcp://127.0.0.1:0",
+			URL:      rs.URL() + "?weight=" + w,
+		}, make(chan bool, 1))
+		if err != errBadWeight {
+			t.Errorf("weight %s: expected errBadWeight, got %v", w, err)
+		}
+	}
+}
+
+func TestShardedRouting(t *testing.T) {
+	servers := startServers(t, 2)
+	for _, rs := range servers {
+		defer rs.Close()
+	}
+	// The responses of the slow node must be written in order
+	servers[0].SetDelay("GET", 20*time.Millisecond)
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol: "redis-sharded",
+		Mode:     "sync",
+		Listen:   "tcp://127.0.0.1:0",
+		URL:      servers[0].URL() + " " + servers[1].URL(),
+		HashTag:  "{}",
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		redis.NewResp([]interface{}{"SET", fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)}).WriteTo(conn)
+	}
+	for i := 0; i < n; i++ {
+		redis.NewResp([]interface{}{"GET", fmt.Sprintf("k%d", i)}).WriteTo(conn)
+	}
+
+	reader := redis.NewRespReader(conn)
+	for i := 0; i < n; i++ {
+		if s, _ := reader.Read().Str(); s != "OK" {
+			t.Fatalf("SET k%d: expected OK, got %q", i, s)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if s, _ := reader.Read().Str(); s != fmt.Sprintf("v%d", i) {
+			t.Fatalf("GET k%d: expected v%d, got %q", i, i, s)
+		}
+	}
+
+	if servers[0].Count("SET") == 0 || servers[1].Count("SET") == 0 {
+		t.Errorf("keys not distributed: %d %d", servers[0].Count("SET"), servers[1].Count("SET"))
+	}
+
+	redis.NewResp([]interface{}{"MGET", "{a}1", "{a}2"}).WriteTo(conn)
+	if r := reader.Read(); r.Err != nil {
+		t.Errorf("MGET with hashtag: %s", r.Err)
+	}
+	redis.NewResp([]interface{}{"KEYS", "*"}).WriteTo(conn)
+	if r := reader.Read(); r.Err == nil {
+		t.Error("KEYS must be rejected")
+	}
+}
+
+func TestShardedEject(t *testing.T) {
+	servers := startServers(t, 2)
+	defer servers[1].Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:      "redis-sharded",
+		Mode:          "sync",
+		Listen:        "tcp://127.0.0.1:0",
+		URL:           servers[0].URL() + " " + servers[1].URL(),
+		EjectFailures: 1,
+		EjectSecs:     60,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+
+	servers[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.ring.Load().(*ring).count != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the failed node wasn't ejected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// All the keys go to the remaining node
+	reader := redis.NewRespReader(conn)
+	for i := 0; i < 10; i++ {
+		redis.NewResp([]interface{}{"SET", fmt.Sprintf("k%d", i), "1"}).WriteTo(conn)
+		if s, _ := reader.Read().Str(); s != "OK" {
+			t.Fatalf("SET k%d: expected OK, got %q", i, s)
+		}
+	}
+	if c := servers[1].Count("SET"); c != 10 {
+		t.Errorf("expected 10 SET in the remaining node, got %d", c)
+	}
+}
+
+func TestShardedEjectByRequests(t *testing.T) {
+	servers := startServers(t, 2)
+	defer servers[1].Close()
+
+	srv, conn := startRelayer(t, lib.RelayerConfig{
+		Protocol:      "redis-sharded",
+		Mode:          "smart",
+		Listen:        "tcp://127.0.0.1:0",
+		URL:           servers[0].URL() + " " + servers[1].URL(),
+		EjectFailures: 5,
+		EjectSecs:     60,
+	})
+	defer srv.Exit()
+	defer conn.Close()
+	servers[0].Close()
+
+	// The async commands that fail are counted
+	reader := redis.NewRespReader(conn)
+	start := time.Now()
+	for i := 0; srv.Stats().Gauges["dropped"] == 0; i++ {
+		if i > 100 {
+			t.Fatal("the failed async commands weren't counted")
+		}
+		redis.NewResp([]interface{}{"SET", fmt.Sprintf("k%d", i), "1"}).WriteTo(conn)
+		if s, _ := reader.Read().Str(); s != "OK" {
+			t.Fatalf("SET k%d: expected OK, got %q", i, s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The failed requests eject the node before the prober does it
+	for i := 0; srv.ring.Load().(*ring).count != 1; i++ {
+		if time.Since(start) > 900*time.Millisecond {
+			t.Fatal("the failed node wasn't ejected by the requests")
+		}
+		redis.NewResp([]interface{}{"GET", fmt.Sprintf("k%d", i)}).WriteTo(conn)
+		reader.Read()
+	}
+}
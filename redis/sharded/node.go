@@ -0,0 +1,91 @@
+package sharded
+
+import (
+	"log"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/smart-relayer/lib"
+	"github.com/gallir/smart-relayer/redis/radix"
+	"github.com/gallir/smart-relayer/redis/radix.improved/redis"
+)
+
+// node is one of the Redis servers of the ring
+type node struct {
+	name         string // host:port, used to build the ring
+	config       lib.RelayerConfig
+	weight       int
+	pool         *redis2.Pool
+	failures     int32
+	ejectedUntil int64 // Unix nano
+}
+
+func newNode(c lib.RelayerConfig, rawurl string, stats *lib.Counters) (*node, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{
+		name:   u.Host,
+		weight: 1,
+	}
+	// A node without weight would have no points in the ring
+	if w := u.Query().Get("weight"); w != "" {
+		n.weight, err = strconv.Atoi(w)
+		if err != nil || n.weight < 1 {
+			return nil, errBadWeight
+		}
+	}
+
+	u.RawQuery = ""
+	c.URL = u.String()
+	n.config = c
+	n.pool = redis2.NewPool(&n.config, stats, nil, nil, nil, nil)
+	return n, nil
+}
+
+func (n *node) reload(c lib.RelayerConfig) {
+	c.URL = n.config.URL
+	n.config = c
+	n.pool.Reload(&n.config)
+}
+
+func (n *node) ejected() bool {
+	return atomic.LoadInt64(&n.ejectedUntil) > time.Now().UnixNano()
+}
+
+// failed counts a failure, it returns true if the node was ejected
+func (n *node) failed(limit int, period time.Duration) bool {
+	f := atomic.AddInt32(&n.failures, 1)
+	if limit <= 0 || int(f) < limit || n.ejected() {
+		return false
+	}
+
+	atomic.StoreInt32(&n.failures, 0)
+	atomic.StoreInt64(&n.ejectedUntil, time.Now().Add(period).UnixNano())
+	log.Printf("Sharded: node %s ejected for %s after %d failures", n.name, period, f)
+	return true
+}
+
+func (n *node) succeeded() {
+	atomic.StoreInt32(&n.failures, 0)
+}
+
+// probe checks the node with a PING in a new connection
+func (n *node) probe(timeout time.Duration) error {
+	conn, err := lib.DialRedis(&n.config, n.config.Scheme(), n.config.Host(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := redis.NewResp([]interface{}{"PING"}).WriteTo(conn); err != nil {
+		return err
+	}
+	r := redis.NewRespReader(conn).Read()
+	return r.Err
+}
@@ -0,0 +1,98 @@
+package sharded
+
+import (
+	"crypto/md5"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ketama consistent hashing, compatible with the libmemcached and
+// twemproxy distribution: 160 points per node proportional to its weight,
+// 4 points from every md5 digest
+
+const pointsPerNode = 160
+
+type point struct {
+	hash uint32
+	node *node
+}
+
+type ring struct {
+	points  []point
+	hashTag string
+	count   int // Number of nodes
+}
+
+func newRing(nodes []*node, hashTag string) *ring {
+	r := &ring{
+		hashTag: hashTag,
+		count:   len(nodes),
+	}
+
+	total := 0
+	for _, n := range nodes {
+		total += n.weight
+	}
+	if total == 0 {
+		return r
+	}
+
+	for _, n := range nodes {
+		pct := float64(n.weight) / float64(total)
+		count := int(pct * pointsPerNode / 4 * float64(len(nodes)))
+		for i := 0; i < count; i++ {
+			digest := md5.Sum([]byte(n.name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, point{
+					hash: uint32(digest[3+j*4])<<24 | uint32(digest[2+j*4])<<16 | uint32(digest[1+j*4])<<8 | uint32(digest[j*4]),
+					node: n,
+				})
+			}
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// get returns the node for the key, nil if the ring is empty
+func (r *ring) get(key string) *node {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hash(r.hashKey(key))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// hashKey returns the part of the key between the hashtag characters
+// if it's not empty, otherwise the whole key
+func (r *ring) hashKey(key string) string {
+	if len(r.hashTag) != 2 {
+		return key
+	}
+
+	start := strings.IndexByte(key, r.hashTag[0])
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], r.hashTag[1])
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+func hash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return uint32(digest[3])<<24 | uint32(digest[2])<<16 | uint32(digest[1])<<8 | uint32(digest[0])
+}
@@ -0,0 +1,68 @@
+package sharded
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testNodes(weights ...int) []*node {
+	nodes := make([]*node, len(weights))
+	for i, w := range weights {
+		nodes[i] = &node{name: fmt.Sprintf("10.0.0.%d:6379", i+1), weight: w}
+	}
+	return nodes
+}
+
+func TestRingWeights(t *testing.T) {
+	nodes := testNodes(1, 1, 2)
+	r := newRing(nodes, "")
+
+	counts := make(map[*node]int)
+	for i := 0; i < 40000; i++ {
+		counts[r.get(fmt.Sprintf("key:%d", i))]++
+	}
+
+	// The node with weight 2 must receive about the half of the keys
+	if c := counts[nodes[2]]; c < 16000 || c > 24000 {
+		t.Errorf("bad distribution: %d keys for the node with weight 2", c)
+	}
+	for _, n := range nodes[:2] {
+		if c := counts[n]; c < 6000 || c > 14000 {
+			t.Errorf("bad distribution: %d keys for %s", c, n.name)
+		}
+	}
+}
+
+func TestRingConsistency(t *testing.T) {
+	nodes := testNodes(1, 1, 1, 1)
+	full := newRing(nodes, "")
+	partial := newRing(nodes[:3], "")
+
+	// Only the keys of the removed node must move
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("key:%d", i)
+		if n := full.get(k); n != nodes[3] && partial.get(k) != n {
+			t.Fatalf("key %s moved from %s to %s", k, n.name, partial.get(k).name)
+		}
+	}
+}
+
+func TestRingHashTag(t *testing.T) {
+	r := newRing(testNodes(1, 1, 1), "{}")
+
+	if k := r.hashKey("user:{42}:name"); k != "42" {
+		t.Errorf("bad hash key %q", k)
+	}
+	if k := r.hashKey("user:{}:name"); k != "user:{}:name" {
+		t.Errorf("empty hashtag must use the whole key, got %q", k)
+	}
+	for i := 0; i < 100; i++ {
+		if r.get(fmt.Sprintf("{user%d}:a", i)) != r.get(fmt.Sprintf("{user%d}:b", i)) {
+			t.Fatal("keys with the same hashtag in different nodes")
+		}
+	}
+
+	if newRing(nil, "").get("a") != nil {
+		t.Error("empty ring must return nil")
+	}
+}